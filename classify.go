@@ -0,0 +1,101 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Classification API for external log pipelines.
+
+ A batch of logs (stream labels plus the raw line) is POSTed either as
+a JSON array or as newline delimited JSON objects, and the response
+contains the verdict and the matching rule for each log, in the same
+format and order. The current ruleset snapshot is used, so the
+database lock is not needed (see data/classify.go).
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/fingon/lixie/data"
+)
+
+const (
+	classifyMaxBodySize   = 64 << 20
+	classifyContentNDJSON = "application/x-ndjson"
+	classifyVersionHeader = "X-Lixie-Rules-Version"
+)
+
+type classifyResponse struct {
+	Version int                   `json:"version"`
+	Results []data.ClassifyResult `json:"results"`
+}
+
+// decodeClassifyRequests decodes either a JSON array or NDJSON; the
+// boolean is true for NDJSON
+func decodeClassifyRequests(body []byte) ([]data.ClassifyRequest, bool, error) {
+	var requests []data.ClassifyRequest
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		err := json.Unmarshal(body, &requests)
+		return requests, false, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	for {
+		var request data.ClassifyRequest
+		err := decoder.Decode(&request)
+		if errors.Is(err, io.EOF) {
+			return requests, true, nil
+		}
+		if err != nil {
+			return nil, true, err
+		}
+		requests = append(requests, request)
+	}
+}
+
+func classifyHandler(st State) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, classifyMaxBodySize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requests, ndjson, err := decodeClassifyRequests(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		snapshot := st.DB.LogRulesSnapshot()
+		results := snapshot.Classify(requests)
+		w.Header().Set(classifyVersionHeader, strconv.Itoa(snapshot.Version))
+		if ndjson {
+			w.Header().Set("Content-Type", classifyContentNDJSON)
+			encoder := json.NewEncoder(w)
+			for _, result := range results {
+				if err := encoder.Encode(result); err != nil {
+					return
+				}
+			}
+			return
+		}
+		if results == nil {
+			results = []data.ClassifyResult{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(classifyResponse{Version: snapshot.Version, Results: results})
+	})
+}
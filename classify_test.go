@@ -0,0 +1,54 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fingon/lixie/data"
+	"gotest.tools/v3/assert"
+)
+
+func TestClassifyHandler(t *testing.T) {
+	path := "test_db.json"
+	_ = os.Remove(path)
+	defer os.Remove(path)
+
+	db := data.Database{Path: path}
+	assert.Equal(t, db.Add(data.LogRule{Matchers: []data.LogFieldMatcher{{Field: "message", Op: data.OpContains, Value: "cron"}}}), nil)
+	st := State{DB: &db}
+	classify := func(method, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		classifyHandler(st).ServeHTTP(w, httptest.NewRequest(method, apiClassify.Path, strings.NewReader(body)))
+		return w
+	}
+
+	w := classify(http.MethodPost, `{"stream": {"source": "a"}, "line": "cron job"}
+{"line": "{\"message\": \"other\"}"}
+`)
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Header().Get("Content-Type"), classifyContentNDJSON)
+	assert.Equal(t, w.Header().Get(classifyVersionHeader), "1")
+	assert.Equal(t, w.Body.String(), `{"verdict":"spam","rule":{"id":1,"version":0}}
+{"verdict":"unknown"}
+`)
+
+	w = classify(http.MethodPost, ` [{"line": "cron"}]`)
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Body.String(), `{"version":1,"results":[{"verdict":"spam","rule":{"id":1,"version":0}}]}`+"\n")
+
+	w = classify(http.MethodPost, `[]`)
+	assert.Equal(t, w.Body.String(), `{"version":1,"results":[]}`+"\n")
+
+	assert.Equal(t, classify(http.MethodPost, `{"line": 1}`).Code, http.StatusBadRequest)
+	assert.Equal(t, classify(http.MethodGet, "").Code, http.StatusMethodNotAllowed)
+}
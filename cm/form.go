@@ -7,7 +7,10 @@
 
 package cm
 
-import "strconv"
+import (
+	"strconv"
+	"time"
+)
 
 type FormValued interface {
 	FormValue(string) string
@@ -43,6 +46,17 @@ func Uint64FromForm(r FormValued, key string, value *uint64) (found bool, err er
 	return
 }
 
+// TimeFromForm parses local time in the given layout
+func TimeFromForm(r FormValued, key, layout string, value *time.Time) (found bool, err error) {
+	raw := r.FormValue(key)
+	if raw == "" {
+		return
+	}
+	found = true
+	*value, err = time.ParseInLocation(layout, raw, time.Local)
+	return
+}
+
 func BoolFromForm(r FormValued, key string, value *bool) {
 	raw := r.FormValue(key)
 	if raw == "" || raw == "false" {
@@ -0,0 +1,76 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Command line subcommands.
+
+ Without a subcommand, lixie runs the web UI; the subcommands are for
+use in e.g. CI pipelines and cron jobs.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/fingon/lixie/data"
+)
+
+type command func(ctx context.Context, args []string, stdout io.Writer) error
+
+var commands = map[string]command{
+	"export":     exportCommand,
+	"rules test": rulesTestCommand,
+	"vector":     vectorCommand,
+}
+
+// findCommand returns the subcommand within the arguments, and the
+// arguments for it (the first one being the command name)
+func findCommand(args []string) (command, []string) {
+	for name, cmd := range commands {
+		words := strings.Fields(name)
+		if len(args) > len(words) && slices.Equal(args[1:1+len(words)], words) {
+			return cmd, append([]string{args[0] + " " + name}, args[1+len(words):]...)
+		}
+	}
+	return nil, nil
+}
+
+var errFixturesFailed = errors.New("example logs failed")
+
+// rulesTestCommand evaluates the example logs (fixtures) of all rules
+func rulesTestCommand(_ context.Context, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
+	dbPath := flags.String("db", "db.json", "Database to use")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	db := data.Database{Path: *dbPath}
+	if err := db.Load(); err != nil {
+		return err
+	}
+	count := 0
+	for _, rule := range db.LogRules.Ordered {
+		count += rule.FixtureCount()
+	}
+	failures := db.FixtureFailures()
+	for _, failure := range failures {
+		fmt.Fprintf(stdout, "FAIL: %s\n", failure.Error())
+	}
+	fmt.Fprintf(stdout, "%d rules, %d example logs, %d failures\n", len(db.LogRules.Rules), count, len(failures))
+	if len(failures) > 0 {
+		return fmt.Errorf("%w: %d failures", errFixturesFailed, len(failures))
+	}
+	return nil
+}
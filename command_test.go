@@ -0,0 +1,45 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/fingon/lixie/data"
+	"gotest.tools/v3/assert"
+)
+
+func TestRulesTestCommand(t *testing.T) {
+	_, rest := findCommand([]string{"lixie", "rules", "test", "-db", "x"})
+	assert.DeepEqual(t, rest, []string{"lixie rules test", "-db", "x"})
+	cmd, _ := findCommand([]string{"lixie", "-db", "x"})
+	assert.Assert(t, cmd == nil)
+
+	path := filepath.Join(t.TempDir(), "db.json")
+	db := data.Database{Path: path}
+	rule := data.LogRule{
+		Matchers:  []data.LogFieldMatcher{{Field: "message", Op: data.OpEqual, Value: "foo"}},
+		MustMatch: []data.LogRuleFixture{{Message: "foo"}},
+	}
+	assert.Equal(t, db.Add(rule), nil)
+
+	args := []string{"lixie rules test", "-db", path}
+	var out bytes.Buffer
+	assert.Equal(t, rulesTestCommand(context.Background(), args, &out), nil)
+	assert.Equal(t, out.String(), "1 rules, 1 example logs, 0 failures\n")
+
+	rule.MustNotMatch = []data.LogRuleFixture{{Message: "foo"}}
+	assert.Equal(t, db.Add(rule), nil)
+	out.Reset()
+	err := rulesTestCommand(context.Background(), args, &out)
+	assert.ErrorIs(t, err, errFixturesFailed)
+	assert.Equal(t, out.String(), "FAIL: rule #2 matches its must-not-match fixture #1\nFAIL: rule #2 matches must-match fixture #1 of rule #1 first\n2 rules, 3 example logs, 2 failures\n")
+}
@@ -0,0 +1,181 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Cron-like schedules.
+
+ The usual five fields (minute, hour, day of month, month, day of
+week) are supported, with lists, ranges and steps, and the names of
+the months and days; also @hourly, @daily (@midnight), @weekly,
+@monthly and @yearly (@annually). As in cron, if both the day of
+month and the day of week are restricted, either of them matching is
+enough.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errCronInvalid = errors.New("invalid schedule")
+
+var cronMacros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+type cronField struct {
+	min, max int
+	names    []string
+}
+
+var (
+	cronMinute = cronField{0, 59, nil}
+	cronHour   = cronField{0, 23, nil}
+	cronDay    = cronField{1, 31, nil}
+	cronMonth  = cronField{1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}}
+
+	// 7 is also Sunday
+	cronWeekday = cronField{0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}}
+)
+
+// Bound on the days to look at when finding the next time (leap days
+// occur at least once in 8 years)
+const cronMaxDays = 8 * 366
+
+func (self cronField) value(s string) (int, error) {
+	for i, name := range self.names {
+		if strings.EqualFold(s, name) {
+			return self.min + i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < self.min || v > self.max {
+		return 0, fmt.Errorf("%w: %q", errCronInvalid, s)
+	}
+	return v, nil
+}
+
+// parse returns the bitmask of the values, and whether the field is
+// unrestricted (starts with *)
+func (self cronField) parse(s string) (uint64, bool, error) {
+	var mask uint64
+	for _, part := range strings.Split(s, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step < 1 {
+				return 0, false, fmt.Errorf("%w: %q", errCronInvalid, part)
+			}
+		}
+		start, end := self.min, self.max
+		if rangePart != "*" {
+			first, last, isRange := strings.Cut(rangePart, "-")
+			var err error
+			start, err = self.value(first)
+			if err != nil {
+				return 0, false, err
+			}
+			end = start
+			if isRange {
+				end, err = self.value(last)
+				if err != nil {
+					return 0, false, err
+				}
+			} else if hasStep {
+				end = self.max
+			}
+			if end < start {
+				return 0, false, fmt.Errorf("%w: %q", errCronInvalid, part)
+			}
+		}
+		for v := start; v <= end; v += step {
+			mask |= 1 << v
+		}
+	}
+	return mask, strings.HasPrefix(s, "*"), nil
+}
+
+type cronSchedule struct {
+	minute, hour, day, month, weekday uint64
+
+	// Unrestricted day of month and day of week
+	anyDay, anyWeekday bool
+}
+
+func parseCronSchedule(s string) (*cronSchedule, error) {
+	if macro, ok := cronMacros[strings.ToLower(s)]; ok {
+		s = macro
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w: expected 5 fields: %q", errCronInvalid, s)
+	}
+	var result cronSchedule
+	var err error
+	if result.minute, _, err = cronMinute.parse(fields[0]); err != nil {
+		return nil, err
+	}
+	if result.hour, _, err = cronHour.parse(fields[1]); err != nil {
+		return nil, err
+	}
+	if result.day, result.anyDay, err = cronDay.parse(fields[2]); err != nil {
+		return nil, err
+	}
+	if result.month, _, err = cronMonth.parse(fields[3]); err != nil {
+		return nil, err
+	}
+	if result.weekday, result.anyWeekday, err = cronWeekday.parse(fields[4]); err != nil {
+		return nil, err
+	}
+	if result.weekday&(1<<7) != 0 {
+		result.weekday |= 1
+	}
+	return &result, nil
+}
+
+func (self *cronSchedule) dayMatches(t time.Time) bool {
+	day := self.day&(1<<t.Day()) != 0
+	weekday := self.weekday&(1<<int(t.Weekday())) != 0
+	if self.anyDay || self.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// Next returns the first time matching the schedule after t (or zero
+// time if there is none, e.g. on February 30th)
+func (self *cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	days := 0
+	for days < cronMaxDays {
+		switch {
+		case self.month&(1<<int(t.Month())) == 0 || !self.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			days++
+		case self.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case self.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
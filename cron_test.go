@@ -0,0 +1,48 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestCronSchedule(t *testing.T) {
+	// Wednesday
+	start := time.Date(2024, 7, 10, 7, 30, 15, 0, time.UTC)
+	for schedule, next := range map[string]string{
+		"* * * * *":           "2024-07-10 07:31",
+		"0 7 * * *":           "2024-07-11 07:00",
+		"@daily":              "2024-07-11 00:00",
+		"*/20 * * * *":        "2024-07-10 07:40",
+		"5,10 8-9 * * *":      "2024-07-10 08:05",
+		"0 7 * * mon-fri":     "2024-07-11 07:00",
+		"0 7 * * 7":           "2024-07-14 07:00",
+		"0 0 1 * *":           "2024-08-01 00:00",
+		"0 0 13 * fri":        "2024-07-12 00:00",
+		"0 0 29 feb *":        "2028-02-29 00:00",
+		"15 10/6 * JAN,jul *": "2024-07-10 10:15",
+		"0 0 30 2 *":          "",
+	} {
+		s, err := parseCronSchedule(schedule)
+		assert.Equal(t, err, nil, schedule)
+		result := s.Next(start)
+		if next == "" {
+			assert.Assert(t, result.IsZero(), schedule)
+			continue
+		}
+		assert.Equal(t, result.Format("2006-01-02 15:04"), next, schedule)
+	}
+
+	for _, schedule := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "* * * foo *"} {
+		_, err := parseCronSchedule(schedule)
+		assert.ErrorIs(t, err, errCronInvalid, schedule)
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Aho-Corasick multi-pattern matcher.
+
+ This is used to find which (of potentially tens of thousands of)
+literals occur within a string, with a single pass over the string.
+The automaton works on bytes; the transitions of the root are stored
+in a table, and the rest as sorted edge lists, as the trie of a large
+number of patterns is mostly sparse.
+*/
+
+package data
+
+import (
+	"cmp"
+	"slices"
+)
+
+type acEdge struct {
+	b    byte
+	next int32
+}
+
+type acNode struct {
+	// Outgoing edges, sorted by byte
+	edges []acEdge
+
+	// Node of the longest proper suffix present in the trie
+	fail int32
+
+	// Next node in the failure chain which ends a pattern (or -1)
+	output int32
+
+	// Patterns ending at this node
+	patterns []int32
+}
+
+type ahoCorasick struct {
+	nodes []acNode
+	root  [256]int32
+}
+
+func (self *ahoCorasick) child(node int32, b byte) (int32, bool) {
+	edges := self.nodes[node].edges
+	i, found := slices.BinarySearchFunc(edges, b, func(e acEdge, b byte) int {
+		return cmp.Compare(e.b, b)
+	})
+	if !found {
+		return 0, false
+	}
+	return edges[i].next, true
+}
+
+func newAhoCorasick(patterns []string) *ahoCorasick {
+	ac := &ahoCorasick{nodes: []acNode{{output: -1}}}
+	for id, pattern := range patterns {
+		node := int32(0)
+		for i := range len(pattern) {
+			b := pattern[i]
+			next, ok := ac.child(node, b)
+			if !ok {
+				next = int32(len(ac.nodes))
+				ac.nodes = append(ac.nodes, acNode{output: -1})
+				edges := ac.nodes[node].edges
+				j, _ := slices.BinarySearchFunc(edges, b, func(e acEdge, b byte) int {
+					return cmp.Compare(e.b, b)
+				})
+				ac.nodes[node].edges = slices.Insert(edges, j, acEdge{b: b, next: next})
+			}
+			node = next
+		}
+		ac.nodes[node].patterns = append(ac.nodes[node].patterns, int32(id))
+	}
+
+	// Failure links are determined breadth-first; children of the
+	// root fail to the root
+	var queue []int32
+	for _, e := range ac.nodes[0].edges {
+		ac.root[e.b] = e.next
+		queue = append(queue, e.next)
+	}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for _, e := range ac.nodes[node].edges {
+			fail := ac.nodes[node].fail
+			for {
+				if next, ok := ac.child(fail, e.b); ok {
+					fail = next
+					break
+				}
+				if fail == 0 {
+					break
+				}
+				fail = ac.nodes[fail].fail
+			}
+			child := &ac.nodes[e.next]
+			child.fail = fail
+			if len(ac.nodes[fail].patterns) > 0 {
+				child.output = fail
+			} else {
+				child.output = ac.nodes[fail].output
+			}
+			queue = append(queue, e.next)
+		}
+	}
+	return ac
+}
+
+func (self *ahoCorasick) step(node int32, b byte) int32 {
+	for node != 0 {
+		if next, ok := self.child(node, b); ok {
+			return next
+		}
+		node = self.nodes[node].fail
+	}
+	return self.root[b]
+}
+
+// appendMatches appends the indexes of the patterns found within the
+// string to dst; patterns found more than once are appended more than
+// once
+func (self *ahoCorasick) appendMatches(dst []int32, s string) []int32 {
+	node := int32(0)
+	for i := range len(s) {
+		node = self.step(node, s[i])
+		n := node
+		if len(self.nodes[n].patterns) == 0 {
+			n = self.nodes[n].output
+		}
+		for n > 0 {
+			dst = append(dst, self.nodes[n].patterns...)
+			n = self.nodes[n].output
+		}
+	}
+	return dst
+}
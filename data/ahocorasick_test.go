@@ -0,0 +1,52 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package data
+
+import (
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestAhoCorasick(t *testing.T) {
+	patterns := []string{"he", "she", "his", "hers", "e", "hishe"}
+	ac := newAhoCorasick(patterns)
+	matches := ac.appendMatches(nil, "ushers")
+	slices.Sort(matches)
+	assert.DeepEqual(t, matches, []int32{0, 1, 3, 4})
+
+	// Compare against the naive approach with random patterns
+	r := rand.New(rand.NewPCG(1, 2))
+	random := func(n int) string {
+		var sb strings.Builder
+		for range n {
+			sb.WriteByte("abc"[r.IntN(3)])
+		}
+		return sb.String()
+	}
+	patterns = nil
+	for range 50 {
+		patterns = append(patterns, random(1+r.IntN(5)))
+	}
+	ac = newAhoCorasick(patterns)
+	for range 100 {
+		s := random(r.IntN(20))
+		var expected []int32
+		for i, pattern := range patterns {
+			if strings.Contains(s, pattern) {
+				expected = append(expected, int32(i))
+			}
+		}
+		got := ac.appendMatches(nil, s)
+		slices.Sort(got)
+		assert.DeepEqual(t, slices.Compact(got), expected)
+	}
+}
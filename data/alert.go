@@ -0,0 +1,467 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Alerting on newly fetched logs.
+
+ Each alert rule selects logs by verdict (ham and unknown by default),
+by the ID of the matching log rule, and by matchers on the stream
+labels (and fields), exactly like the log rules. The selected logs are
+grouped per alert rule, log rule and verdict: the first log of a group
+starts the group wait, after which the group is sent to the webhook of
+the alert rule as one alert. After that, the group is sent at most once
+per throttle interval, with whatever has accumulated meanwhile.
+
+ The webhook payload is either Lixie specific JSON, a Slack incoming
+webhook message, or a matrix-hookshot generic webhook message. Failed
+deliveries are retried with exponential backoff from a bounded queue.
+
+ The logs are added with the database locked, so adding only queues
+them; the deliveries happen in Run.
+*/
+
+package data
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AlertFormatJSON   = "json"
+	AlertFormatSlack  = "slack"
+	AlertFormatMatrix = "matrix"
+)
+
+const (
+	defaultAlertGroupWait = 30 * time.Second
+	defaultAlertThrottle  = 5 * time.Minute
+
+	// Logs included in an alert (the rest are only counted)
+	maxAlertLogs = 10
+
+	alertRetryInterval    = 10 * time.Second
+	maxAlertRetryInterval = 10 * time.Minute
+	maxAlertAttempts      = 6
+	maxAlertQueue         = 100
+
+	alertFlushInterval = time.Second
+	alertTimeout       = 10 * time.Second
+)
+
+var (
+	ErrInvalidAlert         = errors.New("invalid alert rule")
+	ErrAlertDeliveryFailed  = errors.New("alert delivery failed")
+	errAlertUnknownFormat   = errors.New("unknown format")
+	errAlertMissingWebhook  = errors.New("webhook is not set")
+	errAlertInvalidDuration = errors.New("duration must not be negative")
+)
+
+type AlertRule struct {
+	// Shown in the alerts
+	Name string
+
+	// Verdict keys of the logs to alert on (default: ham and unknown)
+	Verdicts []string `json:",omitempty"`
+
+	// IDs of the log rules to alert on (default: any); 0 stands for
+	// the logs no rule matches
+	RuleIDs []int `json:",omitempty"`
+
+	// Conditions on the stream labels (and fields) of the logs
+	Matchers []LogFieldMatcher `json:",omitempty"`
+
+	// URL to POST the alerts to
+	Webhook string
+
+	// Payload format (json, slack or matrix; default json)
+	Format string `json:",omitempty"`
+
+	// How long to collect logs before alerting (default 30s)
+	GroupWait string `json:",omitempty"`
+
+	// Minimum interval between alerts of the same log rule and
+	// verdict (default 5m)
+	Throttle string `json:",omitempty"`
+
+	// Parsed GroupWait and Throttle
+	groupWait, throttle time.Duration
+}
+
+func parseAlertDuration(s string, value time.Duration) (time.Duration, error) {
+	if s == "" {
+		return value, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, errAlertInvalidDuration
+	}
+	return d, nil
+}
+
+// Validate checks the alert rule, and prepares it for use
+func (self *AlertRule) Validate() error {
+	if self.Webhook == "" {
+		return fmt.Errorf("%w %q: %w", ErrInvalidAlert, self.Name, errAlertMissingWebhook)
+	}
+	switch self.Format {
+	case "", AlertFormatJSON, AlertFormatSlack, AlertFormatMatrix:
+	default:
+		return fmt.Errorf("%w %q: %w: %q", ErrInvalidAlert, self.Name, errAlertUnknownFormat, self.Format)
+	}
+	for _, key := range self.Verdicts {
+		if _, ok := LogVerdictFromKey(key); !ok {
+			return fmt.Errorf("%w %q: %w: %q", ErrInvalidAlert, self.Name, ErrUnknownVerdict, key)
+		}
+	}
+	for i := range self.Matchers {
+		if err := self.Matchers[i].Validate(); err != nil {
+			return fmt.Errorf("%w %q: %w", ErrInvalidAlert, self.Name, err)
+		}
+	}
+	var err error
+	self.groupWait, err = parseAlertDuration(self.GroupWait, defaultAlertGroupWait)
+	if err != nil {
+		return fmt.Errorf("%w %q: group wait: %w", ErrInvalidAlert, self.Name, err)
+	}
+	self.throttle, err = parseAlertDuration(self.Throttle, defaultAlertThrottle)
+	if err != nil {
+		return fmt.Errorf("%w %q: throttle: %w", ErrInvalidAlert, self.Name, err)
+	}
+	return nil
+}
+
+func (self *AlertRule) matches(entry *ingestedLog) bool {
+	verdict := LogVerdictInfoOf(entry.verdict).Key
+	if len(self.Verdicts) > 0 {
+		if !slices.Contains(self.Verdicts, verdict) {
+			return false
+		}
+	} else if entry.verdict != LogVerdictHam && entry.verdict != LogVerdictUnknown {
+		return false
+	}
+	if len(self.RuleIDs) > 0 {
+		rid := 0
+		if entry.rule != nil {
+			rid = entry.rule.ID
+		}
+		if !slices.Contains(self.RuleIDs, rid) {
+			return false
+		}
+	}
+	for i := range self.Matchers {
+		matcher := &self.Matchers[i]
+		if !matcher.empty() && !matcher.matchLog(entry.log) {
+			return false
+		}
+	}
+	return true
+}
+
+type alertGroupKey struct {
+	alert   int
+	rule    int
+	verdict int
+}
+
+type alertGroup struct {
+	// When the group may be sent next
+	due time.Time
+
+	// When the group was last sent, if ever
+	sent time.Time
+
+	rule  *LogRule
+	logs  []*Log
+	count int
+}
+
+type alertDelivery struct {
+	rule    *AlertRule
+	payload []byte
+
+	attempts int
+	next     time.Time
+}
+
+type Alerter struct {
+	Rules []*AlertRule
+
+	// Logs older than this are not alerted on (e.g. the logs
+	// fetched after a restart)
+	Since time.Time `json:"-"`
+
+	// Used for the deliveries (default: http.Client with a timeout)
+	Client *http.Client `json:"-"`
+
+	lock   sync.Mutex
+	groups map[alertGroupKey]*alertGroup
+	queue  []*alertDelivery
+}
+
+// Validate checks the alert rules, and prepares them for use
+func (self *Alerter) Validate() error {
+	for _, rule := range self.Rules {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add queues the matching logs (given newest first); it is called
+// with the database locked, so it must not block
+func (self *Alerter) add(ingested []ingestedLog) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.groups == nil {
+		self.groups = make(map[alertGroupKey]*alertGroup)
+	}
+	now := time.Now()
+	for _, entry := range slices.Backward(ingested) {
+		if entry.log.Time.Before(self.Since) {
+			continue
+		}
+		for i, rule := range self.Rules {
+			if !rule.matches(&entry) {
+				continue
+			}
+			key := alertGroupKey{alert: i, verdict: entry.verdict}
+			if entry.rule != nil {
+				key.rule = entry.rule.ID
+			}
+			group, ok := self.groups[key]
+			if !ok {
+				group = &alertGroup{}
+				self.groups[key] = group
+			}
+			if group.count == 0 {
+				// Not pending yet
+				group.due = now.Add(rule.groupWait)
+				if throttled := group.sent.Add(rule.throttle); throttled.After(group.due) {
+					group.due = throttled
+				}
+			}
+			group.rule = entry.rule
+			group.count++
+			if len(group.logs) < maxAlertLogs {
+				group.logs = append(group.logs, entry.log)
+			}
+		}
+	}
+}
+
+// flush returns the deliveries that are due, and removes them from the
+// groups and the retry queue. Groups with nothing pending are dropped
+// once they are no longer throttled, as a new group would behave the
+// same.
+func (self *Alerter) flush(now time.Time) []*alertDelivery {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	var result []*alertDelivery
+	self.queue = slices.DeleteFunc(self.queue, func(delivery *alertDelivery) bool {
+		if now.Before(delivery.next) {
+			return false
+		}
+		result = append(result, delivery)
+		return true
+	})
+	for _, key := range SortedKeysWithFunc(self.groups, compareAlertGroupKeys) {
+		group := self.groups[key]
+		rule := self.Rules[key.alert]
+		if group.count == 0 {
+			if !now.Before(group.sent.Add(rule.throttle)) {
+				delete(self.groups, key)
+			}
+			continue
+		}
+		if now.Before(group.due) {
+			continue
+		}
+		payload, err := alertPayload(rule, key.verdict, group)
+		if err != nil {
+			slog.Error("Unable to produce alert", "alert", rule.Name, "err", err)
+		} else {
+			result = append(result, &alertDelivery{rule: rule, payload: payload})
+		}
+		group.sent = now
+		group.count = 0
+		group.logs = nil
+	}
+	return result
+}
+
+func compareAlertGroupKeys(a, b alertGroupKey) int {
+	return cmp.Or(cmp.Compare(a.alert, b.alert), cmp.Compare(a.rule, b.rule), cmp.Compare(a.verdict, b.verdict))
+}
+
+// retry puts the failed delivery to the retry queue, unless it has
+// been attempted too many times already
+func (self *Alerter) retry(delivery *alertDelivery, now time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	delivery.attempts++
+	if delivery.attempts >= maxAlertAttempts {
+		slog.Error("Giving up on alert", "alert", delivery.rule.Name, "attempts", delivery.attempts)
+		return
+	}
+	backoff := min(alertRetryInterval<<(delivery.attempts-1), maxAlertRetryInterval)
+	delivery.next = now.Add(backoff)
+	if len(self.queue) >= maxAlertQueue {
+		slog.Warn("Alert retry queue full, dropping oldest", "alert", self.queue[0].rule.Name)
+		self.queue = self.queue[1:]
+	}
+	self.queue = append(self.queue, delivery)
+}
+
+// Deliver sends the alerts that are due; failed ones are queued for
+// retrying
+func (self *Alerter) Deliver(ctx context.Context, now time.Time) {
+	for _, delivery := range self.flush(now) {
+		if err := self.send(ctx, delivery); err != nil {
+			slog.Warn("Alert delivery failed", "alert", delivery.rule.Name, "err", err)
+			self.retry(delivery, now)
+		}
+	}
+}
+
+func (self *Alerter) send(ctx context.Context, delivery *alertDelivery) error {
+	client := self.Client
+	if client == nil {
+		client = &http.Client{Timeout: alertTimeout}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.rule.Webhook, bytes.NewReader(delivery.payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%w: %s", ErrAlertDeliveryFailed, resp.Status)
+	}
+	return nil
+}
+
+// Run delivers the alerts until the context is done
+func (self *Alerter) Run(ctx context.Context) {
+	ticker := time.NewTicker(alertFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			self.Deliver(ctx, now)
+		}
+	}
+}
+
+type alertJSONRule struct {
+	ID      int `json:"id"`
+	Version int `json:"version"`
+}
+
+type alertJSONLog struct {
+	Timestamp int64             `json:"timestamp"`
+	Stream    map[string]string `json:"stream"`
+	Message   string            `json:"message"`
+}
+
+type alertJSON struct {
+	Alert   string         `json:"alert"`
+	Verdict string         `json:"verdict"`
+	Rule    *alertJSONRule `json:"rule,omitempty"`
+	Count   int            `json:"count"`
+	Logs    []alertJSONLog `json:"logs"`
+}
+
+type alertSlack struct {
+	Text string `json:"text"`
+}
+
+type alertMatrix struct {
+	Text string `json:"text"`
+	HTML string `json:"html"`
+}
+
+func alertSummary(rule *AlertRule, verdict int, group *alertGroup) string {
+	summary := fmt.Sprintf("%s: %d new %s log", rule.Name, group.count, LogVerdictToString(verdict))
+	if group.count != 1 {
+		summary += "s"
+	}
+	if group.rule != nil {
+		summary += fmt.Sprintf(" (rule #%d)", group.rule.ID)
+	}
+	return summary
+}
+
+func alertLogLine(log *Log) string {
+	return fmt.Sprintf("%s %s %s", log.Time.UTC().Format(time.RFC3339), log.Stream["source"], log.Message)
+}
+
+// alertMarshal encodes the payload as JSON, without escaping HTML
+// (the payloads are not embedded in HTML)
+func alertMarshal(v any) ([]byte, error) {
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), nil
+}
+
+func alertPayload(rule *AlertRule, verdict int, group *alertGroup) ([]byte, error) {
+	var lines []string
+	for _, log := range group.logs {
+		lines = append(lines, alertLogLine(log))
+	}
+	if more := group.count - len(group.logs); more > 0 {
+		lines = append(lines, fmt.Sprintf("(and %d more)", more))
+	}
+	summary := alertSummary(rule, verdict, group)
+	switch rule.Format {
+	case AlertFormatSlack:
+		return alertMarshal(alertSlack{Text: fmt.Sprintf("*%s*\n```\n%s\n```", summary, strings.Join(lines, "\n"))})
+	case AlertFormatMatrix:
+		return alertMarshal(alertMatrix{
+			Text: summary + "\n" + strings.Join(lines, "\n"),
+			HTML: fmt.Sprintf("<strong>%s</strong><pre><code>%s</code></pre>", html.EscapeString(summary), html.EscapeString(strings.Join(lines, "\n"))),
+		})
+	}
+	result := alertJSON{Alert: rule.Name, Verdict: LogVerdictInfoOf(verdict).Key, Count: group.count, Logs: []alertJSONLog{}}
+	if group.rule != nil {
+		result.Rule = &alertJSONRule{ID: group.rule.ID, Version: group.rule.Version}
+	}
+	for _, log := range group.logs {
+		result.Logs = append(result.Logs, alertJSONLog{Timestamp: log.Timestamp, Stream: log.Stream, Message: log.Message})
+	}
+	return alertMarshal(result)
+}
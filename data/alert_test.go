@@ -0,0 +1,169 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+// webhookStandIn records the payloads it gets, and fails the given
+// number of requests first
+type webhookStandIn struct {
+	lock     sync.Mutex
+	failures int
+	payloads []string
+}
+
+func (self *webhookStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.failures > 0 {
+		self.failures--
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	b, _ := io.ReadAll(r.Body)
+	self.payloads = append(self.payloads, string(b))
+}
+
+func (self *webhookStandIn) fail(count int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.failures = count
+}
+
+func (self *webhookStandIn) received() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	result := self.payloads
+	self.payloads = nil
+	return result
+}
+
+func TestAlertRuleValidate(t *testing.T) {
+	for _, rule := range []AlertRule{
+		{Name: "x"},
+		{Name: "x", Webhook: "http://x", Format: "irc"},
+		{Name: "x", Webhook: "http://x", Verdicts: []string{"nope"}},
+		{Name: "x", Webhook: "http://x", Throttle: "-1s"},
+		{Name: "x", Webhook: "http://x", Matchers: []LogFieldMatcher{{Field: "a", Op: OpRegexp, Value: "("}}},
+	} {
+		assert.ErrorIs(t, rule.Validate(), ErrInvalidAlert)
+	}
+	rule := AlertRule{Name: "x", Webhook: "http://x"}
+	assert.Equal(t, rule.Validate(), nil)
+	assert.Equal(t, rule.groupWait, defaultAlertGroupWait)
+	assert.Equal(t, rule.throttle, defaultAlertThrottle)
+}
+
+func TestAlerter(t *testing.T) {
+	path := "test_db.json"
+	_ = os.Remove(path)
+
+	standIn := &webhookStandIn{}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	alerter := &Alerter{Rules: []*AlertRule{
+		{Name: "all", Webhook: server.URL, GroupWait: "0s", Throttle: "1h"},
+		{Name: "cron", Webhook: server.URL, Format: AlertFormatSlack, Verdicts: []string{"spam"}, RuleIDs: []int{1},
+			Matchers: []LogFieldMatcher{{Field: "source", Op: OpEqual, Value: "cron"}}},
+	}}
+	assert.Equal(t, alerter.Validate(), nil)
+	now := time.Now()
+	source := &ArraySource{Chunk: 100}
+	db := Database{Path: path, Source: source, Alerter: alerter}
+	assert.Equal(t, db.Add(LogRule{Matchers: []LogFieldMatcher{{Field: "message", Op: OpEqual, Value: "spam"}}}), nil)
+	assert.Equal(t, db.Add(LogRule{Ham: true, Matchers: []LogFieldMatcher{{Field: "message", Op: OpEqual, Value: "ham"}}}), nil)
+
+	fetch := func(messages ...string) {
+		source.Data = nil
+		for i, message := range messages {
+			stream := map[string]string{"source": "cron"}
+			source.Data = append(source.Data, NewLog(now.UnixNano()-int64(i), stream, message))
+		}
+		source.offset = 0
+		_, err := db.Logs()
+		assert.Equal(t, err, nil)
+	}
+	ctx := context.Background()
+
+	// The groups become due relative to the actual time of the fetch
+	fetch("spam", "ham", "x", "y")
+	alerter.Deliver(ctx, now.Add(time.Second))
+	var received []alertJSON
+	for _, payload := range standIn.received() {
+		var alert alertJSON
+		assert.Equal(t, json.Unmarshal([]byte(payload), &alert), nil)
+		received = append(received, alert)
+	}
+	// Grouped by rule and verdict (and sent in that order); logs oldest first
+	assert.DeepEqual(t, received, []alertJSON{
+		{Alert: "all", Verdict: "unknown", Count: 2, Logs: []alertJSONLog{
+			{Timestamp: now.UnixNano() - 3, Stream: map[string]string{"source": "cron"}, Message: "y"},
+			{Timestamp: now.UnixNano() - 2, Stream: map[string]string{"source": "cron"}, Message: "x"},
+		}},
+		{Alert: "all", Verdict: "ham", Rule: &alertJSONRule{ID: 2}, Count: 1, Logs: []alertJSONLog{
+			{Timestamp: now.UnixNano() - 1, Stream: map[string]string{"source": "cron"}, Message: "ham"},
+		}},
+	})
+
+	// The second rule waits for the default group wait
+	alerter.Deliver(ctx, now.Add(defaultAlertGroupWait+time.Second))
+	assert.DeepEqual(t, standIn.received(), []string{
+		`{"text":"*cron: 1 new Noise log (rule #1)*\n` + "```" + `\n` + now.UTC().Format(time.RFC3339) + ` cron spam\n` + "```" + `"}`,
+	})
+
+	// Throttled, and then delivered with retries
+	fetch("z")
+	alerter.Deliver(ctx, now.Add(time.Minute))
+	assert.Equal(t, len(standIn.received()), 0)
+	// The sent groups are kept while throttled
+	assert.Equal(t, len(alerter.groups), 3)
+	standIn.fail(2)
+	throttled := now.Add(time.Hour + time.Second)
+	alerter.Deliver(ctx, throttled)
+	alerter.Deliver(ctx, throttled.Add(alertRetryInterval))
+	alerter.Deliver(ctx, throttled.Add(3*alertRetryInterval-time.Second))
+	assert.Equal(t, len(standIn.received()), 0)
+	alerter.Deliver(ctx, throttled.Add(3*alertRetryInterval))
+	payloads := standIn.received()
+	assert.Equal(t, len(payloads), 1)
+	assert.Assert(t, json.Valid([]byte(payloads[0])))
+
+	// Logs before Since are not alerted on
+	alerter.Since = now.Add(time.Second)
+	fetch("w")
+	alerter.Deliver(ctx, now.Add(3*time.Hour))
+	assert.Equal(t, len(standIn.received()), 0)
+
+	// The groups are dropped once they are no longer throttled
+	assert.Equal(t, len(alerter.groups), 0)
+}
+
+func TestAlertPayloadMatrix(t *testing.T) {
+	log := NewLog(0, map[string]string{"source": "a"}, "<b>")
+	group := alertGroup{logs: []*Log{log}, count: 12}
+	payload, err := alertPayload(&AlertRule{Name: "x", Format: AlertFormatMatrix}, LogVerdictUnknown, &group)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(payload), `{"text":"x: 12 new Unknown logs\n1970-01-01T00:00:00Z a <b>\n(and 11 more)",`+
+		`"html":"<strong>x: 12 new Unknown logs</strong><pre><code>1970-01-01T00:00:00Z a &lt;b&gt;\n(and 11 more)</code></pre>"}`)
+}
@@ -8,41 +8,145 @@
 /*
  Bulk rule matcher.
 
- It first analyzer the rules, and finds the field with the most exact
-matches. Then, using that field, it sequence of match objects which
-either do single match (slow), or map-based lookup + list based match
-(fast) for the given key.
+ The rules (in the evaluation order) are split into segments of
+consecutive rules. Matching proceeds segment by segment, and stops at
+the first segment with a matching rule, so the priority semantics are
+exactly those of evaluating the rules one by one.
+
+ Each segment has indexes of its own, so the cost of a log is roughly
+the number of segments it reaches times the per-segment lookups (one
+scan of each indexed field value, see below). Smaller segments let the
+logs matched by early rules stop sooner, keep the candidate lists
+short, and let the choice of indexed fields follow the rules of the
+segment; larger segments mean fewer scans for the logs that reach the
+end (e.g. the unknown ones). With the 50k rule benchmark, 256 rule
+segments were about four times and 1024 rule segments about twice as
+slow per log as 4096 rule ones, while larger segments were no faster,
+so a 50k ruleset is matched with at most 13 scans per field.
+
+ Within a segment, each rule is indexed in (at most) one way:
+
+ - By the exact value of a field (only = is indexable, both directly
+and within AND groups, and within OR groups if all of their members
+are exact matches of the same field). If a rule restricts more than
+one field, the field with the best selectivity within the segment is
+used: the one with the smallest expected number of rules per looked
+up value. So e.g. a field which has the same value in every rule is
+not used, if there is anything better available. The most common
+field of the segment ends up being the primary index, and the rest are
+secondary indexes.
+
+ - By the literals the field value must contain (see literals.go).
+All literals of a field within the segment are found with a single
+Aho-Corasick scan of the value.
+
+ - Rules that cannot be indexed at all (e.g. ones with only NOT groups
+or numeric comparisons) are always candidates.
+
+ The candidates from all of the indexes are then checked in the
+evaluation order, and the first one that matches wins.
 */
 
 package data
 
-import "log/slog"
+import (
+	"cmp"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// maxSegmentRules is the maximum number of rules in a segment
+	// (see the trade-off above)
+	maxSegmentRules = 4096
+
+	// Shorter literals are not selective enough to be worth it
+	minLiteralLength = 3
+)
+
+type exactIndex struct {
+	field       string
+	value2Rules map[string][]int32
 
-type logMatcher interface {
-	ToRule(_ string, log *Log) *LogRule
+	// Number of rules in the index
+	count int
 }
 
-type singleLogMatcher struct {
-	rule *LogRule
+type literalIndex struct {
+	field         string
+	ac            *ahoCorasick
+	pattern2Rules [][]int32
+
+	// Number of rules in the index
+	count int
 }
 
-func (self *singleLogMatcher) ToRule(_ string, log *Log) *LogRule {
-	if LogMatchesRule(log, self.rule) {
-		return self.rule
-	}
-	return nil
+type ruleSegment struct {
+	// Rules in the evaluation order; the indexes refer to these
+	rules    []*LogRule
+	exact    []*exactIndex
+	literals []*literalIndex
+
+	// Rules which are always candidates
+	fallback []int32
 }
 
-type mapLogMatcher struct {
-	value2Rules map[string][]*LogRule
+// logFieldCache caches the (string) field values of a log, as
+// segments often use same fields
+type logFieldCache struct {
+	log    *Log
+	fields []string
+	values []string
+	found  []bool
+}
+
+func (self *logFieldCache) get(field string) (string, bool) {
+	for i, f := range self.fields {
+		if f == field {
+			return self.values[i], self.found[i]
+		}
+	}
+	value, found := self.log.FieldString(field)
+	self.fields = append(self.fields, field)
+	self.values = append(self.values, value)
+	self.found = append(self.found, found)
+	return value, found
 }
 
-func (self *mapLogMatcher) ToRule(value string, log *Log) *LogRule {
-	rules, ok := self.value2Rules[value]
-	if !ok {
-		return nil
+func (self *ruleSegment) toRule(log *Log, fields *logFieldCache) *LogRule {
+	var buf [32]int32
+	candidates := buf[:0]
+	for _, index := range self.exact {
+		value, _ := fields.get(index.field)
+		candidates = append(candidates, index.value2Rules[value]...)
 	}
-	for _, rule := range rules {
+	for _, index := range self.literals {
+		value, found := fields.get(index.field)
+		if !found {
+			continue
+		}
+		var pbuf [16]int32
+		patterns := index.ac.appendMatches(pbuf[:0], value)
+		slices.Sort(patterns)
+		for _, pattern := range slices.Compact(patterns) {
+			candidates = append(candidates, index.pattern2Rules[pattern]...)
+		}
+	}
+	slices.Sort(candidates)
+	candidates = slices.Compact(candidates)
+
+	// Merge with the fallback rules (the two are disjoint)
+	fallback := self.fallback
+	for len(candidates) > 0 || len(fallback) > 0 {
+		var i int32
+		if len(fallback) == 0 || (len(candidates) > 0 && candidates[0] < fallback[0]) {
+			i, candidates = candidates[0], candidates[1:]
+		} else {
+			i, fallback = fallback[0], fallback[1:]
+		}
+		rule := self.rules[i]
 		if LogMatchesRule(log, rule) {
 			return rule
 		}
@@ -50,79 +154,177 @@ func (self *mapLogMatcher) ToRule(value string, log *Log) *LogRule {
 	return nil
 }
 
-type BulkRuleMatcher struct {
-	field    string
-	matchers []logMatcher
+type exactOption struct {
+	field string
+	keys  []string
 }
 
-func (self *BulkRuleMatcher) ToRule(log *Log) *LogRule {
-	value, ok := log.Stream[self.field]
-	if !ok {
-		value, ok = log.Fields[self.field].(string)
+// exactOptions returns the ways the rule can be indexed by exact value
+func exactOptions(rule *LogRule) []exactOption {
+	var result []exactOption
+	group := rule.group()
+	group.indexableFields(func(field string) {
+		if slices.ContainsFunc(result, func(o exactOption) bool { return o.field == field }) {
+			return
+		}
+		if keys, ok := group.indexKeys(field); ok {
+			result = append(result, exactOption{field: field, keys: keys})
+		}
+	})
+	return result
+}
+
+// bestLiterals returns the most selective set of literals required by
+// the rule
+func bestLiterals(rule *LogRule) (string, []string, bool) {
+	var bestField string
+	var best []string
+	group := rule.group()
+	group.literalFields(func(field string) {
+		literals, ok := group.requiredLiterals(field)
 		if !ok {
-			value = ""
+			return
 		}
-	}
-	for _, matcher := range self.matchers {
-		rule := matcher.ToRule(value, log)
-		if rule != nil {
-			return rule
+		score := literalsScore(literals)
+		if score > literalsScore(best) || (score == literalsScore(best) && field < bestField) {
+			bestField = field
+			best = literals
 		}
-	}
-	return nil
+	})
+	return bestField, best, literalsScore(best) >= minLiteralLength
 }
 
-func NewBulkRuleMatcher(rules []*LogRule) *BulkRuleMatcher {
-	fieldToEMcount := map[string]int{}
-	for _, rule := range rules {
-		for _, matcher := range rule.Matchers {
-			if matcher.Op != "=" {
-				continue
+func newRuleSegment(rules []*LogRule) *ruleSegment {
+	segment := ruleSegment{rules: rules}
+
+	// Exact value selectivity: expected number of rules in the
+	// bucket of a value, weighted by the bucket sizes
+	options := make([][]exactOption, len(rules))
+	field2Buckets := map[string]map[string]int{}
+	for i, rule := range rules {
+		options[i] = exactOptions(rule)
+		for _, option := range options[i] {
+			buckets, ok := field2Buckets[option.field]
+			if !ok {
+				buckets = make(map[string]int)
+				field2Buckets[option.field] = buckets
+			}
+			for _, key := range option.keys {
+				buckets[key]++
 			}
-			cnt := fieldToEMcount[matcher.Field]
-			cnt++
-			fieldToEMcount[matcher.Field] = cnt
 		}
 	}
-	// TODO: While this is semi ok, what if all values are same?
-	// it isn't as useful for exact matching..
-	bestField := ""
-	bestCount := 0
-	for field, count := range fieldToEMcount {
-		if count > bestCount {
-			bestField = field
-			bestCount = count
+	field2Cost := make(map[string]float64, len(field2Buckets))
+	for field, buckets := range field2Buckets {
+		var n, sumsq int
+		for _, count := range buckets {
+			n += count
+			sumsq += count * count
 		}
+		field2Cost[field] = float64(sumsq) / float64(n)
 	}
-	slog.Debug("NewBulkRuleMatcher chose", "field", bestField, "count", bestCount)
-	brm := BulkRuleMatcher{field: bestField}
-	var currentMatcher *mapLogMatcher
-	var slowRules, fastRules int
-	for _, rule := range rules {
-		found := false
-		if bestField != "" {
-			for _, matcher := range rule.Matchers {
-				if matcher.Op == "=" && matcher.Field == bestField {
-					if currentMatcher == nil {
-						currentMatcher = &mapLogMatcher{make(map[string][]*LogRule)}
-						brm.matchers = append(brm.matchers, currentMatcher)
-					}
-					rules := currentMatcher.value2Rules[matcher.Value]
-					rules = append(rules, rule)
-					currentMatcher.value2Rules[matcher.Value] = rules
-					found = true
-					fastRules++
-					break
+
+	field2Exact := map[string]*exactIndex{}
+	field2Patterns := map[string]map[string]int32{}
+	field2Literal := map[string]*literalIndex{}
+	for i, rule := range rules {
+		ri := int32(i)
+		if len(options[i]) > 0 {
+			option := slices.MinFunc(options[i], func(a, b exactOption) int {
+				return cmp.Or(cmp.Compare(field2Cost[a.field], field2Cost[b.field]),
+					strings.Compare(a.field, b.field))
+			})
+			index, ok := field2Exact[option.field]
+			if !ok {
+				index = &exactIndex{field: option.field, value2Rules: make(map[string][]int32)}
+				field2Exact[option.field] = index
+			}
+			for _, key := range option.keys {
+				index.value2Rules[key] = append(index.value2Rules[key], ri)
+			}
+			index.count++
+			continue
+		}
+		if field, literals, ok := bestLiterals(rule); ok {
+			index, ok := field2Literal[field]
+			if !ok {
+				index = &literalIndex{field: field}
+				field2Literal[field] = index
+				field2Patterns[field] = make(map[string]int32)
+			}
+			patterns := field2Patterns[field]
+			for _, literal := range literals {
+				pattern, ok := patterns[literal]
+				if !ok {
+					pattern = int32(len(index.pattern2Rules))
+					patterns[literal] = pattern
+					index.pattern2Rules = append(index.pattern2Rules, nil)
 				}
+				index.pattern2Rules[pattern] = append(index.pattern2Rules[pattern], ri)
 			}
+			index.count++
+			continue
 		}
-		if !found {
-			currentMatcher = nil
-			// Use fallback code here; unfortunate, but it is what it is
-			brm.matchers = append(brm.matchers, &singleLogMatcher{rule})
-			slowRules++
+		segment.fallback = append(segment.fallback, ri)
+	}
+
+	// Primary (most used) index first
+	for _, index := range field2Exact {
+		segment.exact = append(segment.exact, index)
+	}
+	slices.SortFunc(segment.exact, func(a, b *exactIndex) int {
+		return cmp.Or(cmp.Compare(b.count, a.count), strings.Compare(a.field, b.field))
+	})
+	for field, index := range field2Literal {
+		literals := make([]string, len(index.pattern2Rules))
+		for literal, pattern := range field2Patterns[field] {
+			literals[pattern] = literal
+		}
+		index.ac = newAhoCorasick(literals)
+		segment.literals = append(segment.literals, index)
+	}
+	slices.SortFunc(segment.literals, func(a, b *literalIndex) int {
+		return strings.Compare(a.field, b.field)
+	})
+	return &segment
+}
+
+type BulkRuleMatcher struct {
+	segments []*ruleSegment
+
+	// How long building the matcher took
+	duration time.Duration
+}
+
+func (self *BulkRuleMatcher) ToRule(log *Log) *LogRule {
+	fields := logFieldCache{log: log}
+	for _, segment := range self.segments {
+		rule := segment.toRule(log, &fields)
+		if rule != nil {
+			return rule
+		}
+	}
+	return nil
+}
+
+// NewBulkRuleMatcher creates matcher for the rules, which must be in
+// the evaluation order
+func NewBulkRuleMatcher(rules []*LogRule) *BulkRuleMatcher {
+	start := time.Now()
+	var brm BulkRuleMatcher
+	var exactRules, literalRules, slowRules int
+	for chunk := range slices.Chunk(rules, maxSegmentRules) {
+		segment := newRuleSegment(chunk)
+		for _, index := range segment.exact {
+			exactRules += index.count
+		}
+		for _, index := range segment.literals {
+			literalRules += index.count
 		}
+		slowRules += len(segment.fallback)
+		brm.segments = append(brm.segments, segment)
 	}
-	slog.Debug("Produced matcher", "fast", fastRules, "slow", slowRules)
+	brm.duration = time.Since(start)
+	slog.Debug("Produced matcher", "duration", brm.duration, "segments", len(brm.segments), "exact", exactRules, "literal", literalRules, "slow", slowRules)
 	return &brm
 }
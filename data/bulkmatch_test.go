@@ -0,0 +1,211 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package data
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestRegexpLiterals(t *testing.T) {
+	cases := []struct {
+		expr     string
+		literals []string
+	}{
+		{"foo", []string{"foo"}},
+		{"fo+", []string{"f"}},
+		{"foo.*barbaz", []string{"barbaz"}},
+		{"x(foo|bar)y", []string{"bar", "foo"}},
+		// Common prefixes are factored out by the parser
+		{"x(bar|baz)y", []string{"ba"}},
+		{"(abc)+", []string{"abc"}},
+		{"[Ff]oo", []string{"oo"}},
+		{"(abc)?def", []string{"def"}},
+		{"(abc)*", nil},
+		{"(?i)foo", nil},
+		{"abc|.*", nil},
+		{"[a-z]+", nil},
+		{"(", nil},
+	}
+	for _, c := range cases {
+		literals, ok := regexpLiterals(c.expr)
+		assert.Equal(t, ok, c.literals != nil, c.expr)
+		assert.DeepEqual(t, literals, c.literals)
+	}
+}
+
+// randomBulkRule produces rule with a mix of indexable and
+// non-indexable matchers
+func randomBulkRule(r *rand.Rand, id int) *LogRule {
+	rule := LogRule{ID: id, Priority: r.IntN(3)}
+	value := func() string {
+		return fmt.Sprintf("v%d", r.IntN(8))
+	}
+	for range 1 + r.IntN(3) {
+		var matcher LogFieldMatcher
+		matcher.Field = []string{"source", "host", "message"}[r.IntN(3)]
+		switch r.IntN(6) {
+		case 0, 1:
+			matcher.Op = OpEqual
+			matcher.Value = value()
+		case 2:
+			matcher.Op = OpRegexp
+			matcher.Value = fmt.Sprintf(".*%s.*|%s", value(), value())
+		case 3:
+			matcher.Op = OpContains
+			matcher.Value = value()
+		case 4:
+			matcher.Op = OpNotEqual
+			matcher.Value = value()
+		case 5:
+			matcher.Op = OpRegexp
+			matcher.Value = "(?i)V1.*"
+		}
+		rule.Matchers = append(rule.Matchers, matcher)
+	}
+	if r.IntN(4) == 0 {
+		rule.Groups = append(rule.Groups, LogMatcherGroup{Op: GroupOr, Matchers: []LogFieldMatcher{
+			{Field: "host", Op: OpEqual, Value: value()},
+			{Field: "host", Op: OpEqual, Value: value()},
+		}})
+	}
+	if r.IntN(4) == 0 {
+		rule.Groups = append(rule.Groups, LogMatcherGroup{Op: GroupNot, Matchers: []LogFieldMatcher{
+			{Field: "message", Op: OpContains, Value: value()},
+		}})
+	}
+	return &rule
+}
+
+func randomBulkLog(r *rand.Rand) *Log {
+	stream := map[string]string{
+		"source": fmt.Sprintf("v%d", r.IntN(8)),
+		"host":   fmt.Sprintf("v%d", r.IntN(8)),
+	}
+	return NewLog(1, stream, fmt.Sprintf("v%d x v%d", r.IntN(8), r.IntN(8)))
+}
+
+func TestBulkRuleMatcher(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	var rules []*LogRule
+	for i := range 10000 {
+		rules = append(rules, randomBulkRule(r, i+1))
+	}
+	lrules := NewLogRules(rules, 1)
+	assert.Assert(t, len(lrules.brm.segments) > 1)
+
+	matched := 0
+	for range 1000 {
+		log := randomBulkLog(r)
+		expected := LogToRule(log, lrules.Ordered)
+		assert.Equal(t, lrules.brm.ToRule(log), expected)
+		if expected != nil {
+			matched++
+		}
+	}
+	assert.Assert(t, matched > 0)
+}
+
+func TestBulkRuleMatcherSelectivity(t *testing.T) {
+	// Every rule has the same host, so message is used instead
+	var rules []*LogRule
+	for i := range 10 {
+		rules = append(rules, &LogRule{ID: i + 1, Matchers: []LogFieldMatcher{
+			{Field: "host", Op: OpEqual, Value: "h"},
+			{Field: "message", Op: OpEqual, Value: fmt.Sprintf("m%d", i)},
+		}})
+	}
+	lrules := NewLogRules(rules, 1)
+	segment := lrules.brm.segments[0]
+	assert.Equal(t, len(segment.exact), 1)
+	assert.Equal(t, segment.exact[0].field, "message")
+	log := NewLog(1, map[string]string{"host": "h"}, "m3")
+	assert.Equal(t, lrules.brm.ToRule(log).ID, 4)
+}
+
+// bulkBenchmarkRules produces 50k rules: mostly exact matches
+// (of skewed fields), some regexps and substrings, and a few which
+// cannot be indexed at all
+func bulkBenchmarkRules() []*LogRule {
+	r := rand.New(rand.NewPCG(1, 2))
+	var rules []*LogRule
+	for i := range 50000 {
+		rule := LogRule{ID: i + 1}
+		source := fmt.Sprintf("source%d", r.IntN(20))
+		switch {
+		case i%100 == 0:
+			rule.Matchers = []LogFieldMatcher{{Field: "status", Op: OpGreater, Value: "500"}}
+		case i%10 == 0:
+			rule.Matchers = []LogFieldMatcher{
+				{Field: "message", Op: OpRegexp, Value: fmt.Sprintf(`.*error %d: .*`, i)},
+			}
+		case i%10 == 1:
+			rule.Matchers = []LogFieldMatcher{
+				{Field: "message", Op: OpContains, Value: fmt.Sprintf("token%d", i)},
+			}
+		default:
+			rule.Matchers = []LogFieldMatcher{
+				{Field: "host", Op: OpEqual, Value: "host"},
+				{Field: "source", Op: OpEqual, Value: source},
+				{Field: "message", Op: OpEqual, Value: fmt.Sprintf("message %d", i)},
+			}
+		}
+		rules = append(rules, &rule)
+	}
+	return rules
+}
+
+func bulkBenchmarkLogs() []*Log {
+	r := rand.New(rand.NewPCG(3, 4))
+	var logs []*Log
+	for range 1000 {
+		var message string
+		i := r.IntN(60000)
+		switch r.IntN(3) {
+		case 0:
+			message = fmt.Sprintf("message %d", i)
+		case 1:
+			message = fmt.Sprintf("got error %d: something", i)
+		case 2:
+			message = fmt.Sprintf("with token%d inside", i)
+		}
+		stream := map[string]string{"host": "host", "source": fmt.Sprintf("source%d", r.IntN(20))}
+		logs = append(logs, NewLog(1, stream, message))
+	}
+	return logs
+}
+
+func BenchmarkNewBulkRuleMatcher50k(b *testing.B) {
+	rules := SortLogRules(bulkBenchmarkRules())
+	b.ResetTimer()
+	for range b.N {
+		NewBulkRuleMatcher(rules)
+	}
+}
+
+func BenchmarkBulkRuleMatcher50k(b *testing.B) {
+	lrules := NewLogRules(bulkBenchmarkRules(), 1)
+	logs := bulkBenchmarkLogs()
+	b.ResetTimer()
+	for i := range b.N {
+		lrules.brm.ToRule(logs[i%len(logs)])
+	}
+}
+
+// Baseline: evaluating the rules one by one
+func BenchmarkLogToRule50k(b *testing.B) {
+	lrules := NewLogRules(bulkBenchmarkRules(), 1)
+	logs := bulkBenchmarkLogs()
+	b.ResetTimer()
+	for i := range b.N {
+		LogToRule(logs[i%len(logs)], lrules.Ordered)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Classification of external logs.
+
+ The database publishes an immutable snapshot of the ruleset whenever
+the rules change, so that logs can be classified without the database
+lock (which is held e.g. while the logs are fetched from the source).
+The logs of a batch are matched in parallel, as in addLogsToCounts.
+
+ Rate conditions depend on the cached logs, so the base verdict of the
+matching rule is used.
+*/
+
+package data
+
+import (
+	"time"
+
+	"github.com/sourcegraph/conc/iter"
+)
+
+// LogRulesSnapshot is an immutable view of a version of the ruleset
+type LogRulesSnapshot struct {
+	Version int
+
+	brm *BulkRuleMatcher
+}
+
+// ClassifyRequest is a log to classify: stream labels plus the raw
+// line, as in Loki
+type ClassifyRequest struct {
+	Stream map[string]string `json:"stream"`
+	Line   string            `json:"line"`
+
+	// Timestamp in nanoseconds since the epoch (default: now); it
+	// matters only for rules with validity periods
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+type ClassifyRule struct {
+	ID      int `json:"id"`
+	Version int `json:"version"`
+}
+
+type ClassifyResult struct {
+	Verdict string `json:"verdict"`
+
+	// The matching rule, if any
+	Rule *ClassifyRule `json:"rule,omitempty"`
+}
+
+// Classify returns the verdicts of the logs
+func (self *LogRulesSnapshot) Classify(requests []ClassifyRequest) []ClassifyResult {
+	now := time.Now().UnixNano()
+	return iter.Map(requests, func(request *ClassifyRequest) ClassifyResult {
+		timestamp := request.Timestamp
+		if timestamp == 0 {
+			timestamp = now
+		}
+		rule := self.brm.ToRule(NewLog(timestamp, request.Stream, request.Line))
+		if rule == nil {
+			return ClassifyResult{Verdict: LogVerdictUnknownKey}
+		}
+		return ClassifyResult{Verdict: rule.VerdictKey(), Rule: &ClassifyRule{ID: rule.ID, Version: rule.Version}}
+	})
+}
+
+// publishLogRules publishes snapshot of the current ruleset
+func (self *Database) publishLogRules() *LogRulesSnapshot {
+	brm := self.LogRules.brm
+	if brm == nil {
+		brm = NewBulkRuleMatcher(self.LogRules.Ordered)
+	}
+	snapshot := &LogRulesSnapshot{Version: self.LogRules.Version, brm: brm}
+	self.snapshot.Store(snapshot)
+	self.metrics.published(snapshot.Version, brm.duration)
+	return snapshot
+}
+
+// LogRulesSnapshot returns the latest snapshot of the ruleset; it
+// locks the database only if no snapshot has been published yet
+func (self *Database) LogRulesSnapshot() *LogRulesSnapshot {
+	if snapshot := self.snapshot.Load(); snapshot != nil {
+		return snapshot
+	}
+	self.Lock()
+	defer self.Unlock()
+
+	return self.publishLogRules()
+}
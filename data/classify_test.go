@@ -0,0 +1,60 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package data
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestClassify(t *testing.T) {
+	path := "test_db.json"
+	_ = os.Remove(path)
+
+	db := Database{Path: path}
+	requests := []ClassifyRequest{
+		{Stream: map[string]string{"source": "cron"}, Line: `{"message": "x"}`},
+		{Stream: map[string]string{"source": "kernel"}, Line: "plain"},
+	}
+
+	// Nothing published yet
+	snapshot := db.LogRulesSnapshot()
+	assert.DeepEqual(t, snapshot.Classify(requests), []ClassifyResult{{Verdict: LogVerdictUnknownKey}, {Verdict: LogVerdictUnknownKey}})
+
+	assert.Equal(t, db.Add(LogRule{Matchers: []LogFieldMatcher{{Field: "source", Op: OpEqual, Value: "cron"}}}), nil)
+	past := time.Unix(1, 0)
+	assert.Equal(t, db.Add(LogRule{Ham: true, ValidUntil: &past, Matchers: []LogFieldMatcher{{Field: "source", Op: OpEqual, Value: "kernel"}}}), nil)
+	snapshot2 := db.LogRulesSnapshot()
+	assert.Assert(t, snapshot2 != snapshot)
+	assert.Equal(t, snapshot2.Version, db.LogRules.Version)
+	assert.DeepEqual(t, snapshot2.Classify(requests), []ClassifyResult{
+		{Verdict: LogVerdictSpamKey, Rule: &ClassifyRule{ID: 1}},
+		{Verdict: LogVerdictUnknownKey},
+	})
+
+	// The validity period applies at the timestamp of the log
+	requests[1].Timestamp = 1
+	assert.DeepEqual(t, snapshot2.Classify(requests)[1], ClassifyResult{Verdict: LogVerdictHamKey, Rule: &ClassifyRule{ID: 2}})
+}
+
+func BenchmarkClassify50k(b *testing.B) {
+	lrules := NewLogRules(bulkBenchmarkRules(), 1)
+	snapshot := LogRulesSnapshot{Version: lrules.Version, brm: lrules.brm}
+	var requests []ClassifyRequest
+	for _, log := range bulkBenchmarkLogs() {
+		requests = append(requests, ClassifyRequest{Stream: log.Stream, Line: log.RawMessage, Timestamp: log.Timestamp})
+	}
+	b.ResetTimer()
+	for range b.N {
+		snapshot.Classify(requests)
+	}
+	b.ReportMetric(float64(b.N*len(requests))/b.Elapsed().Seconds(), "logs/s")
+}
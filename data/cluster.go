@@ -0,0 +1,183 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Log template mining.
+
+ This is a simplified version of Drain (He et al., 'Drain: An Online
+Log Parsing Approach with Fixed Depth Tree'). Messages are split into
+tokens, and grouped first by source and token count, then by the first
+token. Within such a group, the message joins the most similar
+existing cluster (if similar enough); positions where the cluster
+members differ become wildcards in the cluster template.
+*/
+
+package data
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Clustering parameters: how the logs are grouped, how similar the
+// members of a cluster must be, and how much of them is kept
+
+// Stream key the clusters are split by
+const clusterStreamKey = "source"
+
+// Minimum ratio of matching tokens for message to join a cluster
+const clusterSimilarityThreshold = 0.4
+
+// Number of example logs stored for each cluster
+const clusterExamples = 3
+
+// Token used in the templates in place of variable tokens
+const ClusterWildcard = "<*>"
+
+type LogCluster struct {
+	// Value of the clusterStreamKey for the logs in the cluster
+	Stream string
+
+	// Template of the cluster, with wildcards in place of variable tokens
+	Tokens []string
+
+	// Number of logs in the cluster, and first few of them
+	Count    int
+	Examples []*Log
+}
+
+func (self *LogCluster) Template() string {
+	return strings.Join(self.Tokens, " ")
+}
+
+// similarity returns ratio of tokens that match the template
+func (self *LogCluster) similarity(tokens []string) float64 {
+	if len(tokens) == 0 {
+		return 1
+	}
+	equal := 0
+	for i, token := range self.Tokens {
+		if token == tokens[i] {
+			equal++
+		}
+	}
+	return float64(equal) / float64(len(tokens))
+}
+
+func (self *LogCluster) add(log *Log, tokens []string) {
+	for i, token := range self.Tokens {
+		if token != tokens[i] {
+			self.Tokens[i] = ClusterWildcard
+		}
+	}
+	self.Count++
+	if len(self.Examples) < clusterExamples {
+		self.Examples = append(self.Examples, log)
+	}
+}
+
+// Rule returns (unsaved) rule which matches every log in the cluster
+func (self *LogCluster) Rule() *LogRule {
+	patterns := make([]string, len(self.Tokens))
+	for i, token := range self.Tokens {
+		if token == ClusterWildcard {
+			patterns[i] = `\S+`
+		} else {
+			patterns[i], _ = GeneralizeMessage(token)
+		}
+	}
+	pattern := `\s*`
+	if len(patterns) > 0 {
+		pattern = `\s*` + strings.Join(patterns, `\s+`) + `\s*`
+	}
+	rule := LogRule{Matchers: []LogFieldMatcher{{
+		Field: "message",
+		Op:    OpRegexp,
+		Value: pattern,
+	}}}
+	if self.Stream != "" {
+		rule.Matchers = append(rule.Matchers, LogFieldMatcher{
+			Field: clusterStreamKey,
+			Op:    OpEqual,
+			Value: self.Stream,
+		})
+	}
+	return &rule
+}
+
+type logClusterKey struct {
+	stream string
+	count  int
+	first  string
+}
+
+// LogClusterer groups logs into clusters by their message templates
+type LogClusterer struct {
+	groups   map[logClusterKey][]*LogCluster
+	clusters []*LogCluster
+}
+
+func NewLogClusterer() *LogClusterer {
+	return &LogClusterer{groups: make(map[logClusterKey][]*LogCluster)}
+}
+
+func hasDigit(s string) bool {
+	return strings.IndexFunc(s, unicode.IsDigit) >= 0
+}
+
+func (self *LogClusterer) Add(log *Log) {
+	tokens := strings.Fields(log.Message)
+	key := logClusterKey{stream: log.Stream[clusterStreamKey], count: len(tokens)}
+	if len(tokens) > 0 {
+		// Tokens with digits are likely to be variable, so they
+		// are not used to split the groups
+		key.first = tokens[0]
+		if hasDigit(key.first) {
+			key.first = ClusterWildcard
+		}
+	}
+	var best *LogCluster
+	bestSimilarity := clusterSimilarityThreshold
+	for _, cluster := range self.groups[key] {
+		similarity := cluster.similarity(tokens)
+		if similarity >= bestSimilarity {
+			best = cluster
+			bestSimilarity = similarity
+		}
+	}
+	if best == nil {
+		best = &LogCluster{Stream: key.stream, Tokens: slices.Clone(tokens)}
+		self.groups[key] = append(self.groups[key], best)
+		self.clusters = append(self.clusters, best)
+	}
+	best.add(log, tokens)
+}
+
+// Clusters returns the clusters, the largest first
+func (self *LogClusterer) Clusters() []*LogCluster {
+	result := slices.Clone(self.clusters)
+	slices.SortStableFunc(result, func(a, b *LogCluster) int {
+		return cmp.Compare(b.Count, a.Count)
+	})
+	return result
+}
+
+// UnknownLogClusters clusters the cached logs which do not match any rule
+func (self *Database) UnknownLogClusters() []*LogCluster {
+	self.Lock()
+	defer self.Unlock()
+
+	clusterer := NewLogClusterer()
+	for _, log := range self.logs {
+		if log.ToRule(&self.LogRules) == nil {
+			clusterer.Add(log)
+		}
+	}
+	return clusterer.Clusters()
+}
@@ -0,0 +1,54 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package data
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestLogClusterer(t *testing.T) {
+	kernel := map[string]string{"source": "kernel"}
+	other := map[string]string{"source": "other"}
+	logs := []*Log{
+		NewLog(1, kernel, "process 123 exited with status 1"),
+		NewLog(2, kernel, "process 456 exited with status 0"),
+		NewLog(3, kernel, "process foo exited with status 0"),
+		NewLog(4, kernel, "link eth0 up"),
+		NewLog(5, other, "process 123 exited with status 1"),
+		NewLog(6, kernel, "totally different message with six"),
+	}
+	clusterer := NewLogClusterer()
+	for _, log := range logs {
+		clusterer.Add(log)
+	}
+	clusters := clusterer.Clusters()
+	assert.Equal(t, len(clusters), 4)
+	assert.Equal(t, clusters[0].Count, 3)
+	assert.Equal(t, clusters[0].Stream, "kernel")
+	assert.Equal(t, clusters[0].Template(), "process <*> exited with status <*>")
+	assert.Equal(t, len(clusters[0].Examples), 3)
+
+	// The rule covers the whole cluster, but not the other source
+	rule := clusters[0].Rule()
+	assert.Equal(t, rule.Validate(), nil)
+	for _, log := range logs[:3] {
+		assert.Assert(t, LogMatchesRule(log, rule), log.Message)
+	}
+	for _, log := range logs[3:] {
+		assert.Assert(t, !LogMatchesRule(log, rule), log.Message)
+	}
+	// Not even similar messages
+	assert.Assert(t, !LogMatchesRule(NewLog(7, kernel, "process 1 exited"), rule))
+
+	// Single log cluster is still generalized
+	assert.Equal(t, clusters[2].Stream, "other")
+	rule = clusters[2].Rule()
+	assert.Assert(t, LogMatchesRule(NewLog(8, other, "process 789 exited with status 2"), rule))
+}
@@ -15,4 +15,6 @@ package data
 var ignoredStreamKeys = map[string]bool{"host": true, "lixie": true, "service_name": true}
 
 // When adding rules, these non-stream keys are also included if present
+//
+// (Nested fields can be referred to using dotted paths, e.g. 'http.method')
 var additionalFieldKeys = []string{"level"}
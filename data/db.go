@@ -19,6 +19,8 @@ import (
 	"os"
 	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/sourcegraph/conc/iter"
 )
@@ -31,13 +33,14 @@ type LogRules struct {
 	Rules   []*LogRule
 	Version int
 
-	// Reversed rules - these are always available if Rules are
-	Reversed []*LogRule `json:"-"`
+	// Rules in the evaluation order - these are always available if Rules are
+	Ordered []*LogRule `json:"-"`
 
 	brm *BulkRuleMatcher
 
 	// Internal tracking of rule matches to log lines
 	rid2Count map[int]int
+	rates     *rateCounters
 }
 
 type Database struct {
@@ -50,11 +53,38 @@ type Database struct {
 	Path   string    `json:"-"`
 	Source LogSource `json:"-"`
 
+	// Alerts about the newly fetched logs, if any
+	Alerter *Alerter `json:"-"`
+
+	// Where the newly fetched logs are pushed with their verdicts, if
+	// anywhere
+	LokiSink *LokiSink `json:"-"`
+
+	// Verdicts of the logs filtered out already by the source (see
+	// -loki-filter), if any; the rules with them get no hits
+	SourceFiltered []string `json:"-"`
+
 	LogRules LogRules
 	logs     []*Log
 
+	// Configured verdicts (if not set, DefaultLogVerdicts are used)
+	Verdicts []*LogVerdictInfo `json:",omitempty"`
+
 	// next id to be added state for rules
 	nextID int
+
+	// Per-rule hit statistics (persisted separately)
+	stats      logRuleStatsFile
+	statsDirty bool
+
+	// Latest ruleset, for use without the lock (see classify.go)
+	snapshot atomic.Pointer[LogRulesSnapshot]
+
+	// Prometheus metrics (with their own lock, see metrics.go)
+	metrics databaseMetrics
+
+	// Number of cached logs with the unknown verdict (see updateRates)
+	unknownLogs int
 }
 
 var (
@@ -64,15 +94,18 @@ var (
 )
 
 func NewLogRules(rules []*LogRule, version int) LogRules {
-	count := len(rules)
-	reversed := make([]*LogRule, count)
-	for k, v := range rules {
-		reversed[count-k-1] = v
+	ordered := SortLogRules(rules)
+	for _, rule := range rules {
+		rule.normalizeVerdict()
+		rule.compile()
 	}
-	return LogRules{Rules: rules, Reversed: reversed, brm: NewBulkRuleMatcher(reversed), Version: version}
+	return LogRules{Rules: rules, Ordered: ordered, brm: NewBulkRuleMatcher(ordered), Version: version}
 }
 
 func (self *Database) add(r LogRule) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
 	r.ID = self.nextLogRuleID()
 	return self.save(append(slices.Clone(self.LogRules.Rules), &r))
 }
@@ -94,6 +127,9 @@ func (self *Database) AddOrUpdate(rule LogRule) error {
 		}
 		// TODO do we want to error if version differs?
 		if v.Version == rule.Version {
+			if err := rule.Validate(); err != nil {
+				return err
+			}
 			rule.Version++
 			nrules := slices.Clone(self.LogRules.Rules)
 			nrules[i] = &rule
@@ -117,7 +153,142 @@ func (self *Database) Delete(rid int) error {
 	return ErrRuleNotFound
 }
 
-func (self *Database) nextLogRuleID() int {
+// rulesWith returns the rules with the given rule added, or replacing
+// the rule with the same ID. Unsaved rules get the ID they would get
+// if they were added.
+func (self *Database) rulesWith(rule *LogRule) []*LogRule {
+	if rule.ID == 0 {
+		rule.ID = self.peekLogRuleID()
+	}
+	rules := slices.DeleteFunc(slices.Clone(self.LogRules.Rules), func(other *LogRule) bool {
+		return other.ID == rule.ID
+	})
+	return append(rules, rule)
+}
+
+// rulesDisabled returns the rules with the given rules disabled (or
+// enabled), and a flag indicating whether all of them were found
+func (self *Database) rulesDisabled(rids []int, disabled bool) ([]*LogRule, bool) {
+	rules := slices.Clone(self.LogRules.Rules)
+	found := 0
+	for i, rule := range rules {
+		if !slices.Contains(rids, rule.ID) {
+			continue
+		}
+		found++
+		if rule.Disabled != disabled {
+			nrule := *rule
+			nrule.Disabled = disabled
+			nrule.Version++
+			rules[i] = &nrule
+		}
+	}
+	return rules, found == len(rids)
+}
+
+// SetDisabled disables (or enables) the given rules
+func (self *Database) SetDisabled(rids []int, disabled bool) error {
+	self.Lock()
+	defer self.Unlock()
+
+	rules, ok := self.rulesDisabled(rids, disabled)
+	if !ok {
+		return ErrRuleNotFound
+	}
+	return self.save(rules)
+}
+
+// DeleteExpired removes rules which expired before the given time, and
+// returns the number of rules removed
+func (self *Database) DeleteExpired(before time.Time) (int, error) {
+	self.Lock()
+	defer self.Unlock()
+
+	rules := slices.DeleteFunc(slices.Clone(self.LogRules.Rules), func(rule *LogRule) bool {
+		return rule.Expired(before)
+	})
+	removed := len(self.LogRules.Rules) - len(rules)
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, self.save(rules)
+}
+
+// Move moves the rule just above (or below) the target rule in the
+// evaluation order. As a side effect, all rules get distinct
+// priorities.
+func (self *Database) Move(rid, target int, above bool) error {
+	self.Lock()
+	defer self.Unlock()
+
+	return self.move(rid, target, above)
+}
+
+func (self *Database) move(rid, target int, above bool) error {
+	ordered := slices.Clone(self.LogRules.Ordered)
+	i := slices.IndexFunc(ordered, func(rule *LogRule) bool { return rule.ID == rid })
+	if i < 0 {
+		return ErrRuleNotFound
+	}
+	if rid == target {
+		// Already where it should be
+		return nil
+	}
+	rule := ordered[i]
+	ordered = slices.Delete(ordered, i, i+1)
+	j := slices.IndexFunc(ordered, func(rule *LogRule) bool { return rule.ID == target })
+	if j < 0 {
+		return ErrRuleNotFound
+	}
+	if !above {
+		j++
+	}
+	ordered = slices.Insert(ordered, j, rule)
+
+	// Renumber the priorities; rules whose priority changes get new version
+	changed := make(map[int]*LogRule)
+	for i, rule := range ordered {
+		priority := len(ordered) - i
+		if rule.Priority != priority {
+			nrule := *rule
+			nrule.Priority = priority
+			nrule.Version++
+			changed[rule.ID] = &nrule
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	nrules := slices.Clone(self.LogRules.Rules)
+	for i, rule := range nrules {
+		if nrule, ok := changed[rule.ID]; ok {
+			nrules[i] = nrule
+		}
+	}
+	return self.save(nrules)
+}
+
+// MoveUp moves the rule one step earlier (up) or later (down) in the evaluation order
+func (self *Database) MoveUp(rid int, up bool) error {
+	self.Lock()
+	defer self.Unlock()
+
+	ordered := self.LogRules.Ordered
+	i := slices.IndexFunc(ordered, func(rule *LogRule) bool { return rule.ID == rid })
+	if i < 0 {
+		return ErrRuleNotFound
+	}
+	if up && i > 0 {
+		return self.move(rid, ordered[i-1].ID, true)
+	}
+	if !up && i < len(ordered)-1 {
+		return self.move(rid, ordered[i+1].ID, false)
+	}
+	return nil
+}
+
+// peekLogRuleID returns the ID the next added rule will get
+func (self *Database) peekLogRuleID() int {
 	id := self.nextID
 	if id == 0 {
 		id = 1 // Start at 1 even with empty database
@@ -127,6 +298,11 @@ func (self *Database) nextLogRuleID() int {
 			}
 		}
 	}
+	return id
+}
+
+func (self *Database) nextLogRuleID() int {
+	id := self.peekLogRuleID()
 	self.nextID = id + 1
 	return id
 }
@@ -135,15 +311,66 @@ func (self *Database) updateLogs() error {
 	if self.Source == nil {
 		return ErrNoSource
 	}
+	start := time.Now()
 	logs, err := self.Source.Load()
+	self.metrics.fetched(time.Since(start), err)
 	if err != nil {
 		return err
 	}
-	self.addLogsToCounts(logs)
+	rules := self.addLogsToCounts(logs)
+	self.addLogsToStats(logs)
 	self.logs = append(logs, self.logs...)
+	self.updateRates(logs)
+
+	ingested := make([]ingestedLog, len(logs))
+	for i, log := range logs {
+		ingested[i] = ingestedLog{log: log, verdict: log.Verdict(&self.LogRules), rule: rules[i]}
+	}
+	self.updateMetrics(ingested)
+	if self.Alerter != nil {
+		self.Alerter.add(ingested)
+	}
+	if self.LokiSink != nil {
+		self.LokiSink.add(ingested)
+	}
 	return nil
 }
 
+// ingestedLog is a newly fetched log, with its verdict (including the
+// rate conditions) and rule
+type ingestedLog struct {
+	log     *Log
+	verdict int
+	rule    *LogRule
+}
+
+// updateMetrics counts the newly fetched logs in the metrics
+func (self *Database) updateMetrics(ingested []ingestedLog) {
+	self.metrics.addLogs(ingested)
+	self.metrics.setUnknownLogs(self.unknownLogs)
+}
+
+// ensureLogs fetches the logs, but only if we have nothing in cache
+func (self *Database) ensureLogs() error {
+	if self.logs == nil {
+		return self.updateLogs()
+	}
+	return nil
+}
+
+// CachedLogs returns the cached logs, without fetching new ones unless
+// there are none yet
+func (self *Database) CachedLogs() ([]*Log, error) {
+	self.Lock()
+	defer self.Unlock()
+
+	err := self.ensureLogs()
+	if err != nil {
+		return nil, err
+	}
+	return self.logs, nil
+}
+
 func (self *Database) Logs() ([]*Log, error) {
 	self.Lock()
 	defer self.Unlock()
@@ -175,13 +402,34 @@ func (self *Database) getLogByHashUnlocked(hash uint64) *Log {
 	return nil
 }
 
-func (self *Database) ClassifyHash(hash uint64, ham bool) error {
+func (self *Database) ClassifyHash(hash uint64, verdict string) error {
+	rule, err := self.LogRuleForHash(hash, verdict)
+	if err != nil {
+		return err
+	}
+	return self.Add(*rule)
+}
+
+// SnoozeHash adds temporary spam rule for the log, valid until the
+// given time
+func (self *Database) SnoozeHash(hash uint64, until time.Time) error {
+	rule, err := self.LogRuleForHash(hash, LogVerdictSpamKey)
+	if err != nil {
+		return err
+	}
+	rule.ValidUntil = &until
+	rule.Comment = "Snoozed"
+	return self.Add(*rule)
+}
+
+// LogRuleForHash produces (unsaved) rule that matches the given log
+func (self *Database) LogRuleForHash(hash uint64, verdict string) (*LogRule, error) {
 	l := self.getLogByHashUnlocked(hash)
 	if l == nil {
-		return ErrHashNotFound
+		return nil, ErrHashNotFound
 	}
 	// Add filters - message and then all Loki labels with cardinality > 1
-	rule := LogRule{Ham: ham, Matchers: []LogFieldMatcher{{
+	rule := LogRule{Verdict: verdict, Matchers: []LogFieldMatcher{{
 		Field: "message",
 		Op:    "=",
 		Value: l.Message,
@@ -197,25 +445,31 @@ func (self *Database) ClassifyHash(hash uint64, ham bool) error {
 		})
 	}
 	for _, k := range additionalFieldKeys {
-		value, ok := l.Fields[k]
-		if ok {
-			switch value := value.(type) {
-			case string:
-				rule.Matchers = append(rule.Matchers, LogFieldMatcher{
-					Field: k,
-					Op:    "=",
-					Value: value,
-				})
-			default:
-				slog.Info("Unknown field type in ClassifyHash", "field", k, "value", value)
-			}
+		value, ok := l.FieldValue(k)
+		if !ok {
+			continue
 		}
+		s, ok := scalarFieldValueToString(value)
+		if !ok {
+			slog.Debug("Non-scalar field ignored in ClassifyHash", "field", k, "value", value)
+			continue
+		}
+		rule.Matchers = append(rule.Matchers, LogFieldMatcher{
+			Field: k,
+			Op:    OpEqual,
+			Value: s,
+		})
 	}
-	return self.Add(rule)
+	return &rule, nil
 }
 
 func (self *Database) save(rules []*LogRule) error {
-	self.LogRules = NewLogRules(rules, self.LogRules.Version+1)
+	old := self.LogRules
+	self.LogRules = NewLogRules(rules, old.Version+1)
+	self.LogRules.rid2Count = self.updatedCounts(&old, &self.LogRules)
+	self.updateRates(nil)
+	self.metrics.setUnknownLogs(self.unknownLogs)
+	self.publishLogRules()
 	b, err := json.Marshal(self)
 	if err != nil {
 		return err
@@ -244,31 +498,143 @@ func (self *Database) save(rules []*LogRule) error {
 	return nil
 }
 
-func (self *Database) addLogsToCounts(logs []*Log) {
+// addLogsToCounts matches the logs (in parallel), and returns their
+// rules; the rule counts are updated if they are in use
+func (self *Database) addLogsToCounts(logs []*Log) []*LogRule {
 	lrules := &self.LogRules
-	r2c := lrules.rid2Count
-	if r2c == nil {
-		return
-	}
-	for _, rule := range iter.Map(logs, func(logp **Log) *LogRule {
+	rules := iter.Map(logs, func(logp **Log) *LogRule {
 		return (*logp).ToRule(lrules)
-	}) {
-		if rule != nil {
-			r2c[rule.ID]++
+	})
+	if r2c := lrules.rid2Count; r2c != nil {
+		for _, rule := range rules {
+			if rule != nil {
+				r2c[rule.ID]++
+			}
+		}
+	}
+	return rules
+}
+
+// maxIncrementalRules is the number of changed rules above which the
+// rule counts are recomputed from scratch instead
+const maxIncrementalRules = 16
+
+// ruleChanges describes which rules of a ruleset differ from the
+// previous one
+type ruleChanges struct {
+	oldRules, newRules map[int]*LogRule
+
+	// Changed (and added) rules, in the evaluation order
+	changed []*LogRule
+}
+
+func newRuleChanges(old, lrules *LogRules) *ruleChanges {
+	result := ruleChanges{
+		oldRules: make(map[int]*LogRule, len(old.Rules)),
+		newRules: make(map[int]*LogRule, len(lrules.Rules)),
+	}
+	for _, rule := range old.Rules {
+		result.oldRules[rule.ID] = rule
+	}
+	for _, rule := range lrules.Rules {
+		result.newRules[rule.ID] = rule
+	}
+	for _, rule := range lrules.Ordered {
+		if !result.kept(rule) {
+			result.changed = append(result.changed, rule)
+		}
+	}
+	return &result
+}
+
+// kept returns true if the rule is present (as is) in both rulesets
+func (self *ruleChanges) kept(rule *LogRule) bool {
+	return self.oldRules[rule.ID] == rule && self.newRules[rule.ID] == rule
+}
+
+// incremental returns true if there are few enough changes to make
+// rematch cheaper than matching from scratch
+func (self *ruleChanges) incremental() bool {
+	return len(self.changed) <= maxIncrementalRules
+}
+
+// rematch returns the rule of the log in the new ruleset, given its
+// rule in the old one. Only the logs whose rule may have changed are
+// matched again: the logs of changed (or removed) rules, and the logs
+// which a changed rule matches ahead of their current rule.
+func (self *ruleChanges) rematch(log *Log, prev *LogRule, lrules *LogRules) *LogRule {
+	if !self.incremental() || (prev != nil && !self.kept(prev)) {
+		return lrules.brm.ToRule(log)
+	}
+	for _, rule := range self.changed {
+		if prev != nil && CompareLogRulePriority(rule, prev) > 0 {
+			break
+		}
+		if LogMatchesRule(log, rule) {
+			return rule
 		}
 	}
+	return prev
+}
+
+type logRuleChange struct {
+	prev, next *LogRule
+}
+
+// rematchLogs returns the rules of the logs in both the old and the
+// new ruleset
+func rematchLogs(logs []*Log, old, lrules *LogRules) []logRuleChange {
+	changes := newRuleChanges(old, lrules)
+	return iter.Map(logs, func(logp **Log) logRuleChange {
+		log := *logp
+		prev := log.ToRule(old)
+		return logRuleChange{prev: prev, next: changes.rematch(log, prev, lrules)}
+	})
+}
+
+// updatedCounts returns the rule counts of the new ruleset, based on
+// the counts of the old one (see ruleChanges.rematch). If there are no
+// counts (or too many changes), nil is returned and the counts are
+// lazily recomputed by RuleCount.
+func (self *Database) updatedCounts(old, lrules *LogRules) map[int]int {
+	if old.rid2Count == nil {
+		return nil
+	}
+	changes := newRuleChanges(old, lrules)
+	if !changes.incremental() {
+		return nil
+	}
+	r2c := make(map[int]int, len(lrules.Rules))
+	for _, rule := range lrules.Rules {
+		if changes.kept(rule) {
+			r2c[rule.ID] = old.rid2Count[rule.ID]
+		} else {
+			r2c[rule.ID] = 0
+		}
+	}
+	for i, change := range rematchLogs(self.logs, old, lrules) {
+		log := self.logs[i]
+		log.rule = change.next
+		log.rulesVersion = lrules.Version
+		if change.prev != nil && changes.kept(change.prev) {
+			if change.next == change.prev {
+				continue
+			}
+			r2c[change.prev.ID]--
+		}
+		if change.next != nil {
+			r2c[change.next.ID]++
+		}
+	}
+	return r2c
 }
 
 func (self *Database) RuleCount(rid int) int {
 	self.Lock()
 	defer self.Unlock()
 
-	// Trigger logs refresh only if we have nothing in cache
-	if self.logs == nil {
-		err := self.updateLogs()
-		if err != nil {
-			return -1
-		}
+	if err := self.ensureLogs(); err != nil {
+		return -1
 	}
 
 	lrules := &self.LogRules
@@ -290,7 +656,23 @@ func (self *Database) Load() error {
 		return err
 	}
 
-	// Recreate to have also reverse slice
+	err = SetLogVerdicts(self.Verdicts)
+	if err != nil {
+		return err
+	}
+
+	err = self.loadStats()
+	if err != nil {
+		return err
+	}
+
+	// Recreate to have also ordered slice
 	self.LogRules = NewLogRules(self.LogRules.Rules, self.LogRules.Version)
+	self.publishLogRules()
+
+	// Invalid rules are kept (they never match), but let the user know
+	for _, invalid := range self.LogRules.Invalid() {
+		slog.Warn("Invalid rule loaded", "id", invalid.Rule.ID, "err", invalid.Rule.Validate())
+	}
 	return nil
 }
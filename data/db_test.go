@@ -12,8 +12,10 @@
 package data
 
 import (
+	"math/rand/v2"
 	"os"
 	"testing"
+	"time"
 
 	"gotest.tools/v3/assert"
 )
@@ -44,6 +46,11 @@ func TestDatabase(t *testing.T) {
 	// Ensure they also match (only one fetched now)
 	assert.Equal(t, db.RuleCount(1), 1)
 
+	// Cached logs do not trigger a fetch
+	logs, err = db.CachedLogs()
+	assert.Equal(t, len(logs), 1)
+	assert.Equal(t, err, nil)
+
 	// Fetch more
 	logs, err = db.Logs()
 	assert.Equal(t, len(logs), 2)
@@ -82,3 +89,158 @@ func TestDatabase(t *testing.T) {
 
 	assert.Equal(t, db.Delete(1), ErrRuleNotFound)
 }
+
+func TestDatabaseMove(t *testing.T) {
+	path := "test_db.json"
+	_ = os.Remove(path)
+
+	db := Database{Path: path}
+	for range 3 {
+		assert.Equal(t, db.Add(LogRule{}), nil)
+	}
+	ids := func() []int {
+		var result []int
+		for _, rule := range db.LogRules.Ordered {
+			result = append(result, rule.ID)
+		}
+		return result
+	}
+	// Newest first by default
+	assert.DeepEqual(t, ids(), []int{3, 2, 1})
+
+	assert.Equal(t, db.Move(1, 3, true), nil)
+	assert.DeepEqual(t, ids(), []int{1, 3, 2})
+
+	assert.Equal(t, db.MoveUp(2, true), nil)
+	assert.DeepEqual(t, ids(), []int{1, 2, 3})
+
+	assert.Equal(t, db.MoveUp(1, false), nil)
+	assert.DeepEqual(t, ids(), []int{2, 1, 3})
+
+	// Already last
+	assert.Equal(t, db.MoveUp(3, false), nil)
+	assert.DeepEqual(t, ids(), []int{2, 1, 3})
+
+	assert.Equal(t, db.Move(1, 42, true), ErrRuleNotFound)
+	assert.Equal(t, db.Move(42, 42, true), ErrRuleNotFound)
+
+	// Moving relative to itself does nothing
+	assert.Equal(t, db.Move(1, 1, false), nil)
+	assert.DeepEqual(t, ids(), []int{2, 1, 3})
+
+	// Explicit priority wins over ID
+	err := db.AddOrUpdate(LogRule{ID: 3, Priority: 10, Version: db.LogRules.Ordered[2].Version})
+	assert.Equal(t, err, nil)
+	assert.DeepEqual(t, ids(), []int{3, 2, 1})
+
+	// The bulk matcher honors the same order
+	log := NewLog(1, nil, "")
+	assert.Equal(t, log.ToRule(&db.LogRules).ID, 3)
+}
+
+func TestDatabaseExpiry(t *testing.T) {
+	path := "test_db.json"
+	_ = os.Remove(path)
+
+	now := time.Now()
+	hourAgo := now.Add(-time.Hour)
+	db := Database{Path: path}
+	assert.Equal(t, db.Add(LogRule{Comment: "permanent"}), nil)
+	assert.Equal(t, db.Add(LogRule{Comment: "expired", ValidUntil: &hourAgo}), nil)
+	assert.Equal(t, db.Add(LogRule{Comment: "future", ValidFrom: &now}), nil)
+
+	// Only the rule valid at the time of the log matches
+	older := NewLog(hourAgo.Add(-time.Minute).UnixNano(), nil, "")
+	assert.Equal(t, older.ToRule(&db.LogRules).Comment, "expired")
+	middle := NewLog(now.Add(-time.Minute).UnixNano(), nil, "")
+	assert.Equal(t, middle.ToRule(&db.LogRules).Comment, "permanent")
+	newer := NewLog(now.Add(time.Minute).UnixNano(), nil, "")
+	assert.Equal(t, newer.ToRule(&db.LogRules).Comment, "future")
+
+	assert.ErrorIs(t, db.Add(LogRule{ValidFrom: &now, ValidUntil: &hourAgo}), ErrInvalidValidity)
+
+	// Still within the grace period
+	removed, err := db.DeleteExpired(now.Add(-2 * time.Hour))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, removed, 0)
+
+	removed, err = db.DeleteExpired(now)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, removed, 1)
+	assert.Equal(t, len(db.LogRules.Rules), 2)
+}
+
+func TestDatabaseRuleCountIncremental(t *testing.T) {
+	path := "test_db.json"
+	_ = os.Remove(path)
+
+	r := rand.New(rand.NewPCG(1, 2))
+	sources := []string{"a", "b", "c", "d"}
+	messages := []string{"foo", "bar", "baz"}
+	var logs []*Log
+	for i := range 500 {
+		stream := map[string]string{"source": sources[r.IntN(len(sources))]}
+		logs = append(logs, NewLog(int64(i+1), stream, messages[r.IntN(len(messages))]))
+	}
+	db := Database{Path: path, Source: &ArraySource{Data: logs, Chunk: len(logs)}}
+
+	randomRule := func() LogRule {
+		var rule LogRule
+		if r.IntN(3) > 0 {
+			rule.Matchers = append(rule.Matchers, LogFieldMatcher{Field: "source", Op: OpEqual, Value: sources[r.IntN(len(sources))]})
+		}
+		if r.IntN(2) > 0 {
+			rule.Matchers = append(rule.Matchers, LogFieldMatcher{Field: "message", Op: OpEqual, Value: messages[r.IntN(len(messages))]})
+		}
+		rule.Priority = r.IntN(3)
+		rule.Disabled = r.IntN(5) == 0
+		return rule
+	}
+	randomExisting := func() *LogRule {
+		return db.LogRules.Rules[r.IntN(len(db.LogRules.Rules))]
+	}
+	for range 5 {
+		assert.Equal(t, db.Add(randomRule()), nil)
+	}
+	// Establish the initial counts
+	_ = db.RuleCount(1)
+
+	for range 200 {
+		switch r.IntN(4) {
+		case 0:
+			assert.Equal(t, db.Add(randomRule()), nil)
+		case 1:
+			old := randomExisting()
+			rule := randomRule()
+			rule.ID = old.ID
+			rule.Version = old.Version
+			assert.Equal(t, db.AddOrUpdate(rule), nil)
+		case 2:
+			if len(db.LogRules.Rules) > 1 {
+				assert.Equal(t, db.Delete(randomExisting().ID), nil)
+			}
+		case 3:
+			assert.Equal(t, db.MoveUp(randomExisting().ID, r.IntN(2) == 0), nil)
+		}
+		counts := db.LogRules.rid2Count
+		if counts == nil {
+			// Too many changes; start over
+			_ = db.RuleCount(1)
+			continue
+		}
+
+		// Compare against full recount
+		expected := make(map[int]int)
+		for _, rule := range db.LogRules.Rules {
+			expected[rule.ID] = 0
+		}
+		for _, log := range logs {
+			rule := db.LogRules.brm.ToRule(log)
+			assert.Equal(t, log.ToRule(&db.LogRules), rule)
+			if rule != nil {
+				expected[rule.ID]++
+			}
+		}
+		assert.DeepEqual(t, counts, expected)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Digest of the logs of a period.
+
+ The digest covers what is worth a look: the ham logs, the largest
+templates of the unknown logs, the sources that had no logs before the
+period (within the log cache), and the rules that matched during the
+previous period of the same length but not during this one (according
+to the rule statistics). Rules whose logs are filtered out by the source
+never match, so they are not reported as stopped.
+*/
+
+package data
+
+import (
+	"cmp"
+	"slices"
+	"time"
+)
+
+// Ham logs and unknown log templates included in a digest (the rest
+// are only counted)
+const (
+	maxDigestLogs     = 50
+	maxDigestClusters = 10
+)
+
+type LogDigestRule struct {
+	Rule  *LogRule
+	Stats *LogRuleStats
+}
+
+type LogDigest struct {
+	Since, Until time.Time
+
+	// Ham logs of the period, newest first
+	HamLogs  []*Log
+	HamCount int
+
+	// Largest templates of the unknown logs of the period
+	UnknownClusters []*LogCluster
+	UnknownCount    int
+
+	// Sources with no earlier logs
+	NewSources []string
+
+	// Rules which matched during the previous period, but not during
+	// this one
+	StoppedRules []*LogDigestRule
+}
+
+// Empty returns true if there is nothing to report
+func (self *LogDigest) Empty() bool {
+	return self.HamCount == 0 && self.UnknownCount == 0 && len(self.NewSources) == 0 && len(self.StoppedRules) == 0
+}
+
+// Digest fetches the logs, and returns the digest of the period
+func (self *Database) Digest(since, until time.Time) (*LogDigest, error) {
+	self.Lock()
+	defer self.Unlock()
+
+	if err := self.updateLogs(); err != nil {
+		return nil, err
+	}
+
+	result := LogDigest{Since: since, Until: until}
+	lrules := &self.LogRules
+	clusterer := NewLogClusterer()
+	sources := make(map[string]bool)
+	oldSources := make(map[string]bool)
+	for _, log := range self.logs {
+		source := log.Stream[clusterStreamKey]
+		if log.Time.Before(since) {
+			oldSources[source] = true
+			continue
+		}
+		if !log.Time.Before(until) {
+			continue
+		}
+		sources[source] = true
+		switch log.Verdict(lrules) {
+		case LogVerdictHam:
+			result.HamCount++
+			if len(result.HamLogs) < maxDigestLogs {
+				result.HamLogs = append(result.HamLogs, log)
+			}
+		case LogVerdictUnknown:
+			result.UnknownCount++
+			clusterer.Add(log)
+		}
+	}
+	result.UnknownClusters = clusterer.Clusters()
+	if len(result.UnknownClusters) > maxDigestClusters {
+		result.UnknownClusters = result.UnknownClusters[:maxDigestClusters]
+	}
+	for _, source := range SortedKeys[string](sources) {
+		if !oldSources[source] {
+			result.NewSources = append(result.NewSources, source)
+		}
+	}
+
+	previous := since.Add(-until.Sub(since))
+	for _, rule := range lrules.Ordered {
+		rstats, ok := self.stats.Rules[rule.ID]
+		if !ok || rule.Disabled || !rule.ValidAt(until) || slices.Contains(self.SourceFiltered, rule.VerdictKey()) {
+			continue
+		}
+		if rstats.SeenSince(previous) && !rstats.SeenSince(since) {
+			result.StoppedRules = append(result.StoppedRules, &LogDigestRule{Rule: rule, Stats: rstats.clone()})
+		}
+	}
+	slices.SortFunc(result.StoppedRules, func(a, b *LogDigestRule) int {
+		return cmp.Compare(a.Rule.ID, b.Rule.ID)
+	})
+	return &result, nil
+}
@@ -0,0 +1,76 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package data
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestDatabaseDigest(t *testing.T) {
+	path := "test_db.json"
+	_ = os.Remove(path)
+
+	until := time.Now().Truncate(time.Second)
+	since := until.Add(-24 * time.Hour)
+	newLog := func(age time.Duration, source, message string) *Log {
+		return NewLog(until.Add(-age).UnixNano(), map[string]string{"source": source}, message)
+	}
+	logs := []*Log{
+		newLog(time.Hour, "cron", "ham"),
+		newLog(2*time.Hour, "sshd", "user 1 logged in"),
+		newLog(3*time.Hour, "sshd", "user 2 logged in"),
+		newLog(4*time.Hour, "cron", "x"),
+		newLog(30*time.Hour, "cron", "old"),
+		newLog(50*time.Hour, "cron", "older"),
+	}
+	db := Database{Path: path, Source: &ArraySource{Data: logs, Chunk: len(logs)}}
+	for _, message := range []string{"old", "older", "x"} {
+		assert.Equal(t, db.Add(LogRule{Matchers: []LogFieldMatcher{{Field: "message", Op: OpEqual, Value: message}}}), nil)
+	}
+	assert.Equal(t, db.Add(LogRule{Ham: true, Matchers: []LogFieldMatcher{{Field: "message", Op: OpEqual, Value: "ham"}}}), nil)
+
+	digest, err := db.Digest(since, until)
+	assert.Equal(t, err, nil)
+	assert.Assert(t, !digest.Empty())
+	assert.Equal(t, len(digest.HamLogs), 1)
+	assert.Equal(t, digest.HamLogs[0], logs[0])
+	assert.Equal(t, digest.HamCount, 1)
+	assert.Equal(t, digest.UnknownCount, 2)
+	assert.Equal(t, len(digest.UnknownClusters), 1)
+	assert.Equal(t, digest.UnknownClusters[0].Template(), "user <*> logged in")
+	assert.DeepEqual(t, digest.NewSources, []string{"sshd"})
+	// Rule 2 last matched before the previous period
+	assert.Equal(t, len(digest.StoppedRules), 1)
+	assert.Equal(t, digest.StoppedRules[0].Rule.ID, 1)
+	assert.Equal(t, digest.StoppedRules[0].Stats.LastSeen, logs[4].Time)
+
+	// Nothing new, but the ham rule matched during the previous hour
+	digest, err = db.Digest(until, until.Add(time.Hour))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, digest.HamCount+digest.UnknownCount+len(digest.NewSources), 0)
+	assert.Equal(t, len(digest.StoppedRules), 1)
+	assert.Equal(t, digest.StoppedRules[0].Rule.ID, 4)
+
+	digest, err = db.Digest(until.Add(time.Hour), until.Add(2*time.Hour))
+	assert.Equal(t, err, nil)
+	assert.Assert(t, digest.Empty())
+
+	// Spam rules do not get hits if spam is filtered by the source
+	db.SourceFiltered = []string{LogVerdictSpamKey}
+	digest, err = db.Digest(since, until)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(digest.StoppedRules), 0)
+	digest, err = db.Digest(until, until.Add(time.Hour))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(digest.StoppedRules), 1)
+	assert.Equal(t, digest.StoppedRules[0].Rule.ID, 4)
+}
@@ -0,0 +1,411 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Common parts of the ruleset exporters (Vector VRL, Fluent Bit Lua and
+rsyslog RainerScript).
+
+ All of them export the rules which are in effect in the evaluation
+order, and the first matching rule determines the verdict. The
+semantics of the matchers (including absent fields, and matchers that
+do not compile) are those of LogFieldMatcher.MatchField; the target
+language specific parts are behind exportSyntax.
+
+ Runs of consecutive rules which all require an exact value of the
+same field are grouped into blocks dispatched by the value (see
+exportBlocks). As the field has only one value, this does not change
+which rule matches first.
+*/
+
+package data
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Shorter runs of rules are not worth dispatching by value
+const minDispatchRules = 4
+
+var ErrExportUnsupported = errors.New("not supported by the export target")
+
+type ExportOptions struct {
+	// Verdict keys of the logs which are dropped, instead of being
+	// annotated with the verdict
+	Drop []string
+
+	// Target specific field names (or paths) of the fields
+	Fields map[string]string
+}
+
+type exportField struct {
+	index int
+
+	// Name of the field within the rules
+	name string
+
+	// Are the values also needed as numbers?
+	numeric bool
+}
+
+// exportFields keeps track of the fields used by the rules
+type exportFields struct {
+	byName map[string]*exportField
+	order  []*exportField
+}
+
+func (self *exportFields) field(name string) *exportField {
+	field, ok := self.byName[name]
+	if !ok {
+		if self.byName == nil {
+			self.byName = make(map[string]*exportField)
+		}
+		field = &exportField{index: len(self.order), name: name}
+		self.byName[name] = field
+		self.order = append(self.order, field)
+	}
+	return field
+}
+
+// exportSyntax produces the target language expressions
+type exportSyntax interface {
+	and(exprs []string) string
+	or(exprs []string) string
+	not(expr string) string
+	constant(value bool) string
+
+	// present returns expression which is true if the field is present
+	present(field *exportField) string
+
+	// guard combines the expression on the value of the field with
+	// the presence check; absent fields match only if absent is set
+	guard(field *exportField, expr string, absent bool) string
+
+	// match returns expression for the matcher on the value of the
+	// (present) field; only the positive operations are used, and the
+	// value is valid for the operation
+	match(field *exportField, matcher *LogFieldMatcher) (string, error)
+
+	// validity returns expression for the validity period of a rule
+	validity(from, until *time.Time) string
+}
+
+func exportMatcherExpr(syntax exportSyntax, fields *exportFields, matcher *LogFieldMatcher) (string, error) {
+	op, ok := logFieldOps[matcher.Op]
+	if !ok {
+		return syntax.constant(false), nil
+	}
+	field := fields.field(matcher.Field)
+	if _, err := op.compile(matcher.Value); err != nil {
+		// Broken matchers match only absent fields (if even those)
+		if op.absent {
+			return syntax.not(syntax.present(field)), nil
+		}
+		return syntax.constant(false), nil
+	}
+	positive := *matcher
+	switch matcher.Op {
+	case OpExists:
+		return syntax.present(field), nil
+	case OpNotExists:
+		return syntax.not(syntax.present(field)), nil
+	case OpNotEqual:
+		positive.Op = OpEqual
+	case OpNotRegexp:
+		positive.Op = OpRegexp
+	case OpLess, OpLessEqual, OpGreater, OpGreaterEqual:
+		field.numeric = true
+	}
+	expr, err := syntax.match(field, &positive)
+	if err != nil {
+		return "", err
+	}
+	if positive.Op != matcher.Op {
+		expr = syntax.not(expr)
+	}
+	return syntax.guard(field, expr, op.absent), nil
+}
+
+// exportMembersExprs returns the expressions of the non-empty members
+// of the group
+func exportMembersExprs(syntax exportSyntax, fields *exportFields, group *LogMatcherGroup) ([]string, error) {
+	var exprs []string
+	for i := range group.Matchers {
+		if group.Matchers[i].empty() {
+			continue
+		}
+		expr, err := exportMatcherExpr(syntax, fields, &group.Matchers[i])
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+	for i := range group.Groups {
+		if group.Groups[i].Empty() {
+			continue
+		}
+		expr, err := exportGroupExpr(syntax, fields, &group.Groups[i])
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+	return exprs, nil
+}
+
+func exportGroupExpr(syntax exportSyntax, fields *exportFields, group *LogMatcherGroup) (string, error) {
+	exprs, err := exportMembersExprs(syntax, fields, group)
+	if err != nil {
+		return "", err
+	}
+	switch group.Op {
+	case GroupAnd:
+		return syntax.and(exprs), nil
+	case GroupOr:
+		return syntax.or(exprs), nil
+	case GroupNot:
+		return syntax.not(syntax.and(exprs)), nil
+	}
+	return syntax.constant(false), nil
+}
+
+// exportRuleExprs returns the conditions of the rule, which must all
+// be true for the rule to match
+func exportRuleExprs(syntax exportSyntax, fields *exportFields, rule *LogRule) ([]string, error) {
+	var exprs []string
+	if rule.ValidFrom != nil || rule.ValidUntil != nil {
+		exprs = append(exprs, syntax.validity(rule.ValidFrom, rule.ValidUntil))
+	}
+	group := rule.group()
+	members, err := exportMembersExprs(syntax, fields, &group)
+	if err != nil {
+		return nil, err
+	}
+	return append(exprs, members...), nil
+}
+
+// exportRules returns the rules in effect, in the evaluation order
+func (self *LogRules) exportRules(now time.Time) []*LogRule {
+	return slices.DeleteFunc(slices.Clone(self.Ordered), func(rule *LogRule) bool {
+		return rule.Disabled || rule.Expired(now)
+	})
+}
+
+// exportRetention returns the retention hint of the verdict of the rule
+func exportRetention(rule *LogRule) string {
+	if verdict, ok := LogVerdictFromKey(rule.VerdictKey()); ok {
+		return LogVerdictInfoOf(verdict).Retention
+	}
+	return ""
+}
+
+type exportBucket struct {
+	value string
+	rules []*LogRule
+}
+
+// exportBlock is a run of consecutive rules; either plain rules, or
+// rules dispatched by the value of a field
+type exportBlock struct {
+	rules []*LogRule
+
+	field   string
+	buckets []exportBucket
+}
+
+// dispatchValue returns the exact value the rule requires the field to
+// have (as a canonical string), if any
+func dispatchValue(rule *LogRule, field string) (string, bool) {
+	for i := range rule.Matchers {
+		matcher := &rule.Matchers[i]
+		if matcher.Field == field && matcher.Op == OpEqual && len(matcher.IndexKeys()) == 1 {
+			return matcher.Value, true
+		}
+	}
+	return "", false
+}
+
+// dispatchFields returns the fields the rule can be dispatched by
+func dispatchFields(rule *LogRule) []string {
+	var result []string
+	for i := range rule.Matchers {
+		field := rule.Matchers[i].Field
+		if _, ok := dispatchValue(rule, field); ok {
+			result = append(result, field)
+		}
+	}
+	slices.Sort(result)
+	return slices.Compact(result)
+}
+
+// dispatchRun returns the length of the run of rules which can be
+// dispatched by a common field, and the field
+func dispatchRun(rules []*LogRule) (int, string) {
+	fields := dispatchFields(rules[0])
+	n := 1
+	for ; n < len(rules) && len(fields) > 0; n++ {
+		common := slices.DeleteFunc(slices.Clone(fields), func(field string) bool {
+			_, ok := dispatchValue(rules[n], field)
+			return !ok
+		})
+		if len(common) == 0 {
+			break
+		}
+		fields = common
+	}
+	if len(fields) == 0 {
+		return 1, ""
+	}
+	return n, fields[0]
+}
+
+// exportBlocks splits the rules (in evaluation order) to blocks; the
+// buckets of dispatched blocks are sorted by value
+func exportBlocks(rules []*LogRule) []*exportBlock {
+	var result []*exportBlock
+	var plain *exportBlock
+	for len(rules) > 0 {
+		n, field := dispatchRun(rules)
+		if n < minDispatchRules {
+			if plain == nil {
+				plain = &exportBlock{}
+				result = append(result, plain)
+			}
+			plain.rules = append(plain.rules, rules[0])
+			rules = rules[1:]
+			continue
+		}
+		plain = nil
+		block := exportBlock{field: field}
+		for _, rule := range rules[:n] {
+			value, _ := dispatchValue(rule, field)
+			i := slices.IndexFunc(block.buckets, func(b exportBucket) bool { return b.value == value })
+			if i < 0 {
+				i = len(block.buckets)
+				block.buckets = append(block.buckets, exportBucket{value: value})
+			}
+			block.buckets[i].rules = append(block.buckets[i].rules, rule)
+		}
+		slices.SortFunc(block.buckets, func(a, b exportBucket) int { return strings.Compare(a.value, b.value) })
+		result = append(result, &block)
+		rules = rules[n:]
+	}
+	return result
+}
+
+type exportPathPart struct {
+	name  string
+	index int
+
+	// Is this an array index (instead of a name)?
+	isIndex bool
+}
+
+// exportPath splits the field name to its path components (see
+// log_field.go); numeric components are array indexes
+func exportPath(field string) []exportPathPart {
+	var result []exportPathPart
+	add := func(s string) {
+		if index, ok := parseIndex(s); ok {
+			result = append(result, exportPathPart{index: index, isIndex: true})
+		} else {
+			result = append(result, exportPathPart{name: s})
+		}
+	}
+	for _, part := range strings.Split(field, ".") {
+		name, rest, _ := strings.Cut(part, "[")
+		if name != "" {
+			add(name)
+		}
+		for rest != "" {
+			index, after, _ := strings.Cut(rest, "]")
+			add(index)
+			rest = strings.TrimPrefix(after, "[")
+		}
+	}
+	return result
+}
+
+func parseIndex(s string) (int, bool) {
+	if s == "" || strings.Trim(s, "0123456789") != "" {
+		return 0, false
+	}
+	index, err := strconv.Atoi(s)
+	return index, err == nil
+}
+
+// exportWriter writes indented code
+type exportWriter struct {
+	b      strings.Builder
+	indent int
+}
+
+func (self *exportWriter) line(format string, args ...any) {
+	self.b.WriteString(strings.Repeat("  ", self.indent))
+	fmt.Fprintf(&self.b, format, args...)
+	self.b.WriteString("\n")
+}
+
+// open writes a line which starts a block
+func (self *exportWriter) open(format string, args ...any) {
+	self.line(format, args...)
+	self.indent++
+}
+
+// next writes a line which ends the block and starts a new one
+func (self *exportWriter) next(format string, args ...any) {
+	self.indent--
+	self.open(format, args...)
+}
+
+// close writes a line which ends a block
+func (self *exportWriter) close(format string, args ...any) {
+	self.indent--
+	self.line(format, args...)
+}
+
+// parenthesized returns true if the whole expression is within a pair
+// of parentheses; quote characters in the expression start strings
+// (with backslash escapes) which are skipped
+func parenthesized(expr, quotes string) bool {
+	if !strings.HasPrefix(expr, "(") || !strings.HasSuffix(expr, ")") {
+		return false
+	}
+	depth := 0
+	var quote rune
+	escaped := false
+	for i, r := range expr {
+		switch {
+		case escaped:
+			escaped = false
+		case quote != 0 && r == '\\':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case strings.ContainsRune(quotes, r):
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+			if depth == 0 && i < len(expr)-1 {
+				return false
+			}
+		}
+	}
+	return depth == 0
+}
+
+// exportIdentifier matches expressions which need no parentheses
+var exportIdentifier = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*(\[[0-9]+\])?$`)
@@ -0,0 +1,756 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Fluent Bit (https://fluentbit.io) Lua filter generation.
+
+ The ruleset is converted to a Lua script for the lua filter, which
+sets the lixie field of the record to the verdict key of the first
+matching rule (and lixie_rule to its ID, and lixie_retention to the
+retention hint of the verdict, if any), or drops the record if the
+verdict is one of the dropped ones. See export.go for the rules which
+are exported; rate conditions are not supported.
+
+ Field names are record paths, as in vrl.go; a record key which
+literally contains the dots takes precedence, as in Lixie. Table
+values have no canonical string form, so they only match presence
+checks (and negated operations). Case-insensitive operations fold only
+ASCII letters. The record timestamp must be a number (the default, i.e.
+time_as_table is not set).
+
+ Lua has no regexps, so the (RE2 syntax) regexps are parsed here, and
+the script contains a small backtracking matcher for them. The parsed
+regexps are flat arrays of nodes (which refer to each other by index),
+as Lua limits the nesting of table constructors.
+
+ The rules are split to blocks (functions) of limited size, as Lua also
+limits the size of a function. Dispatched blocks use a table lookup.
+*/
+
+package data
+
+import (
+	"fmt"
+	"maps"
+	"regexp/syntax"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Maximum number of rules within a Lua function
+const maxLuaBlockRules = 50
+
+// Name of the global function to call within the Fluent Bit lua filter
+const LuaFilterFunction = "lixie_filter"
+
+const luaPrelude = `local function lixie_get(record, key, path)
+  local value = record[key]
+  if value ~= nil or path == nil then
+    return value
+  end
+  value = record
+  for _, part in ipairs(path) do
+    if type(value) ~= "table" then
+      return nil
+    end
+    value = value[part]
+  end
+  return value
+end
+
+-- Canonical string form of scalar values; tables have none
+local function lixie_string(value)
+  local t = type(value)
+  if t == "string" then
+    return value
+  elseif t == "boolean" then
+    return tostring(value)
+  elseif t == "number" then
+    if value == math.floor(value) and math.abs(value) < 1e15 then
+      return string.format("%d", value)
+    end
+    for precision = 1, 17 do
+      local s = string.format("%." .. precision .. "g", value)
+      if tonumber(s) == value then
+        return s
+      end
+    end
+    return tostring(value)
+  end
+  return nil
+end
+`
+
+const luaNumberPrelude = `
+local lixie_units = {ns = 1e-9, us = 1e-6, ["\194\181s"] = 1e-6, ["\206\188s"] = 1e-6, ms = 1e-3, s = 1, m = 60, h = 3600}
+
+-- Numbers, and Go durations (in seconds)
+local function lixie_number(s)
+  if s == nil then
+    return nil
+  end
+  s = s:match("^%s*(.-)%s*$")
+  local number = tonumber(s)
+  if number ~= nil then
+    return number
+  end
+  local sign, rest = s:match("^([-+]?)(.+)$")
+  if rest == nil then
+    return nil
+  end
+  local total = 0
+  while rest ~= "" do
+    local digits, unit, tail = rest:match("^([%d%.]+)([^%d%.]+)(.*)$")
+    if digits == nil or tonumber(digits) == nil or lixie_units[unit] == nil then
+      return nil
+    end
+    total = total + tonumber(digits) * lixie_units[unit]
+    rest = tail
+  end
+  if sign == "-" then
+    return -total
+  end
+  return total
+end
+`
+
+const luaRegexpPrelude = `
+-- Decodes UTF-8 rune at i; invalid encodings are U+FFFD of one byte
+local function lixie_rune(s, i)
+  local c = s:byte(i)
+  if c == nil then
+    return nil, i
+  end
+  if c < 0x80 then
+    return c, i + 1
+  end
+  local n, min
+  if c >= 0xF8 or c < 0xC0 then
+    return 0xFFFD, i + 1
+  elseif c >= 0xF0 then
+    n, c, min = 3, c - 0xF0, 0x10000
+  elseif c >= 0xE0 then
+    n, c, min = 2, c - 0xE0, 0x800
+  else
+    n, c, min = 1, c - 0xC0, 0x80
+  end
+  for j = 1, n do
+    local b = s:byte(i + j)
+    if b == nil or b < 0x80 or b >= 0xC0 then
+      return 0xFFFD, i + 1
+    end
+    c = c * 64 + (b - 0x80)
+  end
+  if c < min or c > 0x10FFFF or (c >= 0xD800 and c < 0xE000) then
+    return 0xFFFD, i + 1
+  end
+  return c, i + n + 1
+end
+
+local function lixie_word(s, i)
+  local c = s:byte(i)
+  return c ~= nil and (c == 95 or (c >= 48 and c <= 57) or (c >= 65 and c <= 90) or (c >= 97 and c <= 122))
+end
+
+local lixie_re_single = {lit = true, cls = true, any = true, anynl = true}
+
+-- Matches single character node at i; returns the next position
+local function lixie_re_step(n, s, i)
+  local op = n[1]
+  if op == "lit" then
+    local j = i + #n[2]
+    if s:sub(i, j - 1) == n[2] then
+      return j
+    end
+    return nil
+  end
+  local c, j = lixie_rune(s, i)
+  if c == nil or (op == "anynl" and c == 10) then
+    return nil
+  end
+  if op ~= "cls" then
+    return j
+  end
+  local ranges = n[2]
+  for m = 1, #ranges, 2 do
+    if c >= ranges[m] and c <= ranges[m + 1] then
+      return j
+    end
+  end
+  return nil
+end
+
+-- Matches node id of the regexp at i, and then the continuation k
+local lixie_re_match
+lixie_re_match = function(re, id, s, i, k)
+  local n = re[id]
+  local op = n[1]
+  if lixie_re_single[op] then
+    local j = lixie_re_step(n, s, i)
+    return j ~= nil and k(j)
+  elseif op == "cat" then
+    local step
+    step = function(m, j)
+      if m > #n then
+        return k(j)
+      end
+      return lixie_re_match(re, n[m], s, j, function(l) return step(m + 1, l) end)
+    end
+    return step(2, i)
+  elseif op == "alt" then
+    for m = 2, #n do
+      if lixie_re_match(re, n[m], s, i, k) then
+        return true
+      end
+    end
+    return false
+  elseif op == "quest" then
+    if n[2] then
+      return lixie_re_match(re, n[3], s, i, k) or k(i)
+    end
+    return k(i) or lixie_re_match(re, n[3], s, i, k)
+  elseif op == "star" or op == "plus" then
+    local greedy, sub = n[2], re[n[3]]
+    if lixie_re_single[sub[1]] then
+      -- Common case (e.g. .*) without recursion
+      local positions, j = {i}, i
+      while true do
+        j = lixie_re_step(sub, s, j)
+        if j == nil then
+          break
+        end
+        positions[#positions + 1] = j
+      end
+      local first, last, delta = 1, #positions, 1
+      if op == "plus" then
+        first = 2
+      end
+      if greedy then
+        first, last, delta = last, first, -1
+      end
+      for m = first, last, delta do
+        if k(positions[m]) then
+          return true
+        end
+      end
+      return false
+    end
+    local loop
+    loop = function(j)
+      local more = function(l) return l ~= j and loop(l) end
+      if greedy then
+        return lixie_re_match(re, n[3], s, j, more) or k(j)
+      end
+      return k(j) or lixie_re_match(re, n[3], s, j, more)
+    end
+    if op == "plus" then
+      return lixie_re_match(re, n[3], s, i, loop)
+    end
+    return loop(i)
+  elseif op == "bot" then
+    return i == 1 and k(i)
+  elseif op == "eot" then
+    return i == #s + 1 and k(i)
+  elseif op == "bol" then
+    return (i == 1 or s:byte(i - 1) == 10) and k(i)
+  elseif op == "eol" then
+    return (i == #s + 1 or s:byte(i) == 10) and k(i)
+  elseif op == "wb" or op == "nwb" then
+    return (lixie_word(s, i - 1) ~= lixie_word(s, i)) == (op == "wb") and k(i)
+  elseif op == "empty" then
+    return k(i)
+  end
+  return false
+end
+
+local function lixie_accept()
+  return true
+end
+
+local function lixie_re(re, s)
+  local i = 1
+  while true do
+    if lixie_re_match(re, 1, s, i, lixie_accept) then
+      return true
+    end
+    if i > #s then
+      return false
+    end
+    local _, j = lixie_rune(s, i)
+    i = j
+  end
+end
+`
+
+const luaDispatchPrelude = `
+local function lixie_dispatch(index, buckets)
+  return function(field, value, number, timestamp)
+    local bucket = buckets[value[index]]
+    if bucket ~= nil then
+      return bucket(field, value, number, timestamp)
+    end
+  end
+end
+`
+
+func luaString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := range len(s) {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, `\%03d`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func luaNumber(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// asciiLower lowercases ASCII letters only, like string.lower in Lua
+func asciiLower(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
+
+// luaRegexp converts the parsed regexp to flat Lua node array
+type luaRegexp struct {
+	nodes []string
+}
+
+func (self *luaRegexp) add(format string, args ...any) int {
+	self.nodes = append(self.nodes, fmt.Sprintf(format, args...))
+	return len(self.nodes)
+}
+
+// class adds node for the character class given as rune ranges
+func (self *luaRegexp) class(ranges []rune) int {
+	var parts []string
+	for _, r := range ranges {
+		parts = append(parts, strconv.Itoa(int(r)))
+	}
+	return self.add(`{"cls", {%s}}`, strings.Join(parts, ", "))
+}
+
+// compile adds the nodes of the regexp, and returns the index of the
+// root node
+func (self *luaRegexp) compile(re *syntax.Regexp) (int, error) {
+	// Reserve the slot first, so that the root is the first node
+	id := self.add("")
+	node, err := self.node(re)
+	if err != nil {
+		return 0, err
+	}
+	self.nodes[id-1] = node
+	return id, nil
+}
+
+func (self *luaRegexp) children(subs []*syntax.Regexp) (string, error) {
+	var ids []string
+	for _, sub := range subs {
+		id, err := self.compile(sub)
+		if err != nil {
+			return "", err
+		}
+		ids = append(ids, strconv.Itoa(id))
+	}
+	return strings.Join(ids, ", "), nil
+}
+
+func (self *luaRegexp) node(re *syntax.Regexp) (string, error) {
+	greedy := re.Flags&syntax.NonGreedy == 0
+	switch re.Op {
+	case syntax.OpNoMatch:
+		return `{"none"}`, nil
+	case syntax.OpEmptyMatch:
+		return `{"empty"}`, nil
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase == 0 {
+			return fmt.Sprintf(`{"lit", %s}`, luaString(string(re.Rune))), nil
+		}
+		var ids []string
+		for _, r := range re.Rune {
+			if unicode.SimpleFold(r) == r {
+				ids = append(ids, strconv.Itoa(self.add(`{"lit", %s}`, luaString(string(r)))))
+				continue
+			}
+			var ranges []rune
+			for f := r; ; {
+				ranges = append(ranges, f, f)
+				if f = unicode.SimpleFold(f); f == r {
+					break
+				}
+			}
+			ids = append(ids, strconv.Itoa(self.class(ranges)))
+		}
+		return fmt.Sprintf(`{"cat", %s}`, strings.Join(ids, ", ")), nil
+	case syntax.OpCharClass:
+		var parts []string
+		for _, r := range re.Rune {
+			parts = append(parts, strconv.Itoa(int(r)))
+		}
+		return fmt.Sprintf(`{"cls", {%s}}`, strings.Join(parts, ", ")), nil
+	case syntax.OpAnyCharNotNL:
+		return `{"anynl"}`, nil
+	case syntax.OpAnyChar:
+		return `{"any"}`, nil
+	case syntax.OpBeginLine:
+		return `{"bol"}`, nil
+	case syntax.OpEndLine:
+		return `{"eol"}`, nil
+	case syntax.OpBeginText:
+		return `{"bot"}`, nil
+	case syntax.OpEndText:
+		return `{"eot"}`, nil
+	case syntax.OpWordBoundary:
+		return `{"wb"}`, nil
+	case syntax.OpNoWordBoundary:
+		return `{"nwb"}`, nil
+	case syntax.OpCapture:
+		return self.node(re.Sub[0])
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest:
+		ops := map[syntax.Op]string{syntax.OpStar: "star", syntax.OpPlus: "plus", syntax.OpQuest: "quest"}
+		id, err := self.compile(re.Sub[0])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf(`{%q, %t, %d}`, ops[re.Op], greedy, id), nil
+	case syntax.OpConcat, syntax.OpAlternate:
+		children, err := self.children(re.Sub)
+		if err != nil {
+			return "", err
+		}
+		if re.Op == syntax.OpConcat {
+			return fmt.Sprintf(`{"cat", %s}`, children), nil
+		}
+		return fmt.Sprintf(`{"alt", %s}`, children), nil
+	}
+	// Repeats are expanded by Simplify
+	return "", fmt.Errorf("%w: regexp operation %v", ErrExportUnsupported, re.Op)
+}
+
+type luaSyntax struct {
+	options *ExportOptions
+
+	// Compiled regexps (Lua table constructors)
+	regexps []string
+	timed   bool
+}
+
+func luaIndex(field *exportField) int {
+	return field.index + 1
+}
+
+func (self *luaSyntax) and(exprs []string) string {
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	return "(" + strings.Join(exprs, " and ") + ")"
+}
+
+func (self *luaSyntax) or(exprs []string) string {
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	return "(" + strings.Join(exprs, " or ") + ")"
+}
+
+func (self *luaSyntax) not(expr string) string {
+	if exportIdentifier.MatchString(expr) || parenthesized(expr, `"`) {
+		return "not " + expr
+	}
+	return "not (" + expr + ")"
+}
+
+func (self *luaSyntax) constant(value bool) string {
+	return strconv.FormatBool(value)
+}
+
+func (self *luaSyntax) present(field *exportField) string {
+	return fmt.Sprintf("(field[%d] ~= nil)", luaIndex(field))
+}
+
+func (self *luaSyntax) guard(field *exportField, expr string, absent bool) string {
+	if absent {
+		return fmt.Sprintf("(value[%d] == nil or %s)", luaIndex(field), expr)
+	}
+	return fmt.Sprintf("(value[%d] ~= nil and %s)", luaIndex(field), expr)
+}
+
+func (self *luaSyntax) equal(field *exportField, value string, fold bool) string {
+	i := luaIndex(field)
+	expr := fmt.Sprintf("value[%d] == %s", i, luaString(value))
+	if fold {
+		expr = fmt.Sprintf("string.lower(value[%d]) == %s", i, luaString(asciiLower(value)))
+	}
+	keys := fieldIndexKeys(value)
+	if len(keys) == 1 {
+		return expr
+	}
+	// Non-strings compare equal also in their canonical form
+	var alternatives []string
+	for _, key := range keys[1:] {
+		alternatives = append(alternatives, fmt.Sprintf("value[%d] == %s", i, luaString(key)))
+	}
+	return fmt.Sprintf(`(%s or (type(field[%d]) ~= "string" and %s))`, expr, i, self.or(alternatives))
+}
+
+func (self *luaSyntax) regexp(expr string) (string, error) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return "", err
+	}
+	var compiled luaRegexp
+	if _, err = compiled.compile(re.Simplify()); err != nil {
+		return "", err
+	}
+	self.regexps = append(self.regexps, "{"+strings.Join(compiled.nodes, ", ")+"}")
+	return fmt.Sprintf("lixie_regexps[%d]", len(self.regexps)), nil
+}
+
+func (self *luaSyntax) match(field *exportField, matcher *LogFieldMatcher) (string, error) {
+	value := fmt.Sprintf("value[%d]", luaIndex(field))
+	lower := fmt.Sprintf("string.lower(%s)", value)
+	switch matcher.Op {
+	case OpEqual:
+		return self.equal(field, matcher.Value, false), nil
+	case OpEqualFold:
+		return self.equal(field, matcher.Value, true), nil
+	case OpRegexp:
+		re, err := self.regexp("^" + matcher.Value + "$")
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("lixie_re(%s, %s)", re, value), nil
+	case OpContains:
+		return fmt.Sprintf("string.find(%s, %s, 1, true) ~= nil", value, luaString(matcher.Value)), nil
+	case OpContainsFold:
+		return fmt.Sprintf("string.find(%s, %s, 1, true) ~= nil", lower, luaString(asciiLower(matcher.Value))), nil
+	case OpPrefix:
+		return fmt.Sprintf("string.sub(%s, 1, %d) == %s", value, len(matcher.Value), luaString(matcher.Value)), nil
+	case OpPrefixFold:
+		return fmt.Sprintf("string.sub(%s, 1, %d) == %s", lower, len(matcher.Value), luaString(asciiLower(matcher.Value))), nil
+	case OpSuffix, OpSuffixFold:
+		if matcher.Value == "" {
+			return "true", nil
+		}
+		if matcher.Op == OpSuffix {
+			return fmt.Sprintf("string.sub(%s, -%d) == %s", value, len(matcher.Value), luaString(matcher.Value)), nil
+		}
+		return fmt.Sprintf("string.sub(%s, -%d) == %s", lower, len(matcher.Value), luaString(asciiLower(matcher.Value))), nil
+	case OpLess, OpLessEqual, OpGreater, OpGreaterEqual:
+		number, _ := parseNumber(matcher.Value)
+		return fmt.Sprintf("(number[%d] ~= nil and number[%d] %s %s)", luaIndex(field), luaIndex(field), matcher.Op, luaNumber(number)), nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrExportUnsupported, matcher.Op)
+}
+
+func luaSeconds(t *time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/1e9, 'f', -1, 64)
+}
+
+func (self *luaSyntax) validity(from, until *time.Time) string {
+	self.timed = true
+	var exprs []string
+	if from != nil {
+		exprs = append(exprs, "timestamp >= "+luaSeconds(from))
+	}
+	if until != nil {
+		exprs = append(exprs, "timestamp < "+luaSeconds(until))
+	}
+	return strings.Join(exprs, " and ")
+}
+
+type luaWriter struct {
+	exportWriter
+	syntax luaSyntax
+	fields exportFields
+
+	// Rules which could not be exported
+	skipped []string
+}
+
+const luaBlockSignature = "function(field, value, number, timestamp)"
+
+// rules writes the rules as a sequence of ifs which return the
+// verdict and the rule ID of the first matching rule
+func (self *luaWriter) rules(rules []*LogRule) {
+	for _, rule := range rules {
+		exprs, err := exportRuleExprs(&self.syntax, &self.fields, rule)
+		if err != nil {
+			self.skipped = append(self.skipped, fmt.Sprintf("rule #%d: %s", rule.ID, err))
+			self.line("-- Rule #%d skipped: %s", rule.ID, err)
+			continue
+		}
+		expr := strings.Join(exprs, " and ")
+		if expr == "" {
+			expr = "true"
+		}
+		self.open("if %s then", expr)
+		self.line("return %s, %d", luaString(rule.VerdictKey()), rule.ID)
+		self.close("end")
+	}
+}
+
+func luaTable(m map[string]string) string {
+	var parts []string
+	for _, key := range slices.Sorted(maps.Keys(m)) {
+		parts = append(parts, fmt.Sprintf("[%s] = %s", luaString(key), m[key]))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// FluentBitLua returns the ruleset as a Lua script for the Fluent Bit
+// lua filter; the rules which could not be exported are also returned
+func (self *LogRules) FluentBitLua(now time.Time, options ExportOptions) (string, []string) {
+	rules := self.exportRules(now)
+	w := luaWriter{syntax: luaSyntax{options: &options}}
+	count := 0
+	dispatched := false
+	for _, block := range exportBlocks(rules) {
+		if block.field != "" {
+			dispatched = true
+			field := w.fields.field(block.field)
+			count++
+			w.open("lixie_blocks[%d] = lixie_dispatch(%d, {", count, luaIndex(field))
+			for _, bucket := range block.buckets {
+				w.open("[%s] = %s", luaString(bucket.value), luaBlockSignature)
+				w.rules(bucket.rules)
+				w.close("end,")
+			}
+			w.close("})")
+			continue
+		}
+		for chunk := range slices.Chunk(block.rules, maxLuaBlockRules) {
+			count++
+			w.open("lixie_blocks[%d] = %s", count, luaBlockSignature)
+			w.rules(chunk)
+			w.close("end")
+		}
+	}
+
+	var header exportWriter
+	header.line("-- Generated by Lixie from %d rules; do not edit", len(rules))
+	header.line("--")
+	header.line("-- [FILTER]")
+	header.line("--     Name   lua")
+	header.line("--     Match  *")
+	header.line("--     script lixie.lua")
+	header.line("--     call   %s", LuaFilterFunction)
+	header.line("")
+	header.b.WriteString(luaPrelude)
+	numeric := slices.ContainsFunc(w.fields.order, func(field *exportField) bool { return field.numeric })
+	if numeric {
+		header.b.WriteString(luaNumberPrelude)
+	}
+	if len(w.syntax.regexps) > 0 {
+		header.b.WriteString(luaRegexpPrelude)
+	}
+	if dispatched {
+		header.b.WriteString(luaDispatchPrelude)
+	}
+	header.line("")
+	retention := map[string]string{}
+	for _, verdict := range LogVerdicts() {
+		if verdict.Retention != "" {
+			retention[verdict.Key] = luaString(verdict.Retention)
+		}
+	}
+	header.line("local lixie_retention = %s", luaTable(retention))
+	drop := map[string]string{}
+	for _, key := range options.Drop {
+		drop[key] = "true"
+	}
+	header.line("local lixie_drop = %s", luaTable(drop))
+	if len(w.syntax.regexps) > 0 {
+		header.open("local lixie_regexps = {")
+		for _, re := range w.syntax.regexps {
+			header.line("%s,", re)
+		}
+		header.close("}")
+	}
+	header.line("local lixie_blocks = {}")
+	header.line("")
+
+	var footer exportWriter
+	footer.line("")
+	footer.open("function %s(tag, timestamp, record)", LuaFilterFunction)
+	footer.line("local field, value, number = {}, {}, {}")
+	for _, field := range w.fields.order {
+		i := luaIndex(field)
+		footer.line("field[%d] = %s", i, luaField(field.name, options))
+		footer.line("value[%d] = lixie_string(field[%d])", i, i)
+		if field.numeric {
+			footer.line("number[%d] = lixie_number(value[%d])", i, i)
+		}
+	}
+	footer.line("local verdict, rule")
+	footer.open("for _, block in ipairs(lixie_blocks) do")
+	footer.line("verdict, rule = block(field, value, number, timestamp)")
+	footer.open("if verdict ~= nil then")
+	footer.line("break")
+	footer.close("end")
+	footer.close("end")
+	footer.open("if verdict == nil then")
+	footer.line("verdict = %s", luaString(LogVerdictUnknownKey))
+	footer.close("end")
+	footer.open("if lixie_drop[verdict] then")
+	footer.line("return -1, timestamp, record")
+	footer.close("end")
+	footer.line(`record["lixie"] = verdict`)
+	footer.line(`record["lixie_rule"] = rule`)
+	footer.line(`record["lixie_retention"] = lixie_retention[verdict]`)
+	footer.line("return 2, timestamp, record")
+	footer.close("end")
+	return header.b.String() + w.b.String() + footer.b.String(), w.skipped
+}
+
+// luaField returns expression for the value of the field in the record
+func luaField(name string, options ExportOptions) string {
+	if target, ok := options.Fields[name]; ok {
+		name = target
+	}
+	path := exportPath(name)
+	if len(path) == 1 && !path[0].isIndex {
+		return fmt.Sprintf("record[%s]", luaString(path[0].name))
+	}
+	var parts []string
+	for _, part := range path {
+		if part.isIndex {
+			parts = append(parts, strconv.Itoa(part.index+1))
+		} else {
+			parts = append(parts, luaString(part.name))
+		}
+	}
+	return fmt.Sprintf("lixie_get(record, %s, {%s})", luaString(name), strings.Join(parts, ", "))
+}
+
+// FluentBitLua returns the current ruleset as a Fluent Bit Lua script
+func (self *Database) FluentBitLua(options ExportOptions) (string, []string) {
+	self.Lock()
+	defer self.Unlock()
+
+	return self.LogRules.FluentBitLua(time.Now(), options)
+}
@@ -0,0 +1,167 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"gotest.tools/v3/assert"
+)
+
+func luaValue(L *lua.LState, value any) lua.LValue {
+	switch value := value.(type) {
+	case string:
+		return lua.LString(value)
+	case float64:
+		return lua.LNumber(value)
+	case bool:
+		return lua.LBool(value)
+	case []any:
+		table := L.NewTable()
+		for _, v := range value {
+			table.Append(luaValue(L, v))
+		}
+		return table
+	case map[string]any:
+		table := L.NewTable()
+		for k, v := range value {
+			table.RawSetString(k, luaValue(L, v))
+		}
+		return table
+	}
+	return lua.LNil
+}
+
+// luaVerdict runs the filter on the record, and returns the verdict
+// ("" if dropped) and the rule ID
+func luaVerdict(t *testing.T, L *lua.LState, timestamp time.Time, record string) (string, int) {
+	var fields map[string]any
+	assert.Equal(t, json.Unmarshal([]byte(record), &fields), nil)
+	err := L.CallByParam(lua.P{Fn: L.GetGlobal(LuaFilterFunction), NRet: 3, Protect: true},
+		lua.LString("tag"), lua.LNumber(float64(timestamp.UnixNano())/1e9), luaValue(L, fields))
+	assert.Equal(t, err, nil)
+	defer L.Pop(3)
+	if L.Get(-3).(lua.LNumber) == -1 {
+		return "", 0
+	}
+	table := L.Get(-1).(*lua.LTable)
+	rule, _ := table.RawGetString("lixie_rule").(lua.LNumber)
+	return table.RawGetString("lixie").String(), int(rule)
+}
+
+func TestLogRulesFluentBitLua(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+	var rules []*LogRule
+	add := func(rule LogRule) {
+		rule.ID = len(rules) + 1
+		rules = append(rules, &rule)
+	}
+	add(LogRule{Verdict: "drop", ValidUntil: &past, Matchers: []LogFieldMatcher{{Field: "source", Op: OpExists}}})
+	add(LogRule{Ham: true, ValidFrom: &future, Matchers: []LogFieldMatcher{{Field: "source", Op: OpEqual, Value: "late"}}})
+	add(LogRule{Ham: true, Matchers: []LogFieldMatcher{
+		{Field: "message", Op: OpRegexp, Value: `(?i)héllo\b.*wor?ld`},
+		{Field: "http.status", Op: OpGreaterEqual, Value: "400"},
+	}})
+	add(LogRule{Matchers: []LogFieldMatcher{{Field: "latency", Op: OpGreater, Value: "1.5s"}}})
+	add(LogRule{Verdict: "drop", Matchers: []LogFieldMatcher{{Field: "ok", Op: OpNotEqual, Value: "true"}, {Field: "level", Op: OpPrefixFold, Value: "DEB"}}})
+	add(LogRule{Matchers: []LogFieldMatcher{{Field: "tags[1]", Op: OpSuffix, Value: "ex"}}})
+	add(LogRule{Groups: []LogMatcherGroup{{Op: GroupOr, Matchers: []LogFieldMatcher{
+		{Field: "message", Op: OpContainsFold, Value: "Spam"},
+		{Field: "message", Op: OpNotRegexp, Value: `[a-z ]+\d*`},
+	}}}})
+	for i := range 6 {
+		add(LogRule{Ham: i%2 == 0, Matchers: []LogFieldMatcher{{Field: "host", Op: OpEqual, Value: fmt.Sprintf("h%d", i)}}})
+	}
+	lrules := NewLogRules(rules, 1)
+	script, skipped := lrules.FluentBitLua(now, ExportOptions{Drop: []string{"drop"}})
+	assert.Equal(t, len(skipped), 0)
+	assert.Assert(t, strings.Contains(script, "lixie_dispatch("))
+
+	L := lua.NewState()
+	defer L.Close()
+	assert.Equal(t, L.DoString(script), nil, script)
+
+	for _, record := range []string{
+		`{"source": "x"}`,
+		`{"source": "late"}`,
+		`{"message": "HÉLLO world", "http": {"status": 404}}`,
+		`{"message": "héllo, wold", "http": {"status": "500"}}`,
+		`{"message": "héllox world", "http": {"status": 500}}`,
+		`{"message": "héllo world", "http": {"status": 200}}`,
+		`{"latency": "1m", "message": "a"}`,
+		`{"latency": 1.2, "message": "a"}`,
+		`{"latency": "1h30m", "message": "a"}`,
+		`{"level": "debug", "message": "a"}`,
+		`{"level": "debug", "ok": true, "message": "a"}`,
+		`{"tags": ["a", "regex"], "message": "a"}`,
+		`{"tags": ["regex", "a"], "message": "a"}`,
+		`{"message": "some SPAM here 42"}`,
+		`{"message": "fine 42"}`,
+		`{"message": "Not fine"}`,
+		`{"host": "h3", "message": "a"}`,
+		`{"host": "h4", "message": "a"}`,
+		`{"host": "h9", "message": "a"}`,
+	} {
+		log := NewLog(now.UnixNano(), nil, record)
+		rule := LogToRule(log, lrules.exportRules(now))
+		verdict, id := luaVerdict(t, L, now, record)
+		switch {
+		case rule == nil:
+			assert.Equal(t, verdict, LogVerdictUnknownKey, record)
+		case rule.VerdictKey() == "drop":
+			assert.Equal(t, verdict, "", record)
+		default:
+			assert.Equal(t, verdict, rule.VerdictKey(), record)
+			assert.Equal(t, id, rule.ID, record)
+		}
+	}
+}
+
+func TestLuaRegexp(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	for _, tc := range []struct {
+		re      string
+		matches []string
+		misses  []string
+	}{
+		{`a{2,3}b`, []string{"aab", "xaaab"}, []string{"ab", "a"}},
+		{`^(foo|ba[rz])+?$`, []string{"foobar", "baz"}, []string{"fooba", ""}},
+		{`(?m)^b$`, []string{"a\nb\nc"}, []string{"ab"}},
+		{`\Bx\b`, []string{"ax"}, []string{"x", "axa"}},
+		{`[^a-c]ä`, []string{"dä", "€ä"}, []string{"aä", "ä"}},
+		{`(a*)*c`, []string{"aaac", "c"}, []string{"aaa"}},
+		{`(?s)a.b`, []string{"a\nb"}, nil},
+		{`a.b`, []string{"a€b"}, []string{"a\nb"}},
+	} {
+		var syntax luaSyntax
+		expr, err := syntax.regexp(tc.re)
+		assert.Equal(t, err, nil)
+		script := luaPrelude + luaRegexpPrelude + "lixie_regexps = {" + strings.Join(syntax.regexps, ", ") + "}\n" +
+			"function test(s) return lixie_re(" + expr + ", s) end\n"
+		assert.Equal(t, L.DoString(script), nil, script)
+		check := func(s string, expected bool) {
+			assert.Equal(t, L.CallByParam(lua.P{Fn: L.GetGlobal("test"), NRet: 1, Protect: true}, lua.LString(s)), nil)
+			defer L.Pop(1)
+			assert.Equal(t, L.Get(-1) == lua.LTrue, expected, tc.re+" "+s)
+		}
+		for _, s := range tc.matches {
+			check(s, true)
+		}
+		for _, s := range tc.misses {
+			check(s, false)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Message generalization.
+
+ Exact message matches are too specific for most logs, as they
+contain variable tokens such as PIDs, timestamps, addresses and
+identifiers. The generalizer finds such tokens, and replaces them
+with regexps matching the whole class of tokens, while quoting the
+rest of the message as-is.
+*/
+
+package data
+
+import (
+	"regexp"
+	"strings"
+)
+
+type generalizerToken struct {
+	// Name of the capture group in generalizerRegexp
+	name string
+
+	// The regexp the token is replaced with
+	replacement string
+
+	// Should the token start at word boundary (\b does not work
+	// for tokens starting with non-word characters)
+	boundary bool
+}
+
+var generalizerTokens = []generalizerToken{
+	{
+		name:        "uuid",
+		replacement: `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`,
+	},
+	{
+		name:        "timestamp",
+		replacement: `\d{4}-\d{2}-\d{2}(?:[T ]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?(?:Z|[+-]\d{2}:?\d{2})?)?`,
+	},
+	{
+		name:        "time",
+		replacement: `\d{2}:\d{2}:\d{2}(?:[.,]\d+)?`,
+	},
+	{
+		name:        "ip",
+		replacement: `\d{1,3}(?:\.\d{1,3}){3}(?::\d+)?`,
+	},
+	{
+		name:        "ipv6",
+		replacement: `[0-9a-fA-F:]+`,
+	},
+	{
+		name:        "duration",
+		replacement: `(?:\d+(?:\.\d+)?(?:ns|us|µs|ms|s|m|h))+`,
+	},
+	{
+		name:        "hex",
+		replacement: `(?:0x)?[0-9a-fA-F]+`,
+	},
+	{
+		name:        "number",
+		replacement: `\d+(?:\.\d+)?`,
+	},
+	{
+		name:        "path",
+		replacement: `/\S*`,
+		boundary:    true,
+	},
+}
+
+var generalizerRegexp = regexp.MustCompile(strings.Join([]string{
+	`\b(?P<uuid>[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})\b`,
+	`\b(?P<timestamp>\d{4}-\d{2}-\d{2}(?:[T ]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?(?:Z|[+-]\d{2}:?\d{2})?)?)`,
+	`\b(?P<time>\d{2}:\d{2}:\d{2}(?:[.,]\d+)?)\b`,
+	`\b(?P<ip>\d{1,3}(?:\.\d{1,3}){3}(?::\d+)?)\b`,
+	`\b(?P<ipv6>[0-9a-fA-F]{1,4}(?::[0-9a-fA-F]{0,4}){2,7})\b`,
+	`\b(?P<duration>(?:\d+(?:\.\d+)?(?:ns|us|µs|ms|s|m|h))+)\b`,
+	`\b(?P<hex>0x[0-9a-fA-F]+|[0-9a-fA-F]*[0-9][0-9a-fA-F]*[a-fA-F][0-9a-fA-F]*|[0-9a-fA-F]*[a-fA-F][0-9a-fA-F]*[0-9][0-9a-fA-F]*)\b`,
+	`\b(?P<number>\d+(?:\.\d+)?)\b`,
+	`(?P<path>(?:/[\w.\-]+){2,}/?)`,
+}, "|"))
+
+// Minimum length of hex identifiers that contain also letters
+// (shorter ones are likely to be just words)
+const minGeneralizedHexLength = 8
+
+func generalizerPathBoundary(s string, start int) bool {
+	if start == 0 {
+		return true
+	}
+	return strings.ContainsRune(" \t=:\"'([<,", rune(s[start-1]))
+}
+
+// GeneralizeMessage returns regexp that matches the message with all
+// variable tokens generalized, and the number of tokens that were
+// generalized
+func GeneralizeMessage(message string) (string, int) {
+	var sb strings.Builder
+	names := generalizerRegexp.SubexpNames()
+	count := 0
+	last := 0
+	for _, match := range generalizerRegexp.FindAllStringSubmatchIndex(message, -1) {
+		for i := 2; i < len(match); i += 2 {
+			start, end := match[i], match[i+1]
+			if start < 0 {
+				continue
+			}
+			var token *generalizerToken
+			for j := range generalizerTokens {
+				if generalizerTokens[j].name == names[i/2] {
+					token = &generalizerTokens[j]
+				}
+			}
+			if token == nil {
+				break
+			}
+			if token.boundary && !generalizerPathBoundary(message, start) {
+				break
+			}
+			if token.name == "hex" && end-start < minGeneralizedHexLength && !strings.HasPrefix(message[start:end], "0x") {
+				break
+			}
+			sb.WriteString(regexp.QuoteMeta(message[last:start]))
+			sb.WriteString(token.replacement)
+			last = end
+			count++
+			break
+		}
+	}
+	sb.WriteString(regexp.QuoteMeta(message[last:]))
+	return sb.String(), count
+}
+
+// GeneralizeLogRule returns copy of the rule with the exact message
+// matchers replaced with generalized regexp matchers, or nil if there
+// was nothing to generalize
+func GeneralizeLogRule(rule *LogRule) *LogRule {
+	var matchers []LogFieldMatcher
+	changed := false
+	for _, matcher := range rule.Matchers {
+		if matcher.Field == "message" && matcher.Op == OpEqual {
+			pattern, count := GeneralizeMessage(matcher.Value)
+			if count > 0 {
+				matcher = LogFieldMatcher{Field: matcher.Field, Op: OpRegexp, Value: pattern}
+				changed = true
+			}
+		}
+		matchers = append(matchers, LogFieldMatcher{Field: matcher.Field, Op: matcher.Op, Value: matcher.Value})
+	}
+	if !changed {
+		return nil
+	}
+	result := *rule
+	result.Matchers = matchers
+	return &result
+}
@@ -0,0 +1,63 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package data
+
+import (
+	"regexp"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestGeneralizeMessage(t *testing.T) {
+	cases := []struct {
+		message string
+		pattern string
+		count   int
+		other   string
+	}{
+		{"nothing to see here", `nothing to see here`, 0, ""},
+		{"eth0 link up", `eth0 link up`, 0, ""},
+		{"pid 1234 exited", `pid \d+(?:\.\d+)? exited`, 1, "pid 42 exited"},
+		{"connection from 192.168.1.1:5353 closed", `connection from \d{1,3}(?:\.\d{1,3}){3}(?::\d+)? closed`, 1, "connection from 10.0.0.1:22 closed"},
+		{"took 12.5ms", `took (?:\d+(?:\.\d+)?(?:ns|us|µs|ms|s|m|h))+`, 1, "took 1m3s"},
+		{"session 0123abcd-0123-abcd-0123-0123456789ab done", "", 1, "session ffffffff-0000-0000-0000-000000000000 done"},
+		{"commit deadbeef01 pushed", "", 1, "commit 0123456789abcdef pushed"},
+		{"opened /var/log/messages (x)", "", 1, "opened /tmp/foo/bar (x)"},
+		{"at 2024-06-01T12:00:00Z, 12:00:01.5", "", 2, "at 2025-01-01T00:00:00+02:00, 01:02:03.456"},
+		{"dead beef", `dead beef`, 0, ""},
+	}
+	for _, c := range cases {
+		pattern, count := GeneralizeMessage(c.message)
+		assert.Equal(t, count, c.count, c.message)
+		if c.pattern != "" {
+			assert.Equal(t, pattern, c.pattern, c.message)
+		}
+		re := regexp.MustCompile("^" + pattern + "$")
+		assert.Assert(t, re.MatchString(c.message), c.message)
+		if c.other != "" {
+			assert.Assert(t, re.MatchString(c.other), c.other)
+		}
+	}
+}
+
+func TestGeneralizeLogRule(t *testing.T) {
+	rule := LogRule{ID: 1, Matchers: []LogFieldMatcher{
+		{Field: "source", Op: OpEqual, Value: "kernel"},
+		{Field: "message", Op: OpEqual, Value: "pid 1234 exited"},
+	}}
+	generalized := GeneralizeLogRule(&rule)
+	assert.Assert(t, generalized != nil)
+	assert.Equal(t, generalized.ID, 1)
+	assert.Equal(t, generalized.Matchers[0].Value, rule.Matchers[0].Value)
+	assert.Equal(t, generalized.Matchers[1].Op, OpRegexp)
+	assert.Equal(t, rule.Matchers[1].Op, OpEqual)
+	assert.Assert(t, LogMatchesRule(NewLog(1, map[string]string{"source": "kernel"}, "pid 42 exited"), generalized))
+
+	assert.Assert(t, GeneralizeLogRule(&LogRule{Matchers: rule.Matchers[:1]}) == nil)
+}
@@ -0,0 +1,104 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Required literals of matchers.
+
+ For matchers which cannot be looked up by exact value, it is often
+still possible to tell that the value must contain at least one of a
+(small) set of literals. For the substring operations this is the
+value itself, and for regexps it is derived from the parsed regexp:
+e.g. `foo.*(bar|baz)` requires either "bar" or "baz" (and "foo"; the
+longer alternative is preferred).
+
+ Case-insensitive parts of regexps are never used, as Unicode case
+folding does not reduce to lowercasing.
+*/
+
+package data
+
+import (
+	"regexp/syntax"
+	"slices"
+)
+
+// maxLiterals is the maximum number of alternative literals to track
+const maxLiterals = 16
+
+// literalsScore returns how selective the set of literals is; the
+// shortest literal determines it
+func literalsScore(literals []string) int {
+	if len(literals) == 0 {
+		return 0
+	}
+	score := len(literals[0])
+	for _, literal := range literals[1:] {
+		score = min(score, len(literal))
+	}
+	return score
+}
+
+func syntaxLiterals(re *syntax.Regexp) ([]string, bool) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return nil, false
+		}
+		return []string{string(re.Rune)}, true
+	case syntax.OpCapture, syntax.OpPlus:
+		return syntaxLiterals(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return syntaxLiterals(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		// Any one of the parts will do; pick the most selective one
+		var best []string
+		for _, sub := range re.Sub {
+			literals, ok := syntaxLiterals(sub)
+			if ok && literalsScore(literals) > literalsScore(best) {
+				best = literals
+			}
+		}
+		return best, best != nil
+	case syntax.OpAlternate:
+		var result []string
+		for _, sub := range re.Sub {
+			literals, ok := syntaxLiterals(sub)
+			if !ok {
+				return nil, false
+			}
+			result = append(result, literals...)
+		}
+		slices.Sort(result)
+		result = slices.Compact(result)
+		return result, len(result) <= maxLiterals
+	}
+	return nil, false
+}
+
+// regexpLiterals returns the literals one of which any string matching
+// the regexp must contain
+func regexpLiterals(expr string) ([]string, bool) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, false
+	}
+	return syntaxLiterals(re.Simplify())
+}
+
+// requiredLiterals returns the literals one of which the field value
+// must contain for the matcher to match
+func (self *LogFieldMatcher) requiredLiterals() ([]string, bool) {
+	switch self.Op {
+	case OpContains, OpPrefix, OpSuffix:
+		return []string{self.Value}, true
+	case OpRegexp:
+		return regexpLiterals(self.Value)
+	}
+	return nil, false
+}
@@ -32,6 +32,10 @@ type Log struct {
 	// Given ruleset version, the matching log rule (if any)
 	rulesVersion int
 	rule         *LogRule
+
+	// Given ruleset version, is the log over the rate of the rule
+	rateVersion int
+	overRate    bool
 }
 
 func (self *Log) Hash() uint64 {
@@ -0,0 +1,183 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Field access for logs.
+
+ Fields are looked up first from the stream labels, then from the
+(possibly nested) structured log fields, and finally 'message' is
+always available. Nested fields are addressed with dotted paths, and
+arrays with either [n] suffixes or numeric path components, e.g.
+'http.request.headers[0]' or 'http.request.headers.0'.
+*/
+
+package data
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+func lookupFieldIndex(value any, key string) (any, bool) {
+	switch value := value.(type) {
+	case map[string]any:
+		result, ok := value[key]
+		return result, ok
+	case []any:
+		index, err := strconv.Atoi(key)
+		if err != nil || index < 0 || index >= len(value) {
+			return nil, false
+		}
+		return value[index], true
+	}
+	return nil, false
+}
+
+func lookupFieldPath(fields map[string]any, path string) (any, bool) {
+	var current any = fields
+	for _, part := range strings.Split(path, ".") {
+		name, rest, _ := strings.Cut(part, "[")
+		if name != "" {
+			var ok bool
+			current, ok = lookupFieldIndex(current, name)
+			if !ok {
+				return nil, false
+			}
+		}
+		for rest != "" {
+			index, after, ok := strings.Cut(rest, "]")
+			if !ok {
+				return nil, false
+			}
+			current, ok = lookupFieldIndex(current, index)
+			if !ok {
+				return nil, false
+			}
+			rest, ok = strings.CutPrefix(after, "[")
+			if !ok && after != "" {
+				return nil, false
+			}
+		}
+	}
+	return current, true
+}
+
+// FieldValue returns the (typed) value of the given field of the log
+func (self *Log) FieldValue(field string) (any, bool) {
+	if value, ok := self.Stream[field]; ok {
+		return value, true
+	}
+	if self.Fields != nil {
+		// Keys which literally contain dots take precedence
+		if value, ok := self.Fields[field]; ok {
+			return value, true
+		}
+		if strings.ContainsAny(field, ".[") {
+			if value, ok := lookupFieldPath(self.Fields, field); ok {
+				return value, true
+			}
+		}
+	}
+	if field == "message" {
+		return self.Message, true
+	}
+	return nil, false
+}
+
+// FieldString returns the value of the given field of the log in its
+// canonical string form
+func (self *Log) FieldString(field string) (string, bool) {
+	value, ok := self.FieldValue(field)
+	if !ok {
+		return "", false
+	}
+	return fieldValueToString(value), true
+}
+
+// scalarFieldValueToString converts the scalar JSON value to its
+// canonical string form; non-scalars are not converted
+func scalarFieldValueToString(value any) (string, bool) {
+	switch value := value.(type) {
+	case string:
+		return value, true
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(value), true
+	case nil:
+		return "null", true
+	}
+	return "", false
+}
+
+func fieldValueToString(value any) string {
+	if s, ok := scalarFieldValueToString(value); ok {
+		return s
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// parseBoolLiteral parses the JSON boolean literals; unlike
+// strconv.ParseBool, e.g. "1" or "t" are not booleans
+func parseBoolLiteral(s string) (value, ok bool) {
+	switch strings.TrimSpace(s) {
+	case "true":
+		return true, true
+	case "false":
+		return false, true
+	}
+	return false, false
+}
+
+// fieldValueEquals compares non-string scalar to the string
+// representation in a type-aware way; ok is false if the comparison
+// is not meaningful (and string comparison should be used instead)
+func fieldValueEquals(value any, s string) (equal, ok bool) {
+	switch value := value.(type) {
+	case float64:
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err == nil {
+			return f == value, true
+		}
+	case bool:
+		if b, ok := parseBoolLiteral(s); ok {
+			return b == value, true
+		}
+	case nil:
+		return s == "" || s == "null", true
+	}
+	return false, false
+}
+
+// fieldIndexKeys returns the canonical string forms that the value
+// may compare equal to using fieldValueEquals
+func fieldIndexKeys(s string) []string {
+	keys := []string{s}
+	add := func(key string) {
+		for _, k := range keys {
+			if k == key {
+				return
+			}
+		}
+		keys = append(keys, key)
+	}
+	if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+		add(strconv.FormatFloat(f, 'f', -1, 64))
+	}
+	if b, ok := parseBoolLiteral(s); ok {
+		add(strconv.FormatBool(b))
+	}
+	if s == "" {
+		add("null")
+	}
+	return keys
+}
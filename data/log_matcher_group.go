@@ -0,0 +1,328 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Boolean matcher groups.
+
+ The matchers of a rule (and a group) are implicitly ANDed together.
+Groups allow expressing the rest: an OR group matches if any of its
+members match, and a NOT group matches if its members do not all
+match. Groups can be nested.
+
+ Empty members (matchers without field and value, and groups without
+members) are ignored, as they are artifacts of the rule editor; they
+also pass validation, so that rules can be saved with them.
+*/
+
+package data
+
+import (
+	"fmt"
+	"slices"
+)
+
+const (
+	GroupAnd = "and"
+	GroupOr  = "or"
+	GroupNot = "not"
+)
+
+var LogMatcherGroupOps = []string{GroupAnd, GroupOr, GroupNot}
+
+type LogMatcherGroup struct {
+	Op       string
+	Matchers []LogFieldMatcher `json:",omitempty"`
+	Groups   []LogMatcherGroup `json:",omitempty"`
+}
+
+func (self *LogFieldMatcher) empty() bool {
+	return self.Field == "" && self.Value == ""
+}
+
+func (self *LogFieldMatcher) matchLog(log *Log) bool {
+	value, found := log.FieldValue(self.Field)
+	return self.MatchField(value, found)
+}
+
+// Empty returns true if the group has no (non-empty) members
+func (self *LogMatcherGroup) Empty() bool {
+	for i := range self.Matchers {
+		if !self.Matchers[i].empty() {
+			return false
+		}
+	}
+	for i := range self.Groups {
+		if !self.Groups[i].Empty() {
+			return false
+		}
+	}
+	return true
+}
+
+// members calls the function for each non-empty member, until it
+// returns false
+func (self *LogMatcherGroup) members(fun func(match func(*Log) bool) bool) {
+	for i := range self.Matchers {
+		matcher := &self.Matchers[i]
+		if !matcher.empty() && !fun(matcher.matchLog) {
+			return
+		}
+	}
+	for i := range self.Groups {
+		group := &self.Groups[i]
+		if !group.Empty() && !fun(group.Match) {
+			return
+		}
+	}
+}
+
+func (self *LogMatcherGroup) matchAll(log *Log) bool {
+	result := true
+	self.members(func(match func(*Log) bool) bool {
+		result = match(log)
+		return result
+	})
+	return result
+}
+
+// Match returns true if the log matches the group; empty groups match
+// every log
+func (self *LogMatcherGroup) Match(log *Log) bool {
+	switch self.Op {
+	case GroupAnd:
+		return self.matchAll(log)
+	case GroupOr:
+		if self.Empty() {
+			return true
+		}
+		result := false
+		self.members(func(match func(*Log) bool) bool {
+			result = match(log)
+			return !result
+		})
+		return result
+	case GroupNot:
+		return self.Empty() || !self.matchAll(log)
+	}
+	return false
+}
+
+// clone returns a copy of the group which shares no matchers with it
+func (self *LogMatcherGroup) clone() LogMatcherGroup {
+	result := LogMatcherGroup{Op: self.Op, Matchers: slices.Clone(self.Matchers)}
+	if self.Groups != nil {
+		result.Groups = make([]LogMatcherGroup, len(self.Groups))
+		for i := range self.Groups {
+			result.Groups[i] = self.Groups[i].clone()
+		}
+	}
+	return result
+}
+
+func (self *LogMatcherGroup) compile() {
+	for i := range self.Matchers {
+		matcher := &self.Matchers[i]
+		if matcher.match == nil {
+			_ = matcher.compile()
+		}
+	}
+	for i := range self.Groups {
+		self.Groups[i].compile()
+	}
+}
+
+// indexKeys returns the values the field must have for the group to
+// match, if the group restricts the field to (a set of) exact values
+func (self *LogMatcherGroup) indexKeys(field string) ([]string, bool) {
+	switch self.Op {
+	case GroupAnd:
+		for i := range self.Matchers {
+			matcher := &self.Matchers[i]
+			if matcher.Indexable() && matcher.Field == field {
+				return matcher.IndexKeys(), true
+			}
+		}
+		for i := range self.Groups {
+			if keys, ok := self.Groups[i].indexKeys(field); ok {
+				return keys, true
+			}
+		}
+	case GroupOr:
+		// Every member must be restricted to exact values
+		if self.Empty() {
+			return nil, false
+		}
+		var result []string
+		for i := range self.Matchers {
+			matcher := &self.Matchers[i]
+			if matcher.empty() {
+				continue
+			}
+			if !matcher.Indexable() || matcher.Field != field {
+				return nil, false
+			}
+			result = append(result, matcher.IndexKeys()...)
+		}
+		for i := range self.Groups {
+			group := &self.Groups[i]
+			if group.Empty() {
+				continue
+			}
+			keys, ok := group.indexKeys(field)
+			if !ok {
+				return nil, false
+			}
+			result = append(result, keys...)
+		}
+		slices.Sort(result)
+		return slices.Compact(result), true
+	}
+	// NOT groups cannot be indexed
+	return nil, false
+}
+
+// indexableFields calls the function for every field with an exact
+// match which may be used for indexing
+func (self *LogMatcherGroup) indexableFields(fun func(field string)) {
+	switch self.Op {
+	case GroupAnd, GroupOr:
+		for i := range self.Matchers {
+			if self.Matchers[i].Indexable() {
+				fun(self.Matchers[i].Field)
+			}
+		}
+		for i := range self.Groups {
+			self.Groups[i].indexableFields(fun)
+		}
+	}
+}
+
+// requiredLiterals returns the literals one of which the field must
+// contain for the group to match (see LogFieldMatcher.requiredLiterals)
+func (self *LogMatcherGroup) requiredLiterals(field string) ([]string, bool) {
+	switch self.Op {
+	case GroupAnd:
+		// Any member will do; pick the most selective one
+		var best []string
+		consider := func(literals []string, ok bool) {
+			if ok && literalsScore(literals) > literalsScore(best) {
+				best = literals
+			}
+		}
+		for i := range self.Matchers {
+			matcher := &self.Matchers[i]
+			if matcher.Field == field {
+				consider(matcher.requiredLiterals())
+			}
+		}
+		for i := range self.Groups {
+			consider(self.Groups[i].requiredLiterals(field))
+		}
+		return best, best != nil
+	case GroupOr:
+		// Every member must require literals of the field
+		if self.Empty() {
+			return nil, false
+		}
+		var result []string
+		for i := range self.Matchers {
+			matcher := &self.Matchers[i]
+			if matcher.empty() {
+				continue
+			}
+			if matcher.Field != field {
+				return nil, false
+			}
+			literals, ok := matcher.requiredLiterals()
+			if !ok {
+				return nil, false
+			}
+			result = append(result, literals...)
+		}
+		for i := range self.Groups {
+			group := &self.Groups[i]
+			if group.Empty() {
+				continue
+			}
+			literals, ok := group.requiredLiterals(field)
+			if !ok {
+				return nil, false
+			}
+			result = append(result, literals...)
+		}
+		slices.Sort(result)
+		result = slices.Compact(result)
+		return result, len(result) <= maxLiterals
+	}
+	// NOT groups do not require anything
+	return nil, false
+}
+
+// literalFields calls the function for every field which may have
+// required literals
+func (self *LogMatcherGroup) literalFields(fun func(field string)) {
+	switch self.Op {
+	case GroupAnd, GroupOr:
+		for i := range self.Matchers {
+			if _, ok := self.Matchers[i].requiredLiterals(); ok {
+				fun(self.Matchers[i].Field)
+			}
+		}
+		for i := range self.Groups {
+			self.Groups[i].literalFields(fun)
+		}
+	}
+}
+
+func (self *LogMatcherGroup) matchesFTS(search string) bool {
+	for _, m := range self.Matchers {
+		if m.MatchesFTS(search) {
+			return true
+		}
+	}
+	for i := range self.Groups {
+		if self.Groups[i].matchesFTS(search) {
+			return true
+		}
+	}
+	return false
+}
+
+// validationErrors returns the problems within the group; path
+// identifies the group in the error messages
+func (self *LogMatcherGroup) validationErrors(path string, depth int) []error {
+	var result []error
+	if !slices.Contains(LogMatcherGroupOps, self.Op) {
+		result = append(result, fmt.Errorf("group %s: %w: %q", path, ErrUnknownGroupOp, self.Op))
+	}
+	if depth > maxGroupDepth {
+		return append(result, fmt.Errorf("group %s: %w", path, ErrGroupTooDeep))
+	}
+	for i := range self.Matchers {
+		if err := self.Matchers[i].Validate(); err != nil {
+			result = append(result, fmt.Errorf("group %s matcher #%d: %w", path, i+1, err))
+		}
+	}
+	for i := range self.Groups {
+		result = append(result, self.Groups[i].validationErrors(fmt.Sprintf("%s.%d", path, i+1), depth+1)...)
+	}
+	return result
+}
+
+// matcherCount returns the total number of matchers in the group
+func (self *LogMatcherGroup) matcherCount() int {
+	count := len(self.Matchers)
+	for i := range self.Groups {
+		count += self.Groups[i].matcherCount()
+	}
+	return count
+}
+
+// group returns the rule as an AND group
+func (self *LogRule) group() LogMatcherGroup {
+	return LogMatcherGroup{Op: GroupAnd, Matchers: self.Matchers, Groups: self.Groups}
+}
@@ -0,0 +1,82 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package data
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestLogMatcherGroup(t *testing.T) {
+	// source is a or b, and the message is not x
+	rule := LogRule{ID: 1, Priority: 1, Groups: []LogMatcherGroup{
+		{Op: GroupOr, Matchers: []LogFieldMatcher{
+			{Field: "source", Op: OpEqual, Value: "a"},
+			{Field: "source", Op: OpEqual, Value: "b"},
+		}},
+		{Op: GroupNot, Matchers: []LogFieldMatcher{
+			{Field: "message", Op: OpEqual, Value: "x"},
+		}},
+		// Empty groups are ignored
+		{Op: GroupOr},
+	}}
+	assert.NilError(t, rule.Validate())
+
+	// Rule which cannot be indexed by source (only NOT group)
+	other := LogRule{ID: 2, Groups: []LogMatcherGroup{
+		{Op: GroupNot, Matchers: []LogFieldMatcher{
+			{Field: "source", Op: OpEqual, Value: "c"},
+		}},
+	}}
+	rules := NewLogRules([]*LogRule{&rule, &other}, 1)
+	segment := rules.brm.segments[0]
+	assert.Equal(t, len(segment.exact), 1)
+	assert.Equal(t, segment.exact[0].field, "source")
+	assert.DeepEqual(t, segment.fallback, []int32{1})
+
+	cases := []struct {
+		source, message string
+		rid             int
+	}{
+		{"a", "y", 1},
+		{"b", "y", 1},
+		{"a", "x", 2},
+		{"d", "y", 2},
+		{"c", "y", 0},
+	}
+	for _, c := range cases {
+		log := NewLog(1, map[string]string{"source": c.source}, c.message)
+		got := 0
+		if r := LogToRule(log, rules.Ordered); r != nil {
+			got = r.ID
+		}
+		assert.Equal(t, got, c.rid, "%s/%s", c.source, c.message)
+		got = 0
+		if r := rules.brm.ToRule(log); r != nil {
+			got = r.ID
+		}
+		assert.Equal(t, got, c.rid, "bulk %s/%s", c.source, c.message)
+	}
+
+	// OR group of exact matches is indexed with all of its values
+	group := rule.group()
+	keys, ok := group.indexKeys("source")
+	assert.Assert(t, ok)
+	assert.DeepEqual(t, keys, []string{"a", "b"})
+	group = other.group()
+	_, ok = group.indexKeys("source")
+	assert.Assert(t, !ok)
+
+	bad := LogRule{Groups: []LogMatcherGroup{{Op: "xor"}}}
+	assert.ErrorIs(t, bad.Validate(), ErrUnknownGroupOp)
+
+	// Empty members are ignored by validation too
+	blank := LogRule{Groups: []LogMatcherGroup{{Op: GroupOr, Matchers: []LogFieldMatcher{{Op: OpEqual}}}}}
+	assert.NilError(t, blank.Validate())
+}
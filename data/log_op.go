@@ -0,0 +1,225 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Operations supported by LogFieldMatcher.
+
+ Every operation compiles its value into a string predicate. The
+operation also specifies what happens if the field is not present in
+the log at all; by default absent fields never match, but the negated
+operations (!=, !~, !exists) do.
+*/
+
+package data
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	OpEqual        = "="
+	OpNotEqual     = "!="
+	OpRegexp       = "=~"
+	OpNotRegexp    = "!~"
+	OpContains     = "contains"
+	OpPrefix       = "prefix"
+	OpSuffix       = "suffix"
+	OpEqualFold    = "i="
+	OpContainsFold = "icontains"
+	OpPrefixFold   = "iprefix"
+	OpSuffixFold   = "isuffix"
+	OpExists       = "exists"
+	OpNotExists    = "!exists"
+	OpLess         = "<"
+	OpLessEqual    = "<="
+	OpGreater      = ">"
+	OpGreaterEqual = ">="
+)
+
+type logFieldOp struct {
+	// Human readable description of the operation
+	title string
+
+	// Does the operation match if the field is not present?
+	absent bool
+
+	// Is the value ignored altogether?
+	noValue bool
+
+	compile func(value string) (func(string) bool, error)
+}
+
+func stringOp(f func(s, value string) bool) func(string) (func(string) bool, error) {
+	return func(value string) (func(string) bool, error) {
+		return func(s string) bool {
+			return f(s, value)
+		}, nil
+	}
+}
+
+func foldOp(f func(s, value string) bool) func(string) (func(string) bool, error) {
+	return func(value string) (func(string) bool, error) {
+		value = strings.ToLower(value)
+		return func(s string) bool {
+			return f(strings.ToLower(s), value)
+		}, nil
+	}
+}
+
+func regexpOp(negate bool) func(string) (func(string) bool, error) {
+	return func(value string) (func(string) bool, error) {
+		re, err := regexp.Compile("^" + value + "$")
+		if err != nil {
+			return nil, err
+		}
+		return func(s string) bool {
+			return re.MatchString(s) != negate
+		}, nil
+	}
+}
+
+func constantOp(result bool) func(string) (func(string) bool, error) {
+	return func(_ string) (func(string) bool, error) {
+		return func(_ string) bool {
+			return result
+		}, nil
+	}
+}
+
+// parseNumber parses the string either as a float, or as a Go
+// duration (in which case the result is in seconds)
+func parseNumber(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	f, err := strconv.ParseFloat(s, 64)
+	if err == nil {
+		return f, true
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil {
+		return d.Seconds(), true
+	}
+	return 0, false
+}
+
+func numberOp(f func(a, b float64) bool) func(string) (func(string) bool, error) {
+	return func(value string) (func(string) bool, error) {
+		b, ok := parseNumber(value)
+		if !ok {
+			return nil, fmt.Errorf("%q is not a number or a duration", value)
+		}
+		return func(s string) bool {
+			a, ok := parseNumber(s)
+			return ok && f(a, b)
+		}, nil
+	}
+}
+
+var logFieldOps = map[string]*logFieldOp{
+	OpEqual: {
+		title:   "equals",
+		compile: stringOp(func(s, value string) bool { return s == value }),
+	},
+	OpNotEqual: {
+		title:   "does not equal",
+		absent:  true,
+		compile: stringOp(func(s, value string) bool { return s != value }),
+	},
+	OpRegexp: {
+		title:   "matches regexp",
+		compile: regexpOp(false),
+	},
+	OpNotRegexp: {
+		title:   "does not match regexp",
+		absent:  true,
+		compile: regexpOp(true),
+	},
+	OpContains: {
+		title:   "contains",
+		compile: stringOp(strings.Contains),
+	},
+	OpPrefix: {
+		title:   "starts with",
+		compile: stringOp(strings.HasPrefix),
+	},
+	OpSuffix: {
+		title:   "ends with",
+		compile: stringOp(strings.HasSuffix),
+	},
+	OpEqualFold: {
+		title:   "equals (case-insensitive)",
+		compile: foldOp(func(s, value string) bool { return s == value }),
+	},
+	OpContainsFold: {
+		title:   "contains (case-insensitive)",
+		compile: foldOp(strings.Contains),
+	},
+	OpPrefixFold: {
+		title:   "starts with (case-insensitive)",
+		compile: foldOp(strings.HasPrefix),
+	},
+	OpSuffixFold: {
+		title:   "ends with (case-insensitive)",
+		compile: foldOp(strings.HasSuffix),
+	},
+	OpExists: {
+		title:   "is present",
+		noValue: true,
+		compile: constantOp(true),
+	},
+	OpNotExists: {
+		title:   "is absent",
+		absent:  true,
+		noValue: true,
+		compile: constantOp(false),
+	},
+	OpLess: {
+		title:   "is less than",
+		compile: numberOp(func(a, b float64) bool { return a < b }),
+	},
+	OpLessEqual: {
+		title:   "is at most",
+		compile: numberOp(func(a, b float64) bool { return a <= b }),
+	},
+	OpGreater: {
+		title:   "is greater than",
+		compile: numberOp(func(a, b float64) bool { return a > b }),
+	},
+	OpGreaterEqual: {
+		title:   "is at least",
+		compile: numberOp(func(a, b float64) bool { return a >= b }),
+	},
+}
+
+// LogFieldMatcherOps is the list of supported operations, in the
+// order they should be presented to the user
+var LogFieldMatcherOps = []string{
+	OpEqual, OpNotEqual, OpRegexp, OpNotRegexp,
+	OpContains, OpPrefix, OpSuffix,
+	OpEqualFold, OpContainsFold, OpPrefixFold, OpSuffixFold,
+	OpExists, OpNotExists,
+	OpLess, OpLessEqual, OpGreater, OpGreaterEqual,
+}
+
+func LogFieldMatcherOpTitle(op string) string {
+	if o, ok := logFieldOps[op]; ok {
+		return o.title
+	}
+	return "unknown"
+}
+
+// LogFieldMatcherOpHasValue returns false for operations which do
+// not care about the value at all (presence checks)
+func LogFieldMatcherOpHasValue(op string) bool {
+	if o, ok := logFieldOps[op]; ok {
+		return !o.noValue
+	}
+	return true
+}
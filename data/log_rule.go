@@ -8,9 +8,11 @@
 package data
 
 import (
+	"cmp"
 	"fmt"
-	"regexp"
+	"slices"
 	"strings"
+	"time"
 )
 
 type LogFieldMatcher struct {
@@ -21,32 +23,78 @@ type LogFieldMatcher struct {
 	match func(string) bool
 }
 
-func (self *LogFieldMatcher) Match(s string) bool {
-	if self.match != nil {
-		return self.match(s)
+func neverMatch(_ string) bool {
+	return false
+}
+
+func (self *LogFieldMatcher) compileMatch() (func(string) bool, error) {
+	op, ok := logFieldOps[self.Op]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownOp, self.Op)
 	}
-	switch self.Op {
-	case "=":
-		self.match = func(s string) bool {
-			return s == self.Value
-		}
-	case "=~":
-		re, err := regexp.Compile(fmt.Sprintf("^%s$", self.Value))
-		if err == nil {
-			self.match = func(s string) bool {
-				return re.Match([]byte(s))
-			}
-		}
+	return op.compile(self.Value)
+}
+
+// compile prepares the matcher for use. Unknown operations or broken
+// values (e.g. regexps) result in an error, and a matcher that never
+// matches.
+func (self *LogFieldMatcher) compile() error {
+	match, err := self.compileMatch()
+	if err != nil {
+		self.match = neverMatch
+		return err
 	}
-	// unknown operations or broken regexps never match
+	self.match = match
+	return nil
+}
+
+func (self *LogFieldMatcher) Match(s string) bool {
 	if self.match == nil {
-		self.match = func(_ string) bool {
-			return false
-		}
+		_ = self.compile()
 	}
 	return self.match(s)
 }
 
+// MatchValue matches the value of the field; found indicates if the
+// field was present in the log in the first place
+func (self *LogFieldMatcher) MatchValue(s string, found bool) bool {
+	if !found {
+		op, ok := logFieldOps[self.Op]
+		return ok && op.absent
+	}
+	return self.Match(s)
+}
+
+// MatchField matches the typed field value; non-string scalars are
+// compared in a type-aware way for equality, and using their
+// canonical string form otherwise
+func (self *LogFieldMatcher) MatchField(value any, found bool) bool {
+	if !found {
+		return self.MatchValue("", false)
+	}
+	if s, ok := value.(string); ok {
+		return self.Match(s)
+	}
+	switch self.Op {
+	case OpEqual, OpEqualFold, OpNotEqual:
+		if equal, ok := fieldValueEquals(value, self.Value); ok {
+			return equal != (self.Op == OpNotEqual)
+		}
+	}
+	return self.Match(fieldValueToString(value))
+}
+
+// IndexKeys returns the canonical field values the matcher may match
+// if it is Indexable
+func (self *LogFieldMatcher) IndexKeys() []string {
+	return fieldIndexKeys(self.Value)
+}
+
+// Indexable matchers can be looked up by their exact value
+func (self *LogFieldMatcher) Indexable() bool {
+	return self.Op == OpEqual && !self.empty()
+}
+
 func (self *LogFieldMatcher) MatchesFTS(s string) bool {
 	// TODO: Is field actually meaningful to match with?
 	return strings.Contains(self.Value, s)
@@ -59,30 +107,114 @@ type LogRule struct {
 	// Rule may or may not be disabled
 	Disabled bool
 
-	// Is the result interesting, or not?
+	// Is the result interesting, or not? (Superseded by Verdict;
+	// kept in sync with it for older consumers of the database)
 	Ham bool
 
+	// Key of the verdict of the rule (see LogVerdictInfo)
+	Verdict string
+
 	// List of matchers the rule matches against
 	Matchers []LogFieldMatcher
 
+	// Nested matcher groups; the rule matches only if all of them
+	// (and all of the matchers) match
+	Groups []LogMatcherGroup `json:",omitempty"`
+
+	// Rules with higher priority are evaluated first; among rules
+	// with equal priority, the most recently added (higher ID) wins
+	Priority int
+
 	// Comment (if any)
 	Comment string
 
+	// Optional rate condition; logs over it get different verdict
+	Rate *LogRuleRate `json:",omitempty"`
+
+	// Optional validity period of the rule; the rule matches only logs
+	// with timestamp within it. Rules which have been expired for
+	// long enough are removed automatically.
+	ValidFrom  *time.Time `json:",omitempty"`
+	ValidUntil *time.Time `json:",omitempty"`
+
+	// Example logs the rule must (and must not) match; see
+	// LogRuleFixture
+	MustMatch    []LogRuleFixture `json:",omitempty"`
+	MustNotMatch []LogRuleFixture `json:",omitempty"`
+
 	// Version of the rule; any time the rule is changed, the
 	// version is incremented
 	Version int
 }
 
+// ValidAt returns true if the rule applies to logs at the given time
+func (self *LogRule) ValidAt(t time.Time) bool {
+	if self.ValidFrom != nil && t.Before(*self.ValidFrom) {
+		return false
+	}
+	if self.ValidUntil != nil && !t.Before(*self.ValidUntil) {
+		return false
+	}
+	return true
+}
+
+// Temporary returns true if the rule stops matching at some point
+func (self *LogRule) Temporary() bool {
+	return self.ValidUntil != nil
+}
+
+// Expired returns true if the rule does not match logs at or after the given time
+func (self *LogRule) Expired(now time.Time) bool {
+	return self.ValidUntil != nil && !now.Before(*self.ValidUntil)
+}
+
+// VerdictKey returns the key of the verdict of the rule; rules without
+// explicit verdict are either ham or spam
+func (self *LogRule) VerdictKey() string {
+	if self.Verdict != "" {
+		return self.Verdict
+	}
+	if self.Ham {
+		return LogVerdictHamKey
+	}
+	return LogVerdictSpamKey
+}
+
+// normalizeVerdict ensures both Verdict and Ham are set consistently
+func (self *LogRule) normalizeVerdict() {
+	self.Verdict = self.VerdictKey()
+	self.Ham = self.Verdict == LogVerdictHamKey
+}
+
+// clone returns a copy of the rule which can be normalized and
+// compiled without changing the rule itself
+func (self *LogRule) clone() *LogRule {
+	result := *self
+	group := self.group()
+	group = group.clone()
+	result.Matchers, result.Groups = group.Matchers, group.Groups
+	if self.Rate != nil {
+		rate := *self.Rate
+		result.Rate = &rate
+	}
+	return &result
+}
+
+// compile prepares all matchers of the rule for use
+func (self *LogRule) compile() {
+	group := self.group()
+	group.compile()
+	if self.Rate != nil {
+		self.Rate.compile()
+	}
+}
+
 func (self *LogRule) MatchesFTS(search string) bool {
 	if strings.Contains(self.Comment, search) {
 		return true
 	}
-	for _, m := range self.Matchers {
-		if m.MatchesFTS(search) {
-			return true
-		}
-	}
-	return false
+	group := self.group()
+	return group.matchesFTS(search)
 }
 
 func (self *LogRule) SourceString() string {
@@ -93,3 +225,19 @@ func (self *LogRule) SourceString() string {
 	}
 	return ""
 }
+
+// CompareLogRulePriority orders the rules in the order they are
+// evaluated: by descending priority, and then by descending ID
+func CompareLogRulePriority(a, b *LogRule) int {
+	if c := cmp.Compare(b.Priority, a.Priority); c != 0 {
+		return c
+	}
+	return cmp.Compare(b.ID, a.ID)
+}
+
+// SortLogRules returns copy of the rules in the evaluation order
+func SortLogRules(rules []*LogRule) []*LogRule {
+	ordered := slices.Clone(rules)
+	slices.SortStableFunc(ordered, CompareLogRulePriority)
+	return ordered
+}
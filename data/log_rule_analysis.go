@@ -0,0 +1,333 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Static analysis of the ruleset.
+
+ Rule B (lower priority) is shadowed by rule A (higher priority), if
+every log that matches B is guaranteed to match A, i.e. every matcher
+of A is implied by some matcher of B. As B can never be the first
+matching rule, it is dead weight.
+
+ Rules with different verdicts conflict, if they overlap (i.e. we
+cannot prove that no log matches both), as then the verdict depends
+on the priority order of the rules.
+
+ Both checks are conservative approximations; regexps in particular
+are only understood if they are literals, or have different literal
+prefixes.
+*/
+
+package data
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"time"
+)
+
+const (
+	LogRuleIssueShadowed int = iota
+	LogRuleIssueConflict
+)
+
+type LogRuleIssue struct {
+	Kind int
+
+	// The rule with the issue
+	Rule *LogRule
+
+	// The higher priority rule that causes the issue
+	By *LogRule
+
+	Reason string
+}
+
+// literalValue returns the only value the matcher can match, if any
+func (self *LogFieldMatcher) literalValue() (string, bool) {
+	var value string
+	switch self.Op {
+	case OpEqual:
+		value = self.Value
+	case OpRegexp:
+		re, err := syntax.Parse(self.Value, syntax.Perl)
+		if err != nil {
+			return "", false
+		}
+		re = re.Simplify()
+		switch {
+		case re.Op == syntax.OpLiteral && re.Flags&syntax.FoldCase == 0:
+			value = string(re.Rune)
+		case re.Op == syntax.OpEmptyMatch:
+			value = ""
+		default:
+			return "", false
+		}
+	default:
+		return "", false
+	}
+	// Typed values may be equal to more than one string
+	// representation; we do not reason about those
+	if len(fieldIndexKeys(value)) > 1 {
+		return "", false
+	}
+	return value, true
+}
+
+// literalPrefix returns the prefix all matching values have
+func (self *LogFieldMatcher) literalPrefix() string {
+	switch self.Op {
+	case OpEqual, OpPrefix:
+		return self.Value
+	case OpRegexp:
+		re, err := regexp.Compile(self.Value)
+		if err != nil {
+			return ""
+		}
+		prefix, _ := re.LiteralPrefix()
+		return prefix
+	}
+	return ""
+}
+
+// typedEquality returns true if the matcher compares non-string
+// values in a type-aware way (and so plain string matching of
+// literals is not accurate)
+func (self *LogFieldMatcher) typedEquality() bool {
+	switch self.Op {
+	case OpEqual, OpNotEqual, OpEqualFold:
+		return len(fieldIndexKeys(self.Value)) > 1
+	}
+	return false
+}
+
+func (self *LogFieldMatcher) matchesAbsent() bool {
+	op, ok := logFieldOps[self.Op]
+	return ok && op.absent
+}
+
+// implies returns true if every value matched by this matcher is also
+// matched by the other matcher
+func (self *LogFieldMatcher) implies(other *LogFieldMatcher) bool {
+	if self.Field != other.Field {
+		return false
+	}
+	if self.Op == other.Op && self.Value == other.Value {
+		return true
+	}
+	if value, ok := self.literalValue(); ok {
+		return !other.typedEquality() && other.Match(value)
+	}
+	if self.matchesAbsent() {
+		return false
+	}
+	switch other.Op {
+	case OpExists:
+		return true
+	case OpPrefix:
+		return self.Op == OpPrefix && strings.HasPrefix(self.Value, other.Value)
+	case OpSuffix:
+		return self.Op == OpSuffix && strings.HasSuffix(self.Value, other.Value)
+	case OpContains:
+		switch self.Op {
+		case OpPrefix, OpSuffix, OpContains:
+			return strings.Contains(self.Value, other.Value)
+		}
+	}
+	return false
+}
+
+// disjoint returns true if no value can match both matchers
+func (self *LogFieldMatcher) disjoint(other *LogFieldMatcher) bool {
+	if self.Field != other.Field {
+		return false
+	}
+	if (self.Op == OpExists && other.Op == OpNotExists) || (self.Op == OpNotExists && other.Op == OpExists) {
+		return true
+	}
+	if value, ok := self.literalValue(); ok && !other.typedEquality() {
+		return !other.Match(value)
+	}
+	if value, ok := other.literalValue(); ok && !self.typedEquality() {
+		return !self.Match(value)
+	}
+	p1 := self.literalPrefix()
+	p2 := other.literalPrefix()
+	return !strings.HasPrefix(p1, p2) && !strings.HasPrefix(p2, p1)
+}
+
+func (self *LogRule) enabledMatchers() []*LogFieldMatcher {
+	result := make([]*LogFieldMatcher, 0, len(self.Matchers))
+	for i := range self.Matchers {
+		matcher := &self.Matchers[i]
+		if matcher.Field == "" && matcher.Value == "" {
+			continue
+		}
+		result = append(result, matcher)
+	}
+	return result
+}
+
+// shadowedBy returns true if every log matched by this rule is also
+// matched by the other rule
+func (self *LogRule) shadowedBy(other *LogRule) bool {
+	// Groups are not analyzed, so we cannot prove anything about
+	// rules which have them
+	for i := range other.Groups {
+		if !other.Groups[i].Empty() {
+			return false
+		}
+	}
+	matchers := self.enabledMatchers()
+	for _, om := range other.enabledMatchers() {
+		implied := false
+		for _, m := range matchers {
+			if m.implies(om) {
+				implied = true
+				break
+			}
+		}
+		if !implied {
+			return false
+		}
+	}
+	return true
+}
+
+// disjoint returns true if no log can match both rules
+func (self *LogRule) disjoint(other *LogRule) bool {
+	matchers := self.enabledMatchers()
+	for _, om := range other.enabledMatchers() {
+		for _, m := range matchers {
+			if m.disjoint(om) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Bucket key for rules that do not have the bucketing field (it cannot
+// occur in real values)
+const wildcardBucket = "\x00*"
+
+// analysisBuckets splits the rules into buckets by the value of the
+// most commonly used exact-match field; rules in different buckets
+// cannot overlap, except for the wildcard bucket (rules without the
+// field) which may overlap with everything
+func analysisBuckets(ordered []*LogRule) (keys []string, buckets map[string][]int) {
+	counts := map[string]int{}
+	for _, rule := range ordered {
+		for _, m := range rule.enabledMatchers() {
+			if m.Indexable() {
+				counts[m.Field]++
+			}
+		}
+	}
+	field := ""
+	best := 0
+	for f, count := range counts {
+		if count > best || (count == best && f < field) {
+			field = f
+			best = count
+		}
+	}
+	keys = make([]string, len(ordered))
+	buckets = map[string][]int{}
+	for i, rule := range ordered {
+		key := ""
+		wildcard := true
+		for _, m := range rule.enabledMatchers() {
+			if m.Field == field {
+				if value, ok := m.literalValue(); ok {
+					key = value
+					wildcard = false
+					break
+				}
+			}
+		}
+		if wildcard {
+			key = wildcardBucket
+		}
+		keys[i] = key
+		buckets[key] = append(buckets[key], i)
+	}
+	return
+}
+
+// AnalyzeLogRules produces list of issues in the ruleset, given the
+// rules in evaluation order
+func AnalyzeLogRules(ordered []*LogRule) []*LogRuleIssue {
+	now := time.Now()
+	enabled := make([]*LogRule, 0, len(ordered))
+	for _, rule := range ordered {
+		if !rule.Disabled && !rule.Expired(now) {
+			enabled = append(enabled, rule)
+		}
+	}
+	keys, buckets := analysisBuckets(enabled)
+	wildcard := buckets[wildcardBucket]
+
+	var issues []*LogRuleIssue
+	for i, rule := range enabled {
+		key := keys[i]
+		candidates := buckets[key]
+		if key != wildcardBucket {
+			candidates = mergeSortedInts(candidates, wildcard)
+		} else {
+			// Wildcard rules may overlap with anything
+			candidates = nil
+			for j := range i {
+				candidates = append(candidates, j)
+			}
+		}
+		verdict := LogRuleToVerdict(rule)
+		for _, j := range candidates {
+			if j >= i {
+				break
+			}
+			other := enabled[j]
+			otherVerdict := LogRuleToVerdict(other)
+			// Temporary rules shadow other rules only for a while
+			if !other.Temporary() && rule.shadowedBy(other) {
+				reason := "matches everything this rule matches"
+				if otherVerdict != verdict {
+					reason = fmt.Sprintf("matches everything this rule matches, with verdict %s instead of %s",
+						LogVerdictToString(otherVerdict), LogVerdictToString(verdict))
+				}
+				issues = append(issues, &LogRuleIssue{Kind: LogRuleIssueShadowed, Rule: rule, By: other, Reason: reason})
+				// Other issues do not really matter if the rule never matches
+				break
+			}
+			if otherVerdict != verdict && !rule.disjoint(other) {
+				issues = append(issues, &LogRuleIssue{
+					Kind: LogRuleIssueConflict, Rule: rule, By: other,
+					Reason: fmt.Sprintf("may overlap, with verdict %s instead of %s",
+						LogVerdictToString(otherVerdict), LogVerdictToString(verdict)),
+				})
+			}
+		}
+	}
+	return issues
+}
+
+func mergeSortedInts(a, b []int) []int {
+	result := make([]int, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if a[0] < b[0] {
+			result = append(result, a[0])
+			a = a[1:]
+		} else {
+			result = append(result, b[0])
+			b = b[1:]
+		}
+	}
+	result = append(result, a...)
+	return append(result, b...)
+}
@@ -0,0 +1,55 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package data
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestAnalyzeLogRules(t *testing.T) {
+	rule := func(id int, ham bool, matchers ...LogFieldMatcher) *LogRule {
+		return &LogRule{ID: id, Ham: ham, Matchers: matchers}
+	}
+	m := func(field, op, value string) LogFieldMatcher {
+		return LogFieldMatcher{Field: field, Op: op, Value: value}
+	}
+	ordered := []*LogRule{
+		// 1 shadows 2 (superset of matchers)
+		rule(1, false, m("source", OpEqual, "a")),
+		rule(2, false, m("source", OpEqual, "a"), m("message", OpEqual, "x")),
+		// 3 shadows 4 (literal instance of regexp)
+		rule(3, false, m("source", OpEqual, "b"), m("message", OpRegexp, "foo .*")),
+		rule(4, true, m("source", OpEqual, "b"), m("message", OpRegexp, "foo bar")),
+		// 5 and 6 conflict (overlapping regexps)
+		rule(5, true, m("source", OpEqual, "c"), m("message", OpRegexp, "foo .*")),
+		rule(6, false, m("source", OpEqual, "c"), m("message", OpRegexp, ".* bar")),
+		// 7 and 8 are disjoint (different literal prefixes)
+		rule(7, true, m("source", OpEqual, "d"), m("message", OpRegexp, "foo .*")),
+		rule(8, false, m("source", OpEqual, "d"), m("message", OpRegexp, "bar .*")),
+		// 9 is different source, so does not overlap with anything
+		rule(9, true, m("source", OpEqual, "e")),
+		// 10 is in wildcard bucket, and shadowed by 9
+		rule(10, true, m("source", OpPrefix, "e"), m("source", OpEqual, "e")),
+	}
+	issues := AnalyzeLogRules(ordered)
+	type result struct {
+		Kind, Rule, By int
+	}
+	var got []result
+	for _, issue := range issues {
+		got = append(got, result{issue.Kind, issue.Rule.ID, issue.By.ID})
+	}
+	assert.DeepEqual(t, got, []result{
+		{LogRuleIssueShadowed, 2, 1},
+		{LogRuleIssueShadowed, 4, 3},
+		{LogRuleIssueConflict, 6, 5},
+		{LogRuleIssueShadowed, 10, 9},
+	})
+}
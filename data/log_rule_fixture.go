@@ -0,0 +1,191 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Rule regression fixtures.
+
+ Each rule may carry example logs it must match, and example logs it
+must not match. A fixture fails if:
+
+ - the rule does not match its must-match fixture (or matches its
+must-not-match fixture); this is about the matchers only, so the
+fixtures of disabled and temporary rules are checked too, or
+
+ - some other rule matches the must-match fixture first (it is
+stolen), because of the evaluation order. This is checked only for
+rules that are in effect.
+*/
+
+package data
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+type LogRuleFixture struct {
+	Stream map[string]string `json:",omitempty"`
+
+	// Raw message of the log (which may be JSON with further fields)
+	Message string
+}
+
+// Log returns the fixture as a log with the given timestamp
+func (self *LogRuleFixture) Log(t time.Time) *Log {
+	return NewLog(t.UnixNano(), self.Stream, self.Message)
+}
+
+// StreamString returns the stream labels in key=value, .. form
+func (self *LogRuleFixture) StreamString() string {
+	result := ""
+	for _, k := range slices.Sorted(maps.Keys(self.Stream)) {
+		if result != "" {
+			result += ", "
+		}
+		result += k + "=" + self.Stream[k]
+	}
+	return result
+}
+
+// SetStreamString sets the stream labels from the StreamString form
+func (self *LogRuleFixture) SetStreamString(s string) {
+	self.Stream = nil
+	for _, label := range strings.Split(s, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(label), "=")
+		if k == "" {
+			continue
+		}
+		if self.Stream == nil {
+			self.Stream = make(map[string]string)
+		}
+		self.Stream[k] = v
+	}
+}
+
+const (
+	// Must-match fixture does not match the rule
+	LogRuleFixtureNotMatched = iota
+
+	// Must-not-match fixture matches the rule
+	LogRuleFixtureMatched
+
+	// Must-match fixture matches some other rule first
+	LogRuleFixtureStolen
+)
+
+type LogRuleFixtureFailure struct {
+	Rule *LogRule
+	Kind int
+
+	// Index of the fixture within MustMatch or MustNotMatch
+	Index int
+
+	// Rule which matches the stolen fixture
+	By *LogRule
+}
+
+func (self *LogRuleFixtureFailure) Error() string {
+	switch self.Kind {
+	case LogRuleFixtureNotMatched:
+		return fmt.Sprintf("rule #%d does not match its must-match fixture #%d", self.Rule.ID, self.Index+1)
+	case LogRuleFixtureMatched:
+		return fmt.Sprintf("rule #%d matches its must-not-match fixture #%d", self.Rule.ID, self.Index+1)
+	case LogRuleFixtureStolen:
+		return fmt.Sprintf("rule #%d matches must-match fixture #%d of rule #%d first", self.By.ID, self.Index+1, self.Rule.ID)
+	}
+	return "unknown fixture failure"
+}
+
+// FixtureCount returns the total number of fixtures of the rule
+func (self *LogRule) FixtureCount() int {
+	return len(self.MustMatch) + len(self.MustNotMatch)
+}
+
+// ownFixtureFailures checks the fixtures of the rule against the rule
+// itself; toRule (if set) returns the rule which would match the given
+// log in the ruleset
+func (self *LogRule) ownFixtureFailures(now time.Time, toRule func(*Log) *LogRule) []*LogRuleFixtureFailure {
+	var result []*LogRuleFixtureFailure
+	active := !self.Disabled && self.ValidAt(now)
+	for i := range self.MustMatch {
+		log := self.MustMatch[i].Log(now)
+		if !self.matchersMatch(log) {
+			result = append(result, &LogRuleFixtureFailure{Rule: self, Kind: LogRuleFixtureNotMatched, Index: i})
+			continue
+		}
+		if active && toRule != nil {
+			if by := toRule(log); by != self {
+				result = append(result, &LogRuleFixtureFailure{Rule: self, Kind: LogRuleFixtureStolen, Index: i, By: by})
+			}
+		}
+	}
+	for i := range self.MustNotMatch {
+		if self.matchersMatch(self.MustNotMatch[i].Log(now)) {
+			result = append(result, &LogRuleFixtureFailure{Rule: self, Kind: LogRuleFixtureMatched, Index: i})
+		}
+	}
+	return result
+}
+
+// FixtureFailures evaluates the fixtures of all of the rules
+func (self *LogRules) FixtureFailures(now time.Time) []*LogRuleFixtureFailure {
+	var result []*LogRuleFixtureFailure
+	for _, rule := range self.Ordered {
+		result = append(result, rule.ownFixtureFailures(now, self.brm.ToRule)...)
+	}
+	return result
+}
+
+// RuleFixtureFailures evaluates the fixtures involving the given rule
+// within the ordered rules: the fixtures of the rule itself, and the
+// must-match fixtures of other rules it steals
+func RuleFixtureFailures(ordered []*LogRule, rule *LogRule, now time.Time) []*LogRuleFixtureFailure {
+	toRule := func(log *Log) *LogRule {
+		return LogToRule(log, ordered)
+	}
+	result := rule.ownFixtureFailures(now, toRule)
+	if rule.Disabled || !rule.ValidAt(now) {
+		return result
+	}
+	for _, other := range ordered {
+		if other == rule || other.Disabled || !other.ValidAt(now) {
+			continue
+		}
+		for i := range other.MustMatch {
+			log := other.MustMatch[i].Log(now)
+			if !rule.matchersMatch(log) || !other.matchersMatch(log) {
+				continue
+			}
+			// Only steals by this rule (and not some third one) count
+			if toRule(log) == rule {
+				result = append(result, &LogRuleFixtureFailure{Rule: other, Kind: LogRuleFixtureStolen, Index: i, By: rule})
+			}
+		}
+	}
+	return result
+}
+
+// FixtureFailures evaluates the fixtures of all of the rules
+func (self *Database) FixtureFailures() []*LogRuleFixtureFailure {
+	self.Lock()
+	defer self.Unlock()
+
+	return self.LogRules.FixtureFailures(time.Now())
+}
+
+// RuleFixtureFailures evaluates the fixtures involving the (possibly
+// modified or unsaved) rule, as if it was saved
+func (self *Database) RuleFixtureFailures(rule LogRule) []*LogRuleFixtureFailure {
+	self.Lock()
+	defer self.Unlock()
+
+	rules := self.rulesWith(&rule)
+	return RuleFixtureFailures(SortLogRules(rules), &rule, time.Now())
+}
@@ -0,0 +1,72 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package data
+
+import (
+	"os"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestLogRuleFixture(t *testing.T) {
+	var fixture LogRuleFixture
+	fixture.SetStreamString(" source=a, host=b=c,,")
+	assert.DeepEqual(t, fixture.Stream, map[string]string{"source": "a", "host": "b=c"})
+	assert.Equal(t, fixture.StreamString(), "host=b=c, source=a")
+	fixture.SetStreamString("")
+	assert.Assert(t, fixture.Stream == nil)
+}
+
+func TestDatabaseFixtures(t *testing.T) {
+	path := "test_db.json"
+	_ = os.Remove(path)
+
+	db := Database{Path: path}
+	foo := LogRuleFixture{Stream: map[string]string{"source": "a"}, Message: "foo"}
+	bar := LogRuleFixture{Stream: map[string]string{"source": "a"}, Message: "bar"}
+	assert.Equal(t, db.Add(LogRule{
+		Matchers:     []LogFieldMatcher{{Field: "message", Op: OpEqual, Value: "foo"}},
+		MustMatch:    []LogRuleFixture{foo},
+		MustNotMatch: []LogRuleFixture{bar},
+	}), nil)
+	assert.Equal(t, len(db.FixtureFailures()), 0)
+
+	// Widening the rule breaks its own fixture
+	wide := *db.LogRules.Rules[0]
+	wide.Matchers = []LogFieldMatcher{{Field: "message", Op: OpRegexp, Value: "(foo|bar)"}}
+	failures := db.RuleFixtureFailures(wide)
+	assert.Equal(t, len(failures), 1)
+	assert.Equal(t, failures[0].Kind, LogRuleFixtureMatched)
+	assert.Equal(t, failures[0].Error(), "rule #1 matches its must-not-match fixture #1")
+
+	// New (higher priority) rule steals the fixture of the first one
+	source := LogRule{Matchers: []LogFieldMatcher{{Field: "source", Op: OpEqual, Value: "a"}}}
+	failures = db.RuleFixtureFailures(source)
+	assert.Equal(t, len(failures), 1)
+	assert.Equal(t, failures[0].Kind, LogRuleFixtureStolen)
+	assert.Equal(t, failures[0].By.ID, 2)
+	assert.Equal(t, failures[0].Error(), "rule #2 matches must-match fixture #1 of rule #1 first")
+
+	// .. but not with lower priority
+	source.Priority = -1
+	assert.Equal(t, len(db.RuleFixtureFailures(source)), 0)
+
+	// Saved steal shows up in the full evaluation too
+	source.Priority = 0
+	assert.Equal(t, db.Add(source), nil)
+	failures = db.FixtureFailures()
+	assert.Equal(t, len(failures), 1)
+	assert.Equal(t, failures[0].Rule.ID, 1)
+
+	// Disabled rules do not steal anything
+	disabled := *db.LogRules.Rules[1]
+	disabled.Disabled = true
+	assert.Equal(t, db.AddOrUpdate(disabled), nil)
+	assert.Equal(t, len(db.FixtureFailures()), 0)
+}
@@ -0,0 +1,187 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Rate-aware rules.
+
+ A rule may have a rate condition: if at least Count logs match the
+rule within the Window (optionally counted separately for each value
+of a stream label), the logs over the threshold get the rate verdict
+instead of the verdict of the rule.
+
+ The rates are evaluated with sliding windows, over the cached logs
+in chronological order. Each window stores only the timestamps of the
+last Count matches (in a ring buffer), and the windows with no matches
+within the last Window are dropped, so the memory use is bounded by the
+thresholds and the label values seen recently. Logs which arrive out of
+order are counted as if they arrived in order.
+*/
+
+package data
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+var ErrInvalidRate = errors.New("invalid rate")
+
+type LogRuleRate struct {
+	// Number of matches within the window that triggers the rate verdict
+	Count int
+
+	// Length of the sliding window (as Go duration, e.g. '1m')
+	Window string
+
+	// Stream label to count the rate separately for, if any
+	PerLabel string `json:",omitempty"`
+
+	// Key of the verdict of the logs over the threshold
+	Verdict string
+
+	// Parsed Window
+	window time.Duration
+}
+
+func (self *LogRuleRate) Validate() error {
+	if self.Count < 1 {
+		return fmt.Errorf("%w: count must be positive", ErrInvalidRate)
+	}
+	window, err := time.ParseDuration(self.Window)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidRate, err)
+	}
+	if window <= 0 {
+		return fmt.Errorf("%w: window must be positive", ErrInvalidRate)
+	}
+	if _, ok := LogVerdictFromKey(self.Verdict); !ok {
+		return fmt.Errorf("%w: %w: %q", ErrInvalidRate, ErrUnknownVerdict, self.Verdict)
+	}
+	return nil
+}
+
+func (self *LogRuleRate) compile() {
+	self.window, _ = time.ParseDuration(self.Window)
+}
+
+func (self *LogRuleRate) String() string {
+	s := fmt.Sprintf("%d per %s", self.Count, self.Window)
+	if self.PerLabel != "" {
+		s += " per " + self.PerLabel
+	}
+	return s
+}
+
+type rateKey struct {
+	rid   int
+	label string
+}
+
+// rateWindow keeps timestamps of the most recent matches
+type rateWindow struct {
+	// Ring buffer of (at most Count) timestamps; once it is full,
+	// next is the index of the oldest one
+	times []time.Time
+	next  int
+
+	newest time.Time
+	window time.Duration
+}
+
+func newRateWindow(rate *LogRuleRate) *rateWindow {
+	return &rateWindow{times: make([]time.Time, 0, rate.Count), window: rate.window}
+}
+
+// add adds match at the given time, and returns true if the rate is
+// at (or over) the threshold
+func (self *rateWindow) add(t time.Time) bool {
+	if t.After(self.newest) {
+		self.newest = t
+	}
+	if len(self.times) < cap(self.times) {
+		self.times = append(self.times, t)
+		return len(self.times) == cap(self.times) && t.Sub(self.times[0]) < self.window
+	}
+	self.times[self.next] = t
+	self.next = (self.next + 1) % len(self.times)
+	return t.Sub(self.times[self.next]) < self.window
+}
+
+type rateCounters struct {
+	windows map[rateKey]*rateWindow
+
+	// Time of the newest log counted
+	newest time.Time
+}
+
+// add counts the log (which matches the rule), and returns true if it
+// is over the rate threshold of the rule
+func (self *rateCounters) add(log *Log, rule *LogRule) bool {
+	rate := rule.Rate
+	key := rateKey{rid: rule.ID}
+	if rate.PerLabel != "" {
+		key.label = log.Stream[rate.PerLabel]
+	}
+	w, ok := self.windows[key]
+	if !ok {
+		w = newRateWindow(rate)
+		self.windows[key] = w
+	}
+	if log.Time.After(self.newest) {
+		self.newest = log.Time
+	}
+	return w.add(log.Time)
+}
+
+// prune drops the windows with no matches within the window; they
+// cannot contribute to the rate of the later logs
+func (self *rateCounters) prune() {
+	maps.DeleteFunc(self.windows, func(_ rateKey, w *rateWindow) bool {
+		return self.newest.Sub(w.newest) >= w.window
+	})
+}
+
+// updateRates evaluates the rate conditions for the logs (given newest
+// first, like the log cache). If the ruleset has changed, all cached
+// logs are evaluated again. As this settles the verdicts, the number
+// of unknown logs is kept up to date here too.
+func (self *Database) updateRates(logs []*Log) {
+	lrules := &self.LogRules
+	if lrules.rates == nil {
+		lrules.rates = &rateCounters{windows: make(map[rateKey]*rateWindow)}
+		logs = self.logs
+		self.unknownLogs = 0
+	}
+	for _, log := range slices.Backward(logs) {
+		rule := log.ToRule(lrules)
+		log.overRate = rule != nil && rule.Rate != nil && lrules.rates.add(log, rule)
+		log.rateVersion = lrules.Version
+		if log.Verdict(lrules) == LogVerdictUnknown {
+			self.unknownLogs++
+		}
+	}
+	lrules.rates.prune()
+}
+
+// Verdict returns the verdict of the log given the ruleset, taking
+// into account the rate conditions (if they have been evaluated)
+func (self *Log) Verdict(rules *LogRules) int {
+	rule := self.ToRule(rules)
+	if self.OverRate(rules) {
+		verdict, _ := LogVerdictFromKey(rule.Rate.Verdict)
+		return verdict
+	}
+	return LogRuleToVerdict(rule)
+}
+
+// OverRate returns true if the log exceeded the rate threshold of its rule
+func (self *Log) OverRate(rules *LogRules) bool {
+	return self.overRate && self.rateVersion == rules.Version
+}
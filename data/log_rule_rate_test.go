@@ -0,0 +1,87 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package data
+
+import (
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestLogRuleRate(t *testing.T) {
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	var logs []*Log
+	add := func(offset time.Duration, host string) {
+		logs = append(logs, NewLog(start.Add(offset).UnixNano(), map[string]string{"host": host}, "msg"))
+	}
+	// Three logs within a minute on host a, then one after a pause
+	add(0, "a")
+	add(10*time.Second, "b")
+	add(20*time.Second, "a")
+	add(30*time.Second, "a")
+	add(5*time.Minute, "a")
+	// The cache is newest first
+	slices.Reverse(logs)
+
+	path := "test_db.json"
+	_ = os.Remove(path)
+	db := Database{Path: path, Source: &ArraySource{Data: logs, Chunk: len(logs)}}
+	rate := LogRuleRate{Count: 3, Window: "1m", Verdict: LogVerdictHamKey}
+	assert.Equal(t, db.Add(LogRule{Matchers: []LogFieldMatcher{{Field: "message", Op: OpEqual, Value: "msg"}}, Rate: &rate}), nil)
+
+	overRate := func() []bool {
+		cached, err := db.Logs()
+		assert.NilError(t, err)
+		var result []bool
+		for _, log := range slices.Backward(cached) {
+			result = append(result, log.OverRate(&db.LogRules))
+		}
+		return result
+	}
+	assert.DeepEqual(t, overRate(), []bool{false, false, true, true, false})
+	assert.Equal(t, logs[1].Verdict(&db.LogRules), LogVerdictHam)
+	assert.Equal(t, logs[0].Verdict(&db.LogRules), LogVerdictSpam)
+
+	// Per label counting; rates are evaluated again when the rules change
+	rule := *db.LogRules.Rules[0]
+	rule.Rate = &LogRuleRate{Count: 3, Window: "1m", PerLabel: "host", Verdict: LogVerdictHamKey}
+	assert.Equal(t, db.AddOrUpdate(rule), nil)
+	assert.DeepEqual(t, overRate(), []bool{false, false, false, true, false})
+
+	rule.Rate = &LogRuleRate{Count: 0, Window: "x", Verdict: "bogus"}
+	assert.ErrorIs(t, rule.Validate(), ErrInvalidRate)
+}
+
+func TestRateCounters(t *testing.T) {
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	rate := LogRuleRate{Count: 2, Window: "1m", PerLabel: "host", Verdict: LogVerdictHamKey}
+	rate.compile()
+	rule := LogRule{ID: 1, Rate: &rate}
+	rates := rateCounters{windows: make(map[rateKey]*rateWindow)}
+	add := func(offset time.Duration, host string) bool {
+		return rates.add(NewLog(start.Add(offset).UnixNano(), map[string]string{"host": host}, "msg"), &rule)
+	}
+
+	// The ring buffer wraps around
+	var result []bool
+	for _, offset := range []time.Duration{0, 50, 70, 80, 200, 300} {
+		result = append(result, add(offset*time.Second, "a"))
+	}
+	assert.DeepEqual(t, result, []bool{false, true, true, true, false, false})
+
+	// Windows with no recent matches are dropped
+	assert.Assert(t, !add(300*time.Second, "b"))
+	assert.Assert(t, !add(400*time.Second, "c"))
+	rates.prune()
+	assert.Equal(t, len(rates.windows), 1)
+	_, ok := rates.windows[rateKey{rid: 1, label: "c"}]
+	assert.Assert(t, ok)
+}
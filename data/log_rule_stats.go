@@ -0,0 +1,255 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Per-rule hit statistics.
+
+ Unlike the rule counts (which are about the cached logs, and follow
+the ruleset as it changes), these accumulate over time: each log is
+counted once, when it is first fetched, for the rule that matched it
+at that time. The statistics are persisted in a separate file next to
+the database, as they change far more often than the rules.
+*/
+
+package data
+
+import (
+	"errors"
+	"io/fs"
+	"maps"
+	"slices"
+	"time"
+)
+
+type LogRuleHitSeries struct {
+	// Index (time divided by bucket size) of the last bucket
+	Last int64
+
+	// Hit counts, the last bucket last
+	Counts []int
+}
+
+// add adds hit to the bucket, dropping buckets beyond the given size
+func (self *LogRuleHitSeries) add(bucket int64, size int) {
+	if len(self.Counts) == 0 {
+		self.Last = bucket
+		self.Counts = []int{0}
+	}
+	if bucket > self.Last {
+		shift := int(min(bucket-self.Last, int64(size)))
+		self.Counts = append(self.Counts, make([]int, shift)...)
+		self.Last = bucket
+	}
+	if len(self.Counts) > size {
+		self.Counts = slices.Delete(self.Counts, 0, len(self.Counts)-size)
+	}
+	age := self.Last - bucket
+	if age >= int64(size) {
+		// Too old to be counted
+		return
+	}
+	if missing := int(age) + 1 - len(self.Counts); missing > 0 {
+		self.Counts = slices.Insert(self.Counts, 0, make([]int, missing)...)
+	}
+	self.Counts[len(self.Counts)-1-int(age)]++
+}
+
+// Recent returns the hit counts of the n buckets up to the given
+// bucket (inclusive), the last bucket last
+func (self *LogRuleHitSeries) Recent(bucket int64, n int) []int {
+	result := make([]int, n)
+	for i, count := range self.Counts {
+		b := self.Last - int64(len(self.Counts)-1-i)
+		if idx := n - 1 - int(bucket-b); idx >= 0 && idx < n {
+			result[idx] = count
+		}
+	}
+	return result
+}
+
+type logRuleSeriesSpec struct {
+	bucket time.Duration
+	size   int
+}
+
+// Resolutions of the hit series and how far back each reaches: two
+// hours by the minute, three days by the hour, and 90 days by the day
+var (
+	minuteSeries = logRuleSeriesSpec{time.Minute, 120}
+	hourSeries   = logRuleSeriesSpec{time.Hour, 72}
+	daySeries    = logRuleSeriesSpec{24 * time.Hour, 90}
+)
+
+func (self logRuleSeriesSpec) bucketOf(t time.Time) int64 {
+	return t.Unix() / int64(self.bucket/time.Second)
+}
+
+type LogRuleStats struct {
+	// Zero if the rule has never matched
+	FirstSeen time.Time
+	LastSeen  time.Time
+
+	Minutes LogRuleHitSeries
+	Hours   LogRuleHitSeries
+	Days    LogRuleHitSeries
+}
+
+func (self *LogRuleStats) add(t time.Time) {
+	if self.FirstSeen.IsZero() || t.Before(self.FirstSeen) {
+		self.FirstSeen = t
+	}
+	if t.After(self.LastSeen) {
+		self.LastSeen = t
+	}
+	self.Minutes.add(minuteSeries.bucketOf(t), minuteSeries.size)
+	self.Hours.add(hourSeries.bucketOf(t), hourSeries.size)
+	self.Days.add(daySeries.bucketOf(t), daySeries.size)
+}
+
+// RecentDays returns the daily hit counts of the last n days
+func (self *LogRuleStats) RecentDays(now time.Time, n int) []int {
+	return self.Days.Recent(daySeries.bucketOf(now), n)
+}
+
+// RecentHours returns the hourly hit counts of the last n hours
+func (self *LogRuleStats) RecentHours(now time.Time, n int) []int {
+	return self.Hours.Recent(hourSeries.bucketOf(now), n)
+}
+
+// RecentMinutes returns the per-minute hit counts of the last n minutes
+func (self *LogRuleStats) RecentMinutes(now time.Time, n int) []int {
+	return self.Minutes.Recent(minuteSeries.bucketOf(now), n)
+}
+
+// SeenSince returns true if the rule has matched since the given time
+func (self *LogRuleStats) SeenSince(t time.Time) bool {
+	return self != nil && !self.LastSeen.Before(t)
+}
+
+func (self *LogRuleStats) clone() *LogRuleStats {
+	result := *self
+	result.Minutes.Counts = slices.Clone(self.Minutes.Counts)
+	result.Hours.Counts = slices.Clone(self.Hours.Counts)
+	result.Days.Counts = slices.Clone(self.Days.Counts)
+	return &result
+}
+
+// Logs may arrive late (e.g. interleaved from different sources), so
+// the logs counted within this long before the newest one are
+// remembered individually; logs older than that are assumed to be
+// counted already
+const statsRecentWindow = time.Hour
+
+type logRuleStatsFile struct {
+	// Timestamp of the newest log counted so far
+	Until int64
+
+	Rules map[int]*LogRuleStats
+
+	// Hashes of the logs counted within statsRecentWindow before
+	// Until, and their timestamps; these are not counted again. This
+	// is not persisted, as it grows with the log volume; after
+	// restart, the logs up to Until are assumed to be counted.
+	recent map[uint64]int64
+}
+
+func (self *Database) statsPath() string {
+	return self.Path + ".stats"
+}
+
+// addLogsToStats counts the (newly fetched) logs in the rule statistics
+func (self *Database) addLogsToStats(logs []*Log) {
+	stats := &self.stats
+	if stats.Rules == nil {
+		stats.Rules = make(map[int]*LogRuleStats)
+	}
+	horizon := stats.Until - int64(statsRecentWindow)
+	if stats.recent == nil {
+		// Freshly loaded; the cached logs (if any) have been counted
+		horizon = stats.Until
+		stats.recent = make(map[uint64]int64)
+		for _, log := range self.logs {
+			if log.Timestamp > horizon-int64(statsRecentWindow) {
+				stats.recent[log.Hash()] = log.Timestamp
+			}
+		}
+	}
+	until := stats.Until
+	for _, log := range logs {
+		if log.Timestamp <= horizon {
+			continue
+		}
+		hash := log.Hash()
+		if _, ok := stats.recent[hash]; ok {
+			continue
+		}
+		stats.recent[hash] = log.Timestamp
+		until = max(until, log.Timestamp)
+		rule := log.ToRule(&self.LogRules)
+		if rule == nil {
+			continue
+		}
+		rstats, ok := stats.Rules[rule.ID]
+		if !ok {
+			rstats = &LogRuleStats{}
+			stats.Rules[rule.ID] = rstats
+		}
+		rstats.add(log.Time)
+		self.statsDirty = true
+	}
+	stats.Until = until
+	maps.DeleteFunc(stats.recent, func(_ uint64, timestamp int64) bool {
+		return timestamp <= until-int64(statsRecentWindow)
+	})
+}
+
+// RuleStats returns (copy of) the statistics of the rule, or nil if
+// the rule has never matched
+func (self *Database) RuleStats(rid int) *LogRuleStats {
+	self.Lock()
+	defer self.Unlock()
+
+	rstats, ok := self.stats.Rules[rid]
+	if !ok {
+		return nil
+	}
+	return rstats.clone()
+}
+
+func (self *Database) loadStats() error {
+	self.stats = logRuleStatsFile{}
+	err := UnmarshalJSONFromPath(&self.stats, self.statsPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// SaveStats persists the rule statistics, if they have changed
+func (self *Database) SaveStats() error {
+	self.Lock()
+	defer self.Unlock()
+
+	if !self.statsDirty {
+		return nil
+	}
+	// Statistics of deleted rules are not interesting
+	rids := make(map[int]struct{}, len(self.LogRules.Rules))
+	for _, rule := range self.LogRules.Rules {
+		rids[rule.ID] = struct{}{}
+	}
+	maps.DeleteFunc(self.stats.Rules, func(rid int, _ *LogRuleStats) bool {
+		_, ok := rids[rid]
+		return !ok
+	})
+	err := MarshalJSONToPath(&self.stats, self.statsPath())
+	if err != nil {
+		return err
+	}
+	self.statsDirty = false
+	return nil
+}
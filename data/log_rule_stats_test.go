@@ -0,0 +1,99 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package data
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestLogRuleHitSeries(t *testing.T) {
+	s := LogRuleHitSeries{}
+	s.add(10, 3)
+	s.add(10, 3)
+	s.add(12, 3)
+	assert.DeepEqual(t, s.Counts, []int{2, 0, 1})
+	assert.DeepEqual(t, s.Recent(13, 5), []int{0, 2, 0, 1, 0})
+
+	// Too old to be counted
+	s.add(5, 3)
+	assert.DeepEqual(t, s.Counts, []int{2, 0, 1})
+
+	s2 := LogRuleHitSeries{}
+	s2.add(12, 3)
+	s2.add(10, 3)
+	assert.DeepEqual(t, s2.Counts, []int{1, 0, 1})
+
+	// Old buckets are dropped
+	s.add(14, 3)
+	assert.DeepEqual(t, s.Counts, []int{1, 0, 1})
+	assert.Equal(t, s.Last, int64(14))
+}
+
+func TestDatabaseRuleStats(t *testing.T) {
+	path := "test_db.json"
+	_ = os.Remove(path)
+	defer os.Remove(path + ".stats")
+
+	now := time.Now()
+	logs := []*Log{
+		NewLog(now.UnixNano(), nil, "a"),
+		NewLog(now.Add(-2*time.Hour).UnixNano(), nil, "a"),
+	}
+	db := Database{Path: path, Source: &ArraySource{Data: logs, Chunk: 2}}
+	assert.Equal(t, db.Add(LogRule{Matchers: []LogFieldMatcher{{Field: "message", Op: OpEqual, Value: "a"}}}), nil)
+	assert.Equal(t, db.RuleStats(1), (*LogRuleStats)(nil))
+
+	_, err := db.Logs()
+	assert.NilError(t, err)
+	stats := db.RuleStats(1)
+	assert.Equal(t, stats.LastSeen, logs[0].Time)
+	assert.Equal(t, stats.FirstSeen, logs[1].Time)
+	assert.DeepEqual(t, stats.RecentHours(now, 3), []int{1, 0, 1})
+	assert.Assert(t, stats.SeenSince(now.Add(-time.Hour)))
+	assert.Assert(t, !stats.SeenSince(now.Add(time.Hour)))
+	assert.NilError(t, db.SaveStats())
+
+	// The statistics survive restart, and the same logs are not
+	// counted again
+	db2 := Database{Path: path, Source: &ArraySource{Data: logs, Chunk: 2}}
+	assert.NilError(t, db2.Load())
+	_, err = db2.Logs()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, db2.RuleStats(1).RecentHours(now, 3), []int{1, 0, 1})
+
+	// Logs arriving late are still counted, once
+	late := NewLog(now.Add(-10*time.Minute).UnixNano(), nil, "a")
+	db2.Source = &ArraySource{Data: []*Log{late, late}, Chunk: 1}
+	for range 2 {
+		_, err = db2.Logs()
+		assert.NilError(t, err)
+	}
+	total := 0
+	for _, count := range db2.RuleStats(1).RecentHours(now, 3) {
+		total += count
+	}
+	assert.Equal(t, total, 3)
+	assert.Assert(t, db2.RuleStats(1).LastSeen.Equal(logs[0].Time))
+
+	// The hashes of the recent logs are not persisted
+	assert.NilError(t, db2.SaveStats())
+	b, err := os.ReadFile(path + ".stats")
+	assert.NilError(t, err)
+	assert.Assert(t, !strings.Contains(string(b), "Recent"), string(b))
+
+	// Statistics of deleted rules are dropped on save
+	assert.NilError(t, db2.Delete(1))
+	db2.statsDirty = true
+	assert.NilError(t, db2.SaveStats())
+	assert.Equal(t, len(db2.stats.Rules), 0)
+}
@@ -12,6 +12,7 @@
 package data
 
 import (
+	"errors"
 	"testing"
 
 	"gotest.tools/v3/assert"
@@ -27,3 +28,35 @@ func TestLogRule(t *testing.T) {
 	assert.Assert(t, !lr.MatchesFTS("dummynonexistent"))
 	assert.Equal(t, lr.SourceString(), "=dummysrc")
 }
+
+func TestLogRuleValidate(t *testing.T) {
+	lr := LogRule{Matchers: []LogFieldMatcher{
+		{Field: "source", Op: OpEqual, Value: "dummysrc"},
+		{Field: "message", Op: OpRegexp, Value: "broken("},
+		{Field: "", Op: OpEqual, Value: "y"},
+		{Field: "", Op: OpEqual, Value: ""},
+		{Field: "x", Op: "?", Value: "y"},
+		{Field: "x", Op: OpLess, Value: "y"},
+		{Field: "x", Op: OpRegexp, Value: "a{1000}b{1000}"},
+	}}
+	errs := lr.ValidationErrors()
+	assert.Equal(t, len(errs), 5)
+	assert.Equal(t, errs[0].Matcher, 1)
+	assert.Assert(t, errors.Is(errs[1], ErrEmptyMatcher))
+	assert.Assert(t, errors.Is(errs[2], ErrUnknownOp))
+	assert.Assert(t, errors.Is(errs[4], ErrRegexpTooComplex))
+	assert.Assert(t, errors.Is(lr.Validate(), ErrInvalidRuleMatcher))
+	assert.Equal(t, lr.MatcherValidationError(0), nil)
+
+	// Blank rows from the rule editor are ignored
+	assert.Equal(t, lr.MatcherValidationError(3), nil)
+
+	// Broken matchers never match
+	log := NewLog(123, nil, "broken(")
+	assert.Assert(t, !LogMatchesRule(log, &LogRule{Matchers: lr.Matchers[1:2]}))
+
+	// Invalid rules are not saved
+	db := Database{Path: "test_db.json"}
+	assert.Assert(t, errors.Is(db.Add(lr), ErrInvalidRuleMatcher))
+	assert.Equal(t, len(db.LogRules.Rules), 0)
+}
@@ -0,0 +1,184 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Rule validation.
+
+ Rules are validated when they are loaded and saved. Broken rules
+never match anything, so it is better to tell the user about them
+than to let a typo silently disable a rule.
+*/
+
+package data
+
+import (
+	"errors"
+	"fmt"
+	"regexp/syntax"
+)
+
+// Limits on the size and complexity of a rule, so that a single rule
+// (e.g. a pasted or hand-edited one) cannot make the matching or the
+// indexing of the ruleset expensive
+
+// Maximum number of matchers in a single rule
+const maxRuleMatchers = 64
+
+// Maximum nesting depth of matcher groups
+const maxGroupDepth = 8
+
+// Maximum length of a matcher value
+const maxMatcherValueLength = 65536
+
+// Maximum number of nodes in a (simplified) regexp syntax tree
+const maxRegexpComplexity = 1000
+
+var (
+	ErrUnknownOp          = errors.New("unknown operation")
+	ErrEmptyMatcher       = errors.New("matcher field is empty")
+	ErrTooManyMatchers    = fmt.Errorf("more than %d matchers", maxRuleMatchers)
+	ErrValueTooLong       = fmt.Errorf("value is longer than %d characters", maxMatcherValueLength)
+	ErrRegexpTooComplex   = fmt.Errorf("regexp has more than %d nodes", maxRegexpComplexity)
+	ErrUnknownVerdict     = errors.New("unknown verdict")
+	ErrRuleVerdictUnknown = errors.New("rules cannot classify logs as unknown")
+	ErrUnknownGroupOp     = errors.New("unknown group operation")
+	ErrGroupTooDeep       = fmt.Errorf("groups are nested more than %d deep", maxGroupDepth)
+	ErrInvalidValidity    = errors.New("rule is valid until before it is valid from")
+	ErrInvalidRule        = errors.New("invalid rule")
+	ErrInvalidRuleMatcher = errors.New("invalid matcher")
+)
+
+// LogRuleValidationError describes single problem with a rule
+type LogRuleValidationError struct {
+	// Index of the matcher that has the problem, or -1 if the
+	// problem is with the rule as a whole
+	Matcher int
+
+	Err error
+}
+
+func (self *LogRuleValidationError) Error() string {
+	if self.Matcher < 0 {
+		return self.Err.Error()
+	}
+	return fmt.Sprintf("matcher #%d: %s", self.Matcher+1, self.Err.Error())
+}
+
+func (self *LogRuleValidationError) Unwrap() []error {
+	if self.Matcher < 0 {
+		return []error{ErrInvalidRule, self.Err}
+	}
+	return []error{ErrInvalidRuleMatcher, self.Err}
+}
+
+func regexpComplexity(re *syntax.Regexp) int {
+	count := 1
+	for _, sub := range re.Sub {
+		count += regexpComplexity(sub)
+	}
+	return count
+}
+
+func (self *LogFieldMatcher) Validate() error {
+	// Blank rows of the rule editor are ignored when matching, so
+	// they are fine to save too
+	if self.empty() {
+		return nil
+	}
+	if self.Field == "" {
+		return ErrEmptyMatcher
+	}
+	if len(self.Value) > maxMatcherValueLength {
+		return ErrValueTooLong
+	}
+	_, err := self.compileMatch()
+	if err != nil {
+		return err
+	}
+	if self.Op == OpRegexp || self.Op == OpNotRegexp {
+		re, err := syntax.Parse(self.Value, syntax.Perl)
+		if err != nil {
+			return err
+		}
+		if regexpComplexity(re.Simplify()) > maxRegexpComplexity {
+			return ErrRegexpTooComplex
+		}
+	}
+	return nil
+}
+
+// ValidationErrors returns all problems with the rule (if any)
+func (self *LogRule) ValidationErrors() []*LogRuleValidationError {
+	var result []*LogRuleValidationError
+	if verdict, ok := LogVerdictFromKey(self.VerdictKey()); !ok {
+		result = append(result, &LogRuleValidationError{Matcher: -1, Err: fmt.Errorf("%w: %q", ErrUnknownVerdict, self.VerdictKey())})
+	} else if verdict == LogVerdictUnknown {
+		result = append(result, &LogRuleValidationError{Matcher: -1, Err: ErrRuleVerdictUnknown})
+	}
+	if self.ValidFrom != nil && self.ValidUntil != nil && !self.ValidFrom.Before(*self.ValidUntil) {
+		result = append(result, &LogRuleValidationError{Matcher: -1, Err: ErrInvalidValidity})
+	}
+	if self.Rate != nil {
+		if err := self.Rate.Validate(); err != nil {
+			result = append(result, &LogRuleValidationError{Matcher: -1, Err: err})
+		}
+	}
+	group := self.group()
+	if group.matcherCount() > maxRuleMatchers {
+		result = append(result, &LogRuleValidationError{Matcher: -1, Err: ErrTooManyMatchers})
+	}
+	for i := range self.Matchers {
+		err := self.Matchers[i].Validate()
+		if err != nil {
+			result = append(result, &LogRuleValidationError{Matcher: i, Err: err})
+		}
+	}
+	for i := range self.Groups {
+		for _, err := range self.Groups[i].validationErrors(fmt.Sprintf("#%d", i+1), 1) {
+			result = append(result, &LogRuleValidationError{Matcher: -1, Err: err})
+		}
+	}
+	return result
+}
+
+// MatcherValidationError returns the problem with the given matcher (if any)
+func (self *LogRule) MatcherValidationError(matcher int) error {
+	for _, err := range self.ValidationErrors() {
+		if err.Matcher == matcher {
+			return err.Err
+		}
+	}
+	return nil
+}
+
+// Validate returns all problems with the rule as a single error
+func (self *LogRule) Validate() error {
+	errs := self.ValidationErrors()
+	result := make([]error, len(errs))
+	for i, err := range errs {
+		result[i] = err
+	}
+	return errors.Join(result...)
+}
+
+// InvalidLogRule is rule which did not pass validation
+type InvalidLogRule struct {
+	Rule   *LogRule
+	Errors []*LogRuleValidationError
+}
+
+// Invalid returns all rules which do not pass validation
+func (self *LogRules) Invalid() []*InvalidLogRule {
+	var result []*InvalidLogRule
+	for _, rule := range self.Ordered {
+		errs := rule.ValidationErrors()
+		if len(errs) > 0 {
+			result = append(result, &InvalidLogRule{Rule: rule, Errors: errs})
+		}
+	}
+	return result
+}
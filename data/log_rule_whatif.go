@@ -0,0 +1,151 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ What-if evaluation of ruleset changes.
+
+ The proposed ruleset is evaluated against all of the cached logs,
+and compared to the current one: how the verdicts of the logs would
+change, and which rules would lose matches. Only the base verdicts of
+the rules are considered (rate conditions depend on the history, and
+are ignored).
+
+ The proposed ruleset consists of copies of the rules, as the rules
+are shared with the current ruleset (and the classification snapshot),
+and preparing them for use must not change the rules in effect.
+*/
+
+package data
+
+import (
+	"cmp"
+	"slices"
+)
+
+// Number of example logs kept for each verdict change
+const whatIfExamples = 3
+
+type LogVerdictChangeExample struct {
+	Log *Log
+
+	// The current and the proposed rule of the log (if any)
+	From, To *LogRule
+}
+
+type LogVerdictChange struct {
+	From, To int
+
+	// Number of logs with the change
+	Count int
+
+	Examples []LogVerdictChangeExample
+}
+
+type LogRuleHitChange struct {
+	Rule *LogRule
+
+	// Number of matches with the current and the proposed ruleset
+	Before, After int
+}
+
+type LogRulesDiff struct {
+	// Number of logs evaluated
+	Total int
+
+	// Number of logs with different verdict
+	Changed int
+
+	// Verdict changes, most common first
+	Verdicts []*LogVerdictChange
+
+	// Rules that would lose matches, biggest losses first
+	Rules []*LogRuleHitChange
+}
+
+// Empty returns true if nothing would change
+func (self *LogRulesDiff) Empty() bool {
+	return self.Changed == 0 && len(self.Rules) == 0
+}
+
+func (self *Database) whatIf(rules []*LogRule) *LogRulesDiff {
+	clones := make([]*LogRule, len(rules))
+	for i, rule := range rules {
+		clones[i] = rule.clone()
+	}
+	// The version is irrelevant, as nothing is cached with it
+	proposed := NewLogRules(clones, -1)
+	diff := LogRulesDiff{Total: len(self.logs)}
+	verdicts := map[[2]int]*LogVerdictChange{}
+	current := map[int]*LogRule{}
+	before := map[int]int{}
+	after := map[int]int{}
+	for i, change := range rematchLogs(self.logs, &self.LogRules, &proposed) {
+		if change.prev != nil {
+			current[change.prev.ID] = change.prev
+			before[change.prev.ID]++
+		}
+		if change.next != nil {
+			after[change.next.ID]++
+		}
+		from, to := LogRuleToVerdict(change.prev), LogRuleToVerdict(change.next)
+		if from == to {
+			continue
+		}
+		diff.Changed++
+		key := [2]int{from, to}
+		verdict, ok := verdicts[key]
+		if !ok {
+			verdict = &LogVerdictChange{From: from, To: to}
+			verdicts[key] = verdict
+			diff.Verdicts = append(diff.Verdicts, verdict)
+		}
+		verdict.Count++
+		if len(verdict.Examples) < whatIfExamples {
+			verdict.Examples = append(verdict.Examples, LogVerdictChangeExample{Log: self.logs[i], From: change.prev, To: change.next})
+		}
+	}
+	slices.SortStableFunc(diff.Verdicts, func(a, b *LogVerdictChange) int {
+		return cmp.Compare(b.Count, a.Count)
+	})
+	for rid, count := range before {
+		if after[rid] < count {
+			diff.Rules = append(diff.Rules, &LogRuleHitChange{Rule: current[rid], Before: count, After: after[rid]})
+		}
+	}
+	slices.SortFunc(diff.Rules, func(a, b *LogRuleHitChange) int {
+		return cmp.Or(cmp.Compare(b.Before-b.After, a.Before-a.After), cmp.Compare(a.Rule.ID, b.Rule.ID))
+	})
+	return &diff
+}
+
+// WhatIfRule evaluates the impact of saving the (possibly modified or
+// unsaved) rule
+func (self *Database) WhatIfRule(rule LogRule) (*LogRulesDiff, error) {
+	self.Lock()
+	defer self.Unlock()
+
+	if err := self.ensureLogs(); err != nil {
+		return nil, err
+	}
+	return self.whatIf(self.rulesWith(&rule)), nil
+}
+
+// WhatIfDisabled evaluates the impact of disabling (or enabling) the
+// given rules
+func (self *Database) WhatIfDisabled(rids []int, disabled bool) (*LogRulesDiff, error) {
+	self.Lock()
+	defer self.Unlock()
+
+	if err := self.ensureLogs(); err != nil {
+		return nil, err
+	}
+	rules, ok := self.rulesDisabled(rids, disabled)
+	if !ok {
+		return nil, ErrRuleNotFound
+	}
+	return self.whatIf(rules), nil
+}
@@ -0,0 +1,82 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package data
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestDatabaseWhatIf(t *testing.T) {
+	path := "test_db.json"
+	_ = os.Remove(path)
+
+	var logs []*Log
+	for i, message := range []string{"foo", "foo", "bar", "baz"} {
+		logs = append(logs, NewLog(int64(i+1), map[string]string{"source": "a"}, message))
+	}
+	db := Database{Path: path, Source: &ArraySource{Data: logs, Chunk: len(logs)}}
+	assert.Equal(t, db.Add(LogRule{Verdict: LogVerdictHamKey, Matchers: []LogFieldMatcher{{Field: "message", Op: OpEqual, Value: "foo"}}}), nil)
+	assert.Equal(t, db.Add(LogRule{Verdict: LogVerdictSpamKey, Matchers: []LogFieldMatcher{{Field: "message", Op: OpEqual, Value: "bar"}}}), nil)
+
+	// New catch-all spam rule with higher priority
+	diff, err := db.WhatIfRule(LogRule{Priority: 1, Verdict: LogVerdictSpamKey, Matchers: []LogFieldMatcher{{Field: "source", Op: OpEqual, Value: "a"}}})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, diff.Total, 4)
+	assert.Equal(t, diff.Changed, 3)
+	assert.Equal(t, len(diff.Verdicts), 2)
+	assert.Equal(t, diff.Verdicts[0].From, LogVerdictHam)
+	assert.Equal(t, diff.Verdicts[0].To, LogVerdictSpam)
+	assert.Equal(t, diff.Verdicts[0].Count, 2)
+	assert.Equal(t, len(diff.Verdicts[0].Examples), 2)
+	assert.Equal(t, diff.Verdicts[0].Examples[0].From.ID, 1)
+	assert.Equal(t, diff.Verdicts[0].Examples[0].To.ID, 3)
+	assert.Equal(t, diff.Verdicts[1].From, LogVerdictUnknown)
+	assert.Equal(t, diff.Verdicts[1].Count, 1)
+
+	// Both existing rules lose their matches (bar stays spam, though)
+	assert.Equal(t, len(diff.Rules), 2)
+	assert.Equal(t, diff.Rules[0].Rule.ID, 1)
+	assert.Equal(t, diff.Rules[0].Before, 2)
+	assert.Equal(t, diff.Rules[0].After, 0)
+	assert.Equal(t, diff.Rules[1].Rule.ID, 2)
+
+	// Nothing was saved
+	assert.Equal(t, len(db.LogRules.Rules), 2)
+
+	// The rules in effect are not touched either (the window would
+	// be set, if the rate was compiled)
+	rate := &LogRuleRate{Count: 1, Window: "1m", Verdict: LogVerdictSpamKey}
+	db.LogRules.Rules[0].Rate = rate
+	_, err = db.WhatIfRule(LogRule{Verdict: LogVerdictSpamKey})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, db.LogRules.Rules[0].Rate, rate)
+	assert.Equal(t, rate.window, time.Duration(0))
+	db.LogRules.Rules[0].Rate = nil
+
+	diff, err = db.WhatIfDisabled([]int{1}, true)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, diff.Changed, 2)
+	assert.Equal(t, diff.Verdicts[0].To, LogVerdictUnknown)
+	assert.Equal(t, len(diff.Rules), 1)
+
+	diff, err = db.WhatIfDisabled([]int{1}, false)
+	assert.Equal(t, err, nil)
+	assert.Assert(t, diff.Empty())
+
+	_, err = db.WhatIfDisabled([]int{42}, true)
+	assert.Equal(t, err, ErrRuleNotFound)
+
+	assert.Equal(t, db.SetDisabled([]int{1, 2}, true), nil)
+	assert.Assert(t, db.LogRules.Rules[0].Disabled)
+	assert.Assert(t, db.LogRules.Rules[1].Disabled)
+	assert.Equal(t, db.RuleCount(1), 0)
+}
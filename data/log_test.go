@@ -0,0 +1,43 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package data
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestLogFieldValue(t *testing.T) {
+	stream := map[string]string{"source": "src"}
+	log := NewLog(123, stream, `{"message": "msg", "dotted.key": 1, "http": {"request": {"method": "GET", "headers": ["a", {"b": true}]}}}`)
+
+	cases := []struct {
+		field string
+		value string
+		found bool
+	}{
+		{"source", "src", true},
+		{"message", "msg", true},
+		{"dotted.key", "1", true},
+		{"http.request.method", "GET", true},
+		{"http.request.headers[0]", "a", true},
+		{"http.request.headers.0", "a", true},
+		{"http.request.headers[1].b", "true", true},
+		{"http.request.headers[2]", "", false},
+		{"http.request.headers[x]", "", false},
+		{"http.request.nonexistent", "", false},
+		{"http.request.method.nonexistent", "", false},
+		{"nonexistent", "", false},
+	}
+	for _, c := range cases {
+		value, found := log.FieldString(c.field)
+		assert.Equal(t, found, c.found, c.field)
+		assert.Equal(t, value, c.value, c.field)
+	}
+}
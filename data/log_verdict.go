@@ -7,45 +7,117 @@
 
 package data
 
+import "errors"
+
+/*
+ Verdicts are configurable; the first three (unknown, ham and spam)
+are always present with fixed indexes, as the rest of the code (and
+Vector configurations) rely on them. Ham and spam are shown to the user
+as 'Interesting' and 'Noise' by default.
+*/
+
 const (
 	LogVerdictUnknown int = iota
 	LogVerdictHam
 	LogVerdictSpam
-	LogVerdictNothing
-	NumLogVerdicts
 )
 
-func LogVerdictToString(verdict int) string {
-	switch verdict {
-	case LogVerdictHam:
-		return "Ham"
-	case LogVerdictSpam:
-		return "Spam"
-	case LogVerdictNothing:
-		return "Nothing"
+const (
+	LogVerdictUnknownKey = "unknown"
+	LogVerdictHamKey     = "ham"
+	LogVerdictSpamKey    = "spam"
+)
+
+var ErrInvalidLogVerdicts = errors.New("the first verdicts must be unknown, ham and spam")
+
+type LogVerdictInfo struct {
+	// Stable identifier of the verdict; it is stored in the rules,
+	// and used in the exported configuration
+	Key string
+
+	// Human readable name of the verdict
+	Name string
+
+	// Bootstrap color of the verdict (e.g. 'danger')
+	Color string
+
+	// Retention hint for the downstream log storage (e.g. '7d');
+	// empty means default retention
+	Retention string `json:",omitempty"`
+}
+
+var DefaultLogVerdicts = []*LogVerdictInfo{
+	{Key: LogVerdictUnknownKey, Name: "Unknown", Color: "light"},
+	{Key: LogVerdictHamKey, Name: "Interesting", Color: "success"},
+	{Key: LogVerdictSpamKey, Name: "Noise", Color: "secondary"},
+	{Key: "drop", Name: "Drop", Color: "danger", Retention: "0"},
+	{Key: "archive-short", Name: "Archive (short)", Color: "info", Retention: "7d"},
+	{Key: "security", Name: "Security", Color: "warning", Retention: "365d"},
+}
+
+// Configuration is assumed to be static, so this is set only on load
+var logVerdicts = DefaultLogVerdicts
+
+// SetLogVerdicts replaces the set of verdicts (nil restores the default set)
+func SetLogVerdicts(verdicts []*LogVerdictInfo) error {
+	if verdicts == nil {
+		logVerdicts = DefaultLogVerdicts
+		return nil
+	}
+	for i, key := range []string{LogVerdictUnknownKey, LogVerdictHamKey, LogVerdictSpamKey} {
+		if len(verdicts) <= i || verdicts[i].Key != key {
+			return ErrInvalidLogVerdicts
+		}
 	}
-	return "Unknown"
+	logVerdicts = verdicts
+	return nil
+}
+
+// LogVerdicts returns the configured verdicts; the index of a verdict
+// is its (int) value
+func LogVerdicts() []*LogVerdictInfo {
+	return logVerdicts
+}
+
+func LogVerdictInfoOf(verdict int) *LogVerdictInfo {
+	if verdict < 0 || verdict >= len(logVerdicts) {
+		return logVerdicts[LogVerdictUnknown]
+	}
+	return logVerdicts[verdict]
+}
+
+// LogVerdictFromKey returns the verdict with the given key, if any
+func LogVerdictFromKey(key string) (int, bool) {
+	for i, info := range logVerdicts {
+		if info.Key == key {
+			return i, true
+		}
+	}
+	return LogVerdictUnknown, false
+}
+
+func LogVerdictToString(verdict int) string {
+	return LogVerdictInfoOf(verdict).Name
 }
 
 func LogMatchesRule(log *Log, rule *LogRule) bool {
-	if rule.Disabled {
+	if rule.Disabled || !rule.ValidAt(log.Time) {
 		return false
 	}
-	for _, matcher := range rule.Matchers {
-		if matcher.Field == "" && matcher.Value == "" {
-			continue
-		}
-		value, ok := log.Stream[matcher.Field]
-		if !ok {
-			value, ok = log.Fields[matcher.Field].(string)
-			if !ok {
-				if matcher.Field != "message" {
-					return false
-				}
-				value = log.Message
-			}
+	return rule.matchersMatch(log)
+}
+
+// matchersMatch returns true if the matchers (and groups) of the rule
+// match the log, regardless of whether the rule is in effect
+func (self *LogRule) matchersMatch(log *Log) bool {
+	for i := range self.Matchers {
+		matcher := &self.Matchers[i]
+		if !matcher.empty() && !matcher.matchLog(log) {
+			return false
 		}
-		if !matcher.Match(value) {
+	}
+	for i := range self.Groups {
+		if !self.Groups[i].Match(log) {
 			return false
 		}
 	}
@@ -63,10 +135,8 @@ func LogToRule(log *Log, rules []*LogRule) *LogRule {
 
 func LogRuleToVerdict(rule *LogRule) int {
 	if rule != nil {
-		if rule.Ham {
-			return LogVerdictHam
-		}
-		return LogVerdictSpam
+		verdict, _ := LogVerdictFromKey(rule.VerdictKey())
+		return verdict
 	}
 	return LogVerdictUnknown
 }
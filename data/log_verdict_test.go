@@ -73,3 +73,108 @@ func TestLogVerdictRe(t *testing.T) {
 	verdict = LogVerdict(log, []*LogRule{&rule})
 	assert.Equal(t, verdict, LogVerdictUnknown)
 }
+
+func TestLogVerdictOps(t *testing.T) {
+	stream := map[string]string{
+		"f": "value",
+	}
+	log := NewLog(123, stream, `{"message": "Some Message", "status": "404", "took": "1500ms"}`)
+
+	cases := []struct {
+		field, op, value string
+		match            bool
+	}{
+		{"f", OpEqual, "value", true},
+		{"f", OpNotEqual, "value", false},
+		{"f", OpNotEqual, "other", true},
+		{"f", OpRegexp, "v.*", true},
+		{"f", OpNotRegexp, "v.*", false},
+		{"f", OpNotRegexp, "x.*", true},
+		{"message", OpContains, "Mess", true},
+		{"message", OpContains, "mess", false},
+		{"message", OpContainsFold, "mess", true},
+		{"message", OpPrefix, "Some", true},
+		{"message", OpPrefixFold, "some", true},
+		{"message", OpSuffix, "Message", true},
+		{"message", OpSuffixFold, "MESSAGE", true},
+		{"message", OpSuffix, "Some", false},
+		{"f", OpEqualFold, "VALUE", true},
+		{"status", OpExists, "", true},
+		{"status", OpNotExists, "", false},
+		{"missing", OpExists, "", false},
+		{"missing", OpNotExists, "", true},
+		{"missing", OpNotEqual, "x", true},
+		{"missing", OpEqual, "", false},
+		{"status", OpGreaterEqual, "400", true},
+		{"status", OpLess, "400", false},
+		{"status", OpLessEqual, "404", true},
+		{"status", OpGreater, "404", false},
+		{"took", OpGreater, "1s", true},
+		{"took", OpLess, "1.5", false},
+		{"f", OpLess, "1", false},
+		{"f", "unknown", "value", false},
+	}
+	for _, c := range cases {
+		rule := LogRule{Matchers: []LogFieldMatcher{{Field: c.field, Op: c.op, Value: c.value}}}
+		assert.Equal(t, LogMatchesRule(log, &rule), c.match, "%s %s %s", c.field, c.op, c.value)
+		rules := NewLogRules([]*LogRule{&rule}, 1)
+		assert.Equal(t, rules.brm.ToRule(log) != nil, c.match, "bulk %s %s %s", c.field, c.op, c.value)
+	}
+}
+
+func TestLogVerdictTyped(t *testing.T) {
+	log := NewLog(123, nil, `{"message": "msg", "status": 404, "ok": false, "empty": null, "http": {"method": "GET"}}`)
+
+	cases := []struct {
+		field, op, value string
+		match            bool
+	}{
+		{"status", OpEqual, "404", true},
+		{"status", OpEqual, "404.0", true},
+		{"status", OpNotEqual, "404", false},
+		{"status", OpEqual, "40", false},
+		{"status", OpGreater, "400", true},
+		{"status", OpPrefix, "40", true},
+		{"ok", OpEqual, "false", true},
+		{"ok", OpEqual, "0", false},
+		{"ok", OpEqual, "f", false},
+		{"ok", OpEqual, "true", false},
+		{"empty", OpEqual, "", true},
+		{"empty", OpEqual, "null", true},
+		{"empty", OpExists, "", true},
+		{"http.method", OpEqual, "GET", true},
+		{"http", OpContains, `"method"`, true},
+	}
+	for _, c := range cases {
+		rule := LogRule{Matchers: []LogFieldMatcher{{Field: c.field, Op: c.op, Value: c.value}}}
+		assert.Equal(t, LogMatchesRule(log, &rule), c.match, "%s %s %s", c.field, c.op, c.value)
+		rules := NewLogRules([]*LogRule{&rule}, 1)
+		assert.Equal(t, rules.brm.ToRule(log) != nil, c.match, "bulk %s %s %s", c.field, c.op, c.value)
+	}
+}
+
+func TestLogVerdicts(t *testing.T) {
+	assert.Equal(t, LogRuleToVerdict(nil), LogVerdictUnknown)
+	assert.Equal(t, LogRuleToVerdict(&LogRule{Ham: true}), LogVerdictHam)
+	assert.Equal(t, LogRuleToVerdict(&LogRule{}), LogVerdictSpam)
+
+	security, ok := LogVerdictFromKey("security")
+	assert.Assert(t, ok)
+	assert.Equal(t, LogRuleToVerdict(&LogRule{Verdict: "security"}), security)
+	assert.Equal(t, LogVerdictToString(security), "Security")
+
+	rule := LogRule{Verdict: "bogus", Matchers: []LogFieldMatcher{{Field: "message", Op: OpEqual}}}
+	assert.ErrorIs(t, rule.Validate(), ErrUnknownVerdict)
+	rule.Verdict = LogVerdictUnknownKey
+	assert.ErrorIs(t, rule.Validate(), ErrRuleVerdictUnknown)
+
+	assert.Equal(t, SetLogVerdicts([]*LogVerdictInfo{{Key: "ham"}}), ErrInvalidLogVerdicts)
+	err := SetLogVerdicts([]*LogVerdictInfo{{Key: "unknown"}, {Key: "ham"}, {Key: "spam"}, {Key: "x", Name: "X"}})
+	assert.NilError(t, err)
+	defer SetLogVerdicts(nil)
+	x, ok := LogVerdictFromKey("x")
+	assert.Assert(t, ok)
+	assert.Equal(t, x, 3)
+	_, ok = LogVerdictFromKey("security")
+	assert.Assert(t, !ok)
+}
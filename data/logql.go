@@ -0,0 +1,459 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ LogQL (Grafana Loki) filter generation.
+
+ The rules are converted to a LogQL pipeline, which drops the logs
+whose verdict would be one of the dropped ones (spam by default), so
+that Loki itself filters out the known spam. The first matching rule
+determines the verdict as usual: a log is kept if some earlier rule
+with other verdict matches it, so the pipeline is a single label
+filter expression, which is linear in the number of the rules.
+
+ The fields used by the rules are extracted to temporary labels
+(lixie_N) with the json parser; stream labels take precedence, as in
+Lixie, and the message defaults to the whole line. The temporary
+labels are dropped at the end, so the streams look the same as without
+the filter.
+
+ LogQL label filters cannot tell empty labels from missing ones, so
+empty values are treated as absent. Rules which cannot be expressed
+(numeric comparisons, validity periods of dropped rules) are handled
+conservatively: dropping rules are left out, and other rules are
+assumed to match everything (and so the dropping rules after them are
+left out too).
+
+ The same pipeline (negated) is also the basis of the Loki ruler
+recording rules for the spam volume.
+*/
+
+package data
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logqlLabel matches valid label names
+var logqlLabel = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+type logqlNodeOp int
+
+const (
+	logqlFalse logqlNodeOp = iota
+	logqlTrue
+	logqlLeaf
+	logqlAnd
+	logqlOr
+	logqlNegation
+)
+
+// logqlNode is a boolean expression over the label filters; it is
+// needed as LogQL has no negation operator, so negations are pushed
+// down to the filters before rendering
+type logqlNode struct {
+	op logqlNodeOp
+
+	// Label filter, its negation, and the field (logqlLeaf)
+	filter, negated string
+	field           *exportField
+
+	subs []*logqlNode
+}
+
+func logqlConstant(value bool) *logqlNode {
+	if value {
+		return &logqlNode{op: logqlTrue}
+	}
+	return &logqlNode{op: logqlFalse}
+}
+
+func logqlNot(node *logqlNode) *logqlNode {
+	return &logqlNode{op: logqlNegation, subs: []*logqlNode{node}}
+}
+
+func logqlAndOr(op logqlNodeOp, subs ...*logqlNode) *logqlNode {
+	return &logqlNode{op: op, subs: subs}
+}
+
+// normalize returns equivalent expression (negated, if requested)
+// without negations, with the constants eliminated (unless the whole
+// expression is constant)
+func (self *logqlNode) normalize(negated bool) *logqlNode {
+	switch self.op {
+	case logqlTrue, logqlFalse:
+		return logqlConstant((self.op == logqlTrue) != negated)
+	case logqlLeaf:
+		if negated {
+			return &logqlNode{op: logqlLeaf, filter: self.negated, negated: self.filter, field: self.field}
+		}
+		return self
+	case logqlNegation:
+		return self.subs[0].normalize(!negated)
+	}
+	op := self.op
+	if negated {
+		op = logqlAnd + logqlOr - op
+	}
+	// Identity element of the operation, and the absorbing one
+	identity, absorbing := logqlTrue, logqlFalse
+	if op == logqlOr {
+		identity, absorbing = logqlFalse, logqlTrue
+	}
+	result := logqlNode{op: op}
+	for _, sub := range self.subs {
+		sub = sub.normalize(negated)
+		switch sub.op {
+		case identity:
+			continue
+		case absorbing:
+			return sub
+		case op:
+			result.subs = append(result.subs, sub.subs...)
+		default:
+			result.subs = append(result.subs, sub)
+		}
+	}
+	switch len(result.subs) {
+	case 0:
+		return &logqlNode{op: identity}
+	case 1:
+		return result.subs[0]
+	}
+	return &result
+}
+
+// fields returns the fields of the filters, in order of the indexes
+func (self *logqlNode) fields() []*exportField {
+	var result []*exportField
+	var collect func(node *logqlNode)
+	collect = func(node *logqlNode) {
+		if node.field != nil && !slices.Contains(result, node.field) {
+			result = append(result, node.field)
+		}
+		for _, sub := range node.subs {
+			collect(sub)
+		}
+	}
+	collect(self)
+	slices.SortFunc(result, func(a, b *exportField) int { return a.index - b.index })
+	return result
+}
+
+// render returns the normalized expression as label filter expression
+func (self *logqlNode) render() string {
+	if self.op == logqlLeaf {
+		return self.filter
+	}
+	join := " and "
+	if self.op == logqlOr {
+		join = " or "
+	}
+	var parts []string
+	for _, sub := range self.subs {
+		if sub.op == logqlLeaf {
+			parts = append(parts, sub.render())
+		} else {
+			parts = append(parts, "("+sub.render()+")")
+		}
+	}
+	return strings.Join(parts, join)
+}
+
+type logqlWriter struct {
+	fields exportFields
+
+	// First error of the current rule
+	err error
+}
+
+func logqlLabelName(field *exportField) string {
+	return fmt.Sprintf("lixie_%d", field.index)
+}
+
+// logqlPresent returns filter which is true if the field is present
+// (and not empty)
+func logqlPresent(field *exportField) *logqlNode {
+	label := logqlLabelName(field)
+	return &logqlNode{op: logqlLeaf, filter: label + `!=""`, negated: label + `=""`, field: field}
+}
+
+// logqlRegexpLeaf returns the filter on the field for the (RE2, fully
+// anchored) regexp; empty values are treated as absent
+func (self *logqlWriter) regexpLeaf(field *exportField, expr string) *logqlNode {
+	label := logqlLabelName(field)
+	leaf := &logqlNode{
+		op:      logqlLeaf,
+		filter:  fmt.Sprintf("%s=~%s", label, strconv.Quote(expr)),
+		negated: fmt.Sprintf("%s!~%s", label, strconv.Quote(expr)),
+		field:   field,
+	}
+	if !regexp.MustCompile("^(?:" + expr + ")$").MatchString("") {
+		return leaf
+	}
+	return logqlAndOr(logqlAnd, logqlPresent(field), leaf)
+}
+
+// logqlRegexp returns the fully anchored equivalent of the regexp of
+// OpRegexp
+func logqlRegexp(value string) string {
+	expr := "^" + value + "$"
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err == nil && re.Op == syntax.OpConcat && len(re.Sub) > 1 &&
+		re.Sub[0].Op == syntax.OpBeginText && re.Sub[len(re.Sub)-1].Op == syntax.OpEndText {
+		return value
+	}
+	// Top-level alternation; match anywhere
+	return "(?s:.*)(?:" + expr + ")(?s:.*)"
+}
+
+// positive returns the filter for the positive operations on present
+// fields
+func (self *logqlWriter) positive(field *exportField, matcher *LogFieldMatcher) *logqlNode {
+	quoted := regexp.QuoteMeta(matcher.Value)
+	switch matcher.Op {
+	case OpEqual:
+		if matcher.Value == "" {
+			return logqlConstant(false)
+		}
+		label := logqlLabelName(field)
+		return &logqlNode{
+			op:      logqlLeaf,
+			filter:  fmt.Sprintf("%s=%s", label, strconv.Quote(matcher.Value)),
+			negated: fmt.Sprintf("%s!=%s", label, strconv.Quote(matcher.Value)),
+			field:   field,
+		}
+	case OpEqualFold:
+		return self.regexpLeaf(field, "(?i)"+quoted)
+	case OpRegexp:
+		return self.regexpLeaf(field, logqlRegexp(matcher.Value))
+	case OpContains:
+		return self.regexpLeaf(field, "(?s).*"+quoted+".*")
+	case OpContainsFold:
+		return self.regexpLeaf(field, "(?is).*"+quoted+".*")
+	case OpPrefix:
+		return self.regexpLeaf(field, "(?s)"+quoted+".*")
+	case OpPrefixFold:
+		return self.regexpLeaf(field, "(?is)"+quoted+".*")
+	case OpSuffix:
+		return self.regexpLeaf(field, "(?s).*"+quoted)
+	case OpSuffixFold:
+		return self.regexpLeaf(field, "(?is).*"+quoted)
+	}
+	if self.err == nil {
+		self.err = fmt.Errorf("%w: %q", ErrExportUnsupported, matcher.Op)
+	}
+	return logqlConstant(false)
+}
+
+func (self *logqlWriter) matcher(matcher *LogFieldMatcher) *logqlNode {
+	op, ok := logFieldOps[matcher.Op]
+	if !ok {
+		return logqlConstant(false)
+	}
+	field := self.fields.field(matcher.Field)
+	present := logqlPresent(field)
+	if _, err := op.compile(matcher.Value); err != nil {
+		if op.absent {
+			return logqlNot(present)
+		}
+		return logqlConstant(false)
+	}
+	positive := *matcher
+	switch matcher.Op {
+	case OpExists:
+		return present
+	case OpNotExists:
+		return logqlNot(present)
+	case OpNotEqual:
+		positive.Op = OpEqual
+	case OpNotRegexp:
+		positive.Op = OpRegexp
+	}
+	node := self.positive(field, &positive)
+	if positive.Op != matcher.Op {
+		return logqlNot(node)
+	}
+	return node
+}
+
+func (self *logqlWriter) group(group *LogMatcherGroup) *logqlNode {
+	var subs []*logqlNode
+	for i := range group.Matchers {
+		if !group.Matchers[i].empty() {
+			subs = append(subs, self.matcher(&group.Matchers[i]))
+		}
+	}
+	for i := range group.Groups {
+		if !group.Groups[i].Empty() {
+			subs = append(subs, self.group(&group.Groups[i]))
+		}
+	}
+	switch group.Op {
+	case GroupAnd:
+		return logqlAndOr(logqlAnd, subs...)
+	case GroupOr:
+		return logqlAndOr(logqlOr, subs...)
+	case GroupNot:
+		return logqlNot(logqlAndOr(logqlAnd, subs...))
+	}
+	return logqlConstant(false)
+}
+
+// rule returns the expression of the rule, or an error if it cannot
+// be expressed
+func (self *logqlWriter) rule(rule *LogRule) (*logqlNode, error) {
+	self.err = nil
+	group := rule.group()
+	node := self.group(&group)
+	return node, self.err
+}
+
+// jsonPath returns the json parser expression for the field
+func logqlJSONPath(name string) string {
+	var b strings.Builder
+	for _, part := range exportPath(name) {
+		switch {
+		case part.isIndex:
+			fmt.Fprintf(&b, "[%d]", part.index)
+		case logqlLabel.MatchString(part.name):
+			if b.Len() > 0 {
+				b.WriteString(".")
+			}
+			b.WriteString(part.name)
+		default:
+			fmt.Fprintf(&b, "[%s]", strconv.Quote(part.name))
+		}
+	}
+	return b.String()
+}
+
+// LogQLFilter is the generated filter; the keep expression is true for
+// the logs which are kept
+type LogQLFilter struct {
+	// Rules which could not be exported
+	Skipped []string
+
+	keep *logqlNode
+}
+
+// LogQLFilter converts the rules to LogQL filter which drops the logs
+// with verdicts in options.Drop (default: spam)
+func (self *LogRules) LogQLFilter(now time.Time, options ExportOptions) *LogQLFilter {
+	drop := options.Drop
+	if len(drop) == 0 {
+		drop = []string{LogVerdictSpamKey}
+	}
+	rules := self.exportRules(now)
+	var w logqlWriter
+	var result LogQLFilter
+	// Built from the last rule backwards: a dropping rule drops the
+	// logs it matches, other rules keep the logs they match
+	var nodes []*logqlNode
+	var dropping []bool
+	for i, rule := range rules {
+		dropped := slices.Contains(drop, rule.VerdictKey())
+		node, err := w.rule(rule)
+		if err == nil && dropped && (rule.ValidFrom != nil || rule.ValidUntil != nil) {
+			err = fmt.Errorf("%w: validity period", ErrExportUnsupported)
+		}
+		if err != nil && dropped {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("rule #%d: %s", rule.ID, err))
+			continue
+		}
+		if err != nil {
+			// The rule may match anything, so it keeps everything
+			// the later rules would drop
+			for _, later := range rules[i+1:] {
+				if slices.Contains(drop, later.VerdictKey()) {
+					result.Skipped = append(result.Skipped, fmt.Sprintf("rule #%d: after rule #%d: %s", later.ID, rule.ID, err))
+				}
+			}
+			break
+		}
+		nodes = append(nodes, node)
+		dropping = append(dropping, dropped)
+	}
+	keep := logqlConstant(true)
+	for i := len(nodes) - 1; i >= 0; i-- {
+		if dropping[i] {
+			keep = logqlAndOr(logqlAnd, logqlNot(nodes[i]), keep)
+		} else {
+			keep = logqlAndOr(logqlOr, nodes[i], keep)
+		}
+	}
+	result.keep = keep.normalize(false)
+	return &result
+}
+
+// pipeline returns the pipeline stages which keep the logs (or drop
+// them, if negated); empty string if there is nothing to filter
+func (self *LogQLFilter) pipeline(negated bool) string {
+	expr := self.keep.normalize(negated)
+	switch expr.op {
+	case logqlTrue:
+		return ""
+	case logqlFalse:
+		// Nothing passes; the labels are never set
+		return `| lixie_never="never"`
+	}
+	var extract, format, labels []string
+	for _, field := range expr.fields() {
+		label := logqlLabelName(field)
+		labels = append(labels, label)
+		extract = append(extract, fmt.Sprintf("%s=%s", label, strconv.Quote(logqlJSONPath(field.name))))
+		// Stream labels (which may not contain dots) take precedence
+		var sources []string
+		if logqlLabel.MatchString(field.name) {
+			sources = append(sources, "."+field.name)
+		}
+		sources = append(sources, "."+label)
+		if field.name == "message" {
+			sources = append(sources, "__line__")
+		}
+		if len(sources) > 1 {
+			format = append(format, fmt.Sprintf("%s=%s", label, strconv.Quote("{{ or "+strings.Join(sources, " ")+" }}")))
+		}
+	}
+	var stages []string
+	if len(extract) > 0 {
+		stages = append(stages, "| json "+strings.Join(extract, ", "))
+	}
+	if len(format) > 0 {
+		stages = append(stages, "| label_format "+strings.Join(format, ", "))
+	}
+	stages = append(stages, "| "+expr.render())
+	labels = append(labels, "__error__", "__error_details__")
+	stages = append(stages, "| drop "+strings.Join(labels, ", "))
+	return strings.Join(stages, " ")
+}
+
+// Keep returns the pipeline stages which keep only the logs which
+// are not dropped
+func (self *LogQLFilter) Keep() string {
+	return self.pipeline(false)
+}
+
+// Dropped returns the pipeline stages which keep only the logs which
+// are dropped
+func (self *LogQLFilter) Dropped() string {
+	return self.pipeline(true)
+}
+
+// LogQLFilter converts the current ruleset to LogQL filter
+func (self *Database) LogQLFilter(options ExportOptions) *LogQLFilter {
+	self.Lock()
+	defer self.Unlock()
+
+	return self.LogRules.LogQLFilter(time.Now(), options)
+}
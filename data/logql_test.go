@@ -0,0 +1,111 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package data
+
+import (
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+var logqlTestFilter = regexp.MustCompile(`^(lixie_\d+)(=~|!~|!=|=)(".*")$`)
+
+// logqlEval evaluates the normalized expression the way Loki would,
+// given the values of the labels
+func logqlEval(t *testing.T, node *logqlNode, labels map[string]string) bool {
+	switch node.op {
+	case logqlTrue, logqlFalse:
+		return node.op == logqlTrue
+	case logqlAnd, logqlOr:
+		for _, sub := range node.subs {
+			if logqlEval(t, sub, labels) == (node.op == logqlOr) {
+				return node.op == logqlOr
+			}
+		}
+		return node.op == logqlAnd
+	}
+	m := logqlTestFilter.FindStringSubmatch(node.filter)
+	assert.Assert(t, m != nil, node.filter)
+	value, err := strconv.Unquote(m[3])
+	assert.Equal(t, err, nil)
+	label := labels[m[1]]
+	switch m[2] {
+	case "=":
+		return label == value
+	case "!=":
+		return label != value
+	}
+	matched := regexp.MustCompile("^(?:" + value + ")$").MatchString(label)
+	return matched == (m[2] == "=~")
+}
+
+func TestLogQLFilter(t *testing.T) {
+	now := time.Now()
+	rules := NewLogRules([]*LogRule{
+		{ID: 1, Matchers: []LogFieldMatcher{{Field: "source", Op: OpEqual, Value: "cron"}}},
+		{ID: 2, Ham: true, Matchers: []LogFieldMatcher{{Field: "message", Op: OpContainsFold, Value: "ERROR"}}},
+		{ID: 3, Matchers: []LogFieldMatcher{{Field: "message", Op: OpRegexp, Value: `x|y+`}}},
+		{ID: 4, Verdict: "drop", Matchers: []LogFieldMatcher{{Field: "user", Op: OpNotExists}}, Groups: []LogMatcherGroup{
+			{Op: GroupNot, Matchers: []LogFieldMatcher{{Field: "source", Op: OpPrefix, Value: "sys"}}},
+		}},
+		{ID: 5, Matchers: []LogFieldMatcher{{Field: "http.status", Op: OpNotEqual, Value: "200"}, {Field: "source", Op: OpSuffix, Value: ""}}},
+	}, 1)
+	filter := rules.LogQLFilter(now, ExportOptions{})
+	assert.Equal(t, len(filter.Skipped), 0)
+	fields := filter.keep.fields()
+	for _, data := range []string{
+		`{"message": "ok", "source": "cron"}`,
+		`{"message": "an Error", "source": "cron"}`,
+		`{"message": "yyy", "source": "kernel"}`,
+		`{"message": "xy", "source": "systemd"}`,
+		`{"message": "a", "source": "systemd"}`,
+		`{"message": "a", "source": "kernel", "user": "root"}`,
+		`{"message": "a", "source": "systemd", "user": "root", "http": {"status": 200}}`,
+		`{"message": "a", "source": "systemd", "user": "root", "http": {"status": 500}}`,
+		`{"message": "a", "user": "root"}`,
+		`plain x`,
+	} {
+		log := NewLog(0, nil, data)
+		labels := map[string]string{}
+		for _, field := range fields {
+			labels[logqlLabelName(field)], _ = log.FieldString(field.name)
+		}
+		rule := LogToRule(log, rules.Ordered)
+		dropped := rule != nil && rule.VerdictKey() == LogVerdictSpamKey
+		assert.Equal(t, logqlEval(t, filter.keep, labels), !dropped, data)
+		assert.Equal(t, logqlEval(t, filter.keep.normalize(true), labels), dropped, data)
+	}
+
+	// Rules are evaluated in the order of descending IDs
+	assert.Equal(t, filter.Keep(), `| json lixie_0="http.status", lixie_1="source", lixie_2="user", lixie_3="message" | `+
+		`label_format lixie_1="{{ or .source .lixie_1 }}", lixie_2="{{ or .user .lixie_2 }}", lixie_3="{{ or .message .lixie_3 __line__ }}" | `+
+		`(lixie_0="200" or lixie_1="" or lixie_1!~"(?s).*") and ((lixie_2="" and lixie_1!~"(?s)sys.*") or `+
+		`(lixie_3!~"(?s:.*)(?:^x|y+$)(?s:.*)" and (lixie_3=~"(?is).*ERROR.*" or lixie_1!="cron"))) | `+
+		`drop lixie_0, lixie_1, lixie_2, lixie_3, __error__, __error_details__`)
+}
+
+func TestLogQLFilterUnsupported(t *testing.T) {
+	future := time.Now().Add(time.Hour)
+	rules := NewLogRules([]*LogRule{
+		{ID: 1, Matchers: []LogFieldMatcher{{Field: "source", Op: OpEqual, Value: "b"}}},
+		{ID: 2, Ham: true, Matchers: []LogFieldMatcher{{Field: "latency", Op: OpLess, Value: "3"}}},
+		{ID: 3, Matchers: []LogFieldMatcher{{Field: "level", Op: OpGreater, Value: "3"}}},
+		{ID: 4, ValidUntil: &future, Matchers: []LogFieldMatcher{{Field: "source", Op: OpEqual, Value: "a"}}},
+	}, 1)
+	filter := rules.LogQLFilter(time.Now(), ExportOptions{})
+	assert.DeepEqual(t, filter.Skipped, []string{
+		`rule #4: not supported by the export target: validity period`,
+		`rule #3: not supported by the export target: ">"`,
+		`rule #1: after rule #2: not supported by the export target: "<"`,
+	})
+	assert.Equal(t, filter.Keep(), "")
+	assert.Equal(t, filter.Dropped(), `| lixie_never="never"`)
+}
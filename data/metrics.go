@@ -0,0 +1,166 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Prometheus metrics of the database.
+
+ The metrics are updated as the logs are fetched and the ruleset
+changes, and they have their own lock, so that scraping them does not
+need to wait for the database lock (which is held while the logs are
+fetched from the source).
+*/
+
+package data
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	fetchDurationBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+	buildDurationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+)
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsHistogram counts observations in the given buckets (upper
+// bounds, without the implicit +Inf)
+type metricsHistogram struct {
+	// Per bucket (non-cumulative), the last one is +Inf
+	counts []uint64
+	sum    float64
+}
+
+func (self *metricsHistogram) observe(buckets []float64, value float64) {
+	if self.counts == nil {
+		self.counts = make([]uint64, len(buckets)+1)
+	}
+	i, _ := slices.BinarySearch(buckets, value)
+	self.counts[i]++
+	self.sum += value
+}
+
+func (self *metricsHistogram) write(w io.Writer, buckets []float64, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var count uint64
+	for i, bucket := range buckets {
+		if self.counts != nil {
+			count += self.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bucket, 'g', -1, 64), count)
+	}
+	if self.counts != nil {
+		count += self.counts[len(buckets)]
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(self.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+}
+
+type ingestKey struct {
+	source, verdict string
+}
+
+type databaseMetrics struct {
+	sync.Mutex
+
+	ingested    map[ingestKey]uint64
+	ruleHits    map[int]uint64
+	unknownLogs int
+
+	fetchErrors   uint64
+	fetchDuration metricsHistogram
+
+	buildDuration metricsHistogram
+	rulesVersion  int
+}
+
+func (self *databaseMetrics) fetched(duration time.Duration, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	self.fetchDuration.observe(fetchDurationBuckets, duration.Seconds())
+	if err != nil {
+		self.fetchErrors++
+	}
+}
+
+// addLogs counts the newly fetched logs
+func (self *databaseMetrics) addLogs(ingested []ingestedLog) {
+	self.Lock()
+	defer self.Unlock()
+
+	if self.ingested == nil {
+		self.ingested = make(map[ingestKey]uint64)
+		self.ruleHits = make(map[int]uint64)
+	}
+	for _, entry := range ingested {
+		key := ingestKey{source: entry.log.Stream["source"], verdict: LogVerdictInfoOf(entry.verdict).Key}
+		self.ingested[key]++
+		if entry.rule != nil {
+			self.ruleHits[entry.rule.ID]++
+		}
+	}
+}
+
+func (self *databaseMetrics) setUnknownLogs(count int) {
+	self.Lock()
+	defer self.Unlock()
+
+	self.unknownLogs = count
+}
+
+func (self *databaseMetrics) published(version int, build time.Duration) {
+	self.Lock()
+	defer self.Unlock()
+
+	self.rulesVersion = version
+	self.buildDuration.observe(buildDurationBuckets, build.Seconds())
+}
+
+func (self *databaseMetrics) write(w io.Writer) {
+	self.Lock()
+	defer self.Unlock()
+
+	fmt.Fprintf(w, "# HELP lixie_logs_ingested_total Logs fetched from the source.\n# TYPE lixie_logs_ingested_total counter\n")
+	keys := SortedKeysWithFunc(self.ingested, func(a, b ingestKey) int {
+		return cmp.Or(strings.Compare(a.source, b.source), strings.Compare(a.verdict, b.verdict))
+	})
+	for _, key := range keys {
+		fmt.Fprintf(w, "lixie_logs_ingested_total{source=\"%s\",verdict=\"%s\"} %d\n",
+			metricsLabelEscaper.Replace(key.source), metricsLabelEscaper.Replace(key.verdict), self.ingested[key])
+	}
+
+	fmt.Fprintf(w, "# HELP lixie_rule_hits_total Fetched logs matched by the rule.\n# TYPE lixie_rule_hits_total counter\n")
+	for _, rid := range SortedKeysWithFunc(self.ruleHits, cmp.Compare) {
+		fmt.Fprintf(w, "lixie_rule_hits_total{rule=\"%d\"} %d\n", rid, self.ruleHits[rid])
+	}
+
+	fmt.Fprintf(w, "# HELP lixie_unknown_logs Logs in the buffer without a verdict.\n# TYPE lixie_unknown_logs gauge\n")
+	fmt.Fprintf(w, "lixie_unknown_logs %d\n", self.unknownLogs)
+
+	fmt.Fprintf(w, "# HELP lixie_source_fetch_errors_total Failed fetches from the source.\n# TYPE lixie_source_fetch_errors_total counter\n")
+	fmt.Fprintf(w, "lixie_source_fetch_errors_total %d\n", self.fetchErrors)
+	self.fetchDuration.write(w, fetchDurationBuckets, "lixie_source_fetch_duration_seconds", "Duration of the fetches from the source.")
+
+	self.buildDuration.write(w, buildDurationBuckets, "lixie_matcher_build_duration_seconds", "Duration of building the rule matcher.")
+
+	fmt.Fprintf(w, "# HELP lixie_ruleset_version Version of the ruleset.\n# TYPE lixie_ruleset_version gauge\n")
+	fmt.Fprintf(w, "lixie_ruleset_version %d\n", self.rulesVersion)
+}
+
+// WriteMetrics writes the metrics in the Prometheus text format
+func (self *Database) WriteMetrics(w io.Writer) {
+	self.metrics.write(w)
+}
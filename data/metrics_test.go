@@ -0,0 +1,68 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package data
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+type failingSource struct{}
+
+func (self *failingSource) Load() ([]*Log, error) {
+	return nil, errors.New("unavailable")
+}
+
+func TestDatabaseMetrics(t *testing.T) {
+	path := "test_db.json"
+	_ = os.Remove(path)
+
+	logs := []*Log{
+		NewLog(1, map[string]string{"source": "cron"}, "a"),
+		NewLog(2, map[string]string{"source": "cron"}, "b"),
+		NewLog(3, map[string]string{"source": `x"y`}, "a"),
+	}
+	db := Database{Path: path, Source: &ArraySource{Data: logs, Chunk: 2}}
+	assert.Equal(t, db.Add(LogRule{Matchers: []LogFieldMatcher{{Field: "message", Op: OpEqual, Value: "a"}}}), nil)
+	for range 2 {
+		_, err := db.Logs()
+		assert.Equal(t, err, nil)
+	}
+	db.Source = &failingSource{}
+	_, err := db.Logs()
+	assert.Assert(t, err != nil)
+
+	var b strings.Builder
+	db.WriteMetrics(&b)
+	metrics := b.String()
+	for _, line := range []string{
+		`lixie_logs_ingested_total{source="cron",verdict="spam"} 1`,
+		`lixie_logs_ingested_total{source="cron",verdict="unknown"} 1`,
+		`lixie_logs_ingested_total{source="x\"y",verdict="spam"} 1`,
+		`lixie_rule_hits_total{rule="1"} 2`,
+		`lixie_unknown_logs 1`,
+		`lixie_source_fetch_errors_total 1`,
+		`lixie_source_fetch_duration_seconds_bucket{le="+Inf"} 3`,
+		`lixie_source_fetch_duration_seconds_count 3`,
+		`lixie_matcher_build_duration_seconds_count 1`,
+		`lixie_ruleset_version 1`,
+	} {
+		assert.Assert(t, strings.Contains(metrics, line+"\n"), "%s missing from\n%s", line, metrics)
+	}
+
+	// Ruleset change updates the unknown logs without a fetch
+	assert.Equal(t, db.Add(LogRule{Matchers: []LogFieldMatcher{{Field: "message", Op: OpEqual, Value: "b"}}}), nil)
+	b.Reset()
+	db.WriteMetrics(&b)
+	metrics = b.String()
+	assert.Assert(t, strings.Contains(metrics, "lixie_unknown_logs 0\n"), metrics)
+}
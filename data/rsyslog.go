@@ -0,0 +1,491 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ rsyslog (https://www.rsyslog.com) RainerScript generation.
+
+ The ruleset is converted to RainerScript statements to be included
+within the ruleset processing the logs. They set the lixie JSON
+property ($!lixie) to the verdict key of the first matching rule (and
+$!lixie_rule to its ID, and $!lixie_retention to the retention hint of
+the verdict, if any), or stop the processing of the message if the
+verdict is one of the dropped ones. See export.go for the rules which
+are exported; rate conditions are not supported.
+
+ RainerScript is much more limited than the other targets, so the
+output is an approximation:
+
+ - Field names map to JSON properties ($!a!b for a.b), except for the
+message which maps to $msg; ExportOptions.Fields may map fields to
+any properties (e.g. $hostname). Array indexes are not supported.
+
+ - Values are compared in the string form rsyslog gives them, which is
+the canonical one only for strings and integers.
+
+ - Regexps are converted to POSIX EREs, which lack some of the RE2
+features (e.g. line anchors, word boundaries, and non-ASCII character
+classes). Case-insensitive operations fold only ASCII letters.
+
+ - Numeric comparisons work only with integer values.
+
+ - Validity periods are checked against the processing time.
+
+ Rules that cannot be converted are left out (with a comment).
+*/
+
+package data
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// rsyslogPathPart matches the JSON property names usable as is
+var rsyslogPathPart = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+const rsyslogMatched = "$.lixie_matched"
+
+func rsyslogString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := range len(s) {
+		c := s[i]
+		switch c {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// rsyslogEREMeta are the characters which are special outside
+// bracket expressions
+const rsyslogEREMeta = `\.[]()*+?{}|^$`
+
+func rsyslogEREQuote(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(rsyslogEREMeta, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// rsyslogBracket returns the bracket expression of the (ASCII) rune
+// ranges
+func rsyslogBracket(ranges []rune, negated bool) string {
+	var specials []rune
+	var b strings.Builder
+	for i := 0; i < len(ranges); i += 2 {
+		lo, hi := ranges[i], ranges[i+1]
+		// Characters special within brackets are written separately
+		for lo <= hi && strings.ContainsRune(`]^-[`, lo) {
+			specials = append(specials, lo)
+			lo++
+		}
+		for lo <= hi && strings.ContainsRune(`]^-[`, hi) {
+			specials = append(specials, hi)
+			hi--
+		}
+		switch {
+		case lo > hi:
+		case lo == hi:
+			b.WriteRune(lo)
+		case lo+1 == hi:
+			b.WriteRune(lo)
+			b.WriteRune(hi)
+		default:
+			fmt.Fprintf(&b, "%c-%c", lo, hi)
+		}
+	}
+	// ] must be first, [ is followed by ^, - or ], and - must be last
+	var result strings.Builder
+	result.WriteByte('[')
+	if negated {
+		result.WriteByte('^')
+	}
+	if slices.Contains(specials, ']') {
+		result.WriteByte(']')
+	}
+	result.WriteString(b.String())
+	for _, special := range []rune(`[^-`) {
+		if slices.Contains(specials, special) {
+			result.WriteRune(special)
+		}
+	}
+	result.WriteByte(']')
+	if result.String() == "[^]" {
+		return `\^`
+	}
+	return result.String()
+}
+
+// rsyslogClass converts the character class; negated classes (which
+// contain all of the non-ASCII runes) are written as negations
+func rsyslogClass(ranges []rune) (string, error) {
+	if len(ranges) > 0 && ranges[len(ranges)-1] == unicode.MaxRune {
+		// Complement within ASCII
+		var complement []rune
+		next := rune(0)
+		for i := 0; i < len(ranges); i += 2 {
+			if ranges[i] > next {
+				complement = append(complement, next, ranges[i]-1)
+			}
+			next = ranges[i+1] + 1
+		}
+		if len(complement) == 0 {
+			return ".", nil
+		}
+		if complement[len(complement)-1] > unicode.MaxASCII {
+			return "", fmt.Errorf("%w: non-ASCII character class", ErrExportUnsupported)
+		}
+		return rsyslogBracket(complement, true), nil
+	}
+	if len(ranges) == 0 {
+		return "", fmt.Errorf("%w: empty character class", ErrExportUnsupported)
+	}
+	if ranges[len(ranges)-1] > unicode.MaxASCII {
+		return "", fmt.Errorf("%w: non-ASCII character class", ErrExportUnsupported)
+	}
+	return rsyslogBracket(ranges, false), nil
+}
+
+// rsyslogAtom returns true if the ERE of the regexp can be repeated as is
+func rsyslogAtom(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return len(re.Rune) == 1
+	case syntax.OpCharClass, syntax.OpAnyChar, syntax.OpAnyCharNotNL, syntax.OpCapture:
+		return true
+	}
+	return false
+}
+
+// rsyslogERE converts the regexp to POSIX ERE
+func rsyslogERE(re *syntax.Regexp) (string, error) {
+	switch re.Op {
+	case syntax.OpEmptyMatch:
+		return "()", nil
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase == 0 {
+			return rsyslogEREQuote(string(re.Rune)), nil
+		}
+		var b strings.Builder
+		for _, r := range re.Rune {
+			switch {
+			case r > unicode.MaxASCII && unicode.SimpleFold(r) != r:
+				return "", fmt.Errorf("%w: non-ASCII case folding", ErrExportUnsupported)
+			case unicode.IsLetter(r):
+				fmt.Fprintf(&b, "[%c%c]", unicode.ToUpper(r), unicode.ToLower(r))
+			default:
+				b.WriteString(rsyslogEREQuote(string(r)))
+			}
+		}
+		return b.String(), nil
+	case syntax.OpCharClass:
+		return rsyslogClass(re.Rune)
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return ".", nil
+	case syntax.OpBeginText:
+		return "^", nil
+	case syntax.OpEndText:
+		return "$", nil
+	case syntax.OpCapture:
+		sub, err := rsyslogERE(re.Sub[0])
+		if err != nil || re.Sub[0].Op == syntax.OpAlternate {
+			// Alternations are already within parentheses
+			return sub, err
+		}
+		return "(" + sub + ")", nil
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		sub, err := rsyslogERE(re.Sub[0])
+		if err != nil {
+			return "", err
+		}
+		if !rsyslogAtom(re.Sub[0]) {
+			sub = "(" + sub + ")"
+		}
+		switch re.Op {
+		case syntax.OpStar:
+			return sub + "*", nil
+		case syntax.OpPlus:
+			return sub + "+", nil
+		case syntax.OpQuest:
+			return sub + "?", nil
+		}
+		if re.Max < 0 {
+			return fmt.Sprintf("%s{%d,}", sub, re.Min), nil
+		}
+		return fmt.Sprintf("%s{%d,%d}", sub, re.Min, re.Max), nil
+	case syntax.OpConcat, syntax.OpAlternate:
+		var parts []string
+		for _, sub := range re.Sub {
+			part, err := rsyslogERE(sub)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, part)
+		}
+		if re.Op == syntax.OpConcat {
+			return strings.Join(parts, ""), nil
+		}
+		return "(" + strings.Join(parts, "|") + ")", nil
+	}
+	return "", fmt.Errorf("%w: regexp operation %v", ErrExportUnsupported, re.Op)
+}
+
+type rsyslogSyntax struct {
+	options *ExportOptions
+
+	// First error of the current rule (unsupported fields)
+	err error
+}
+
+// variable returns the property of the field
+func (self *rsyslogSyntax) variable(field *exportField) string {
+	name := field.name
+	if target, ok := self.options.Fields[name]; ok {
+		if strings.HasPrefix(target, "$") {
+			return target
+		}
+		name = target
+	} else if name == "message" {
+		return "$msg"
+	}
+	var b strings.Builder
+	b.WriteString("$")
+	for _, part := range exportPath(name) {
+		if part.isIndex || !rsyslogPathPart.MatchString(part.name) {
+			if self.err == nil {
+				self.err = fmt.Errorf("%w: field %q", ErrExportUnsupported, field.name)
+			}
+			return `$!""`
+		}
+		b.WriteString("!" + part.name)
+	}
+	return b.String()
+}
+
+func (self *rsyslogSyntax) and(exprs []string) string {
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	return "(" + strings.Join(exprs, " and ") + ")"
+}
+
+func (self *rsyslogSyntax) or(exprs []string) string {
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	return "(" + strings.Join(exprs, " or ") + ")"
+}
+
+func (self *rsyslogSyntax) not(expr string) string {
+	if parenthesized(expr, `"`) {
+		return "not " + expr
+	}
+	return "not (" + expr + ")"
+}
+
+func (self *rsyslogSyntax) constant(value bool) string {
+	if value {
+		return "1"
+	}
+	return "0"
+}
+
+// JSON properties may be absent; others are always present
+func (self *rsyslogSyntax) present(field *exportField) string {
+	variable := self.variable(field)
+	if !strings.HasPrefix(variable, "$!") && !strings.HasPrefix(variable, "$.") && !strings.HasPrefix(variable, "$/") {
+		return self.constant(true)
+	}
+	return fmt.Sprintf("exists(%s)", variable)
+}
+
+func (self *rsyslogSyntax) guard(field *exportField, expr string, absent bool) string {
+	present := self.present(field)
+	if present == self.constant(true) {
+		return expr
+	}
+	if absent {
+		return fmt.Sprintf("(not %s or %s)", present, expr)
+	}
+	return fmt.Sprintf("(%s and %s)", present, expr)
+}
+
+func (self *rsyslogSyntax) regexp(variable, expr string) (string, error) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return "", err
+	}
+	ere, err := rsyslogERE(re)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("re_match(%s, %s)", variable, rsyslogString(ere)), nil
+}
+
+// rsyslogInteger returns the integer bound equivalent to the float one
+// for comparisons of integers
+func rsyslogInteger(op string, bound float64) string {
+	switch op {
+	case OpLess, OpGreaterEqual:
+		bound = math.Ceil(bound)
+	default:
+		bound = math.Floor(bound)
+	}
+	return strconv.FormatFloat(bound, 'f', 0, 64)
+}
+
+func (self *rsyslogSyntax) match(field *exportField, matcher *LogFieldMatcher) (string, error) {
+	variable := self.variable(field)
+	value := rsyslogString(matcher.Value)
+	switch matcher.Op {
+	case OpEqual:
+		return fmt.Sprintf("%s == %s", variable, value), nil
+	case OpEqualFold:
+		return fmt.Sprintf("tolower(%s) == %s", variable, rsyslogString(asciiLower(matcher.Value))), nil
+	case OpRegexp:
+		return self.regexp(variable, "^"+matcher.Value+"$")
+	case OpContains:
+		return fmt.Sprintf("%s contains %s", variable, value), nil
+	case OpContainsFold:
+		return fmt.Sprintf("%s contains_i %s", variable, value), nil
+	case OpPrefix:
+		return fmt.Sprintf("%s startswith %s", variable, value), nil
+	case OpPrefixFold:
+		return fmt.Sprintf("%s startswith_i %s", variable, value), nil
+	case OpSuffix:
+		return fmt.Sprintf("re_match(%s, %s)", variable, rsyslogString(rsyslogEREQuote(matcher.Value)+"$")), nil
+	case OpSuffixFold:
+		return fmt.Sprintf("re_match(tolower(%s), %s)", variable, rsyslogString(rsyslogEREQuote(asciiLower(matcher.Value))+"$")), nil
+	case OpLess, OpLessEqual, OpGreater, OpGreaterEqual:
+		number, _ := parseNumber(matcher.Value)
+		return fmt.Sprintf(`(re_match(%s, "^[-+]?[0-9]+$") and cnum(%s) %s %s)`,
+			variable, variable, matcher.Op, rsyslogInteger(matcher.Op, number)), nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrExportUnsupported, matcher.Op)
+}
+
+func (self *rsyslogSyntax) validity(from, until *time.Time) string {
+	var exprs []string
+	if from != nil {
+		exprs = append(exprs, fmt.Sprintf("cnum($$now-unixtimestamp) >= %d", from.Unix()))
+	}
+	if until != nil {
+		exprs = append(exprs, fmt.Sprintf("cnum($$now-unixtimestamp) < %d", until.Unix()))
+	}
+	return strings.Join(exprs, " and ")
+}
+
+type rsyslogWriter struct {
+	exportWriter
+	syntax rsyslogSyntax
+	fields exportFields
+	drop   map[string]bool
+
+	// Rules which could not be exported
+	skipped []string
+}
+
+// verdict writes the statements for the verdict of the matching rule
+func (self *rsyslogWriter) verdict(key string, rule *LogRule) {
+	if self.drop[key] {
+		self.line("stop")
+		return
+	}
+	self.line("set $!lixie = %s;", rsyslogString(key))
+	if rule == nil {
+		return
+	}
+	self.line("set $!lixie_rule = %d;", rule.ID)
+	if retention := exportRetention(rule); retention != "" {
+		self.line("set $!lixie_retention = %s;", rsyslogString(retention))
+	}
+	self.line("set %s = 1;", rsyslogMatched)
+}
+
+func (self *rsyslogWriter) rules(rules []*LogRule) {
+	for _, rule := range rules {
+		self.syntax.err = nil
+		exprs, err := exportRuleExprs(&self.syntax, &self.fields, rule)
+		if err == nil {
+			err = self.syntax.err
+		}
+		if err != nil {
+			self.skipped = append(self.skipped, fmt.Sprintf("rule #%d: %s", rule.ID, err))
+			self.line("# Rule #%d skipped: %s", rule.ID, err)
+			continue
+		}
+		exprs = append([]string{rsyslogMatched + " == 0"}, exprs...)
+		self.open("if %s then {", strings.Join(exprs, " and "))
+		self.verdict(rule.VerdictKey(), rule)
+		self.close("}")
+	}
+}
+
+// RainerScript returns the ruleset as RainerScript statements; the
+// rules which could not be exported are also returned
+func (self *LogRules) RainerScript(now time.Time, options ExportOptions) (string, []string) {
+	rules := self.exportRules(now)
+	w := rsyslogWriter{syntax: rsyslogSyntax{options: &options}, drop: map[string]bool{}}
+	for _, key := range options.Drop {
+		w.drop[key] = true
+	}
+	w.line("# Generated by Lixie from %d rules; do not edit", len(rules))
+	w.line("set %s = 0;", rsyslogMatched)
+	for _, block := range exportBlocks(rules) {
+		if block.field == "" {
+			w.rules(block.rules)
+			continue
+		}
+		w.syntax.err = nil
+		variable := w.syntax.variable(w.fields.field(block.field))
+		for _, bucket := range block.buckets {
+			if w.syntax.err != nil {
+				// The rules are skipped, with the reason
+				w.rules(bucket.rules)
+				continue
+			}
+			w.open("if %s == 0 and %s == %s then {", rsyslogMatched, variable, rsyslogString(bucket.value))
+			w.rules(bucket.rules)
+			w.close("}")
+		}
+	}
+	w.open("if %s == 0 then {", rsyslogMatched)
+	w.verdict(LogVerdictUnknownKey, nil)
+	w.close("}")
+	return w.b.String(), w.skipped
+}
+
+// RainerScript returns the current ruleset as RainerScript statements
+func (self *Database) RainerScript(options ExportOptions) (string, []string) {
+	self.Lock()
+	defer self.Unlock()
+
+	return self.LogRules.RainerScript(time.Now(), options)
+}
@@ -0,0 +1,64 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package data
+
+import (
+	"regexp/syntax"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestRsyslogERE(t *testing.T) {
+	for expr, ere := range map[string]string{
+		`a.b+`:       `a.b+`,
+		`(ab)*c{2,}`: `(ab)*c{2,}`,
+		`x(a|bc)?`:   `x(a|bc)?`,
+		`[]a-c^-]`:   `[]a-c^-]`,
+		`[^\]\-]`:    `[^]-]`,
+		`[\^]`:       `\^`,
+		`[[-\]]`:     `[]\[]`,
+		`(?i)get /`:  `[Gg][Ee][Tt] /`,
+		`1\.0 \(x\)`: `1\.0 \(x\)`,
+		`^\d+$`:      `^[0-9]+$`,
+		`(?i:ab)+`:   `([Aa][Bb])+`,
+		`[ä-ö]x`:     "",
+		`\bx`:        "",
+		`(?i)ä`:      "",
+	} {
+		re, err := syntax.Parse(expr, syntax.Perl)
+		assert.Equal(t, err, nil)
+		result, err := rsyslogERE(re)
+		if ere == "" {
+			assert.ErrorIs(t, err, ErrExportUnsupported, expr)
+			continue
+		}
+		assert.Equal(t, err, nil, expr)
+		assert.Equal(t, result, ere, expr)
+	}
+}
+
+func TestLogRulesRainerScript(t *testing.T) {
+	rules := NewLogRules([]*LogRule{
+		{ID: 1, Matchers: []LogFieldMatcher{{Field: "headers[0]", Op: OpEqual, Value: "x"}}},
+		{ID: 2, Verdict: "drop", Matchers: []LogFieldMatcher{{Field: "host", Op: OpLessEqual, Value: "2.5"}}},
+	}, 1)
+	script, skipped := rules.RainerScript(time.Now(), ExportOptions{Drop: []string{"drop"}, Fields: map[string]string{"host": "$hostname"}})
+	assert.DeepEqual(t, skipped, []string{`rule #1: not supported by the export target: field "headers[0]"`})
+	assert.Equal(t, script, `# Generated by Lixie from 2 rules; do not edit
+set $.lixie_matched = 0;
+if $.lixie_matched == 0 and (re_match($hostname, "^[-+]?[0-9]+$") and cnum($hostname) <= 2) then {
+  stop
+}
+# Rule #1 skipped: not supported by the export target: field "headers[0]"
+if $.lixie_matched == 0 then {
+  set $!lixie = "unknown";
+}
+`)
+}
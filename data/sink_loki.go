@@ -0,0 +1,243 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Loki sink for the classified logs.
+
+ The newly fetched logs are pushed to (another) Loki with the verdict
+and the ID of the matching rule as either labels (lixie, lixie_rule) or
+structured metadata; spam can be skipped altogether. The logs are
+queued with the database locked, and pushed in batches by Run. Failed
+pushes are retried with backoff, except for the ones Loki rejects as
+invalid.
+*/
+
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LokiVerdictLabel = "lixie"
+	LokiRuleLabel    = "lixie_rule"
+)
+
+const (
+	lokiPushPath = "/loki/api/v1/push"
+
+	maxLokiPushBatch = 1000
+	maxLokiSinkQueue = 100000
+
+	lokiPushInterval         = time.Second
+	lokiPushRetryInterval    = time.Second
+	maxLokiPushRetryInterval = time.Minute
+	lokiPushTimeout          = 30 * time.Second
+)
+
+type lokiSinkEntry struct {
+	log     *Log
+	verdict string
+
+	// 0 if no rule matched
+	rule int
+}
+
+type LokiSink struct {
+	// Base URL of the Loki to push to
+	Server string
+
+	// Tenant (X-Scope-OrgID), if any
+	Tenant string
+
+	// Do not push spam at all
+	SkipSpam bool
+
+	// Add the verdict and the rule as structured metadata instead of
+	// labels
+	Metadata bool
+
+	// Used for the pushes (default: http.Client with a timeout)
+	Client *http.Client
+
+	lock     sync.Mutex
+	queue    []lokiSinkEntry
+	failures int
+	retryAt  time.Time
+}
+
+// add queues the logs (given newest first); it is called with the
+// database locked, so it must not block
+func (self *LokiSink) add(ingested []ingestedLog) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for _, entry := range slices.Backward(ingested) {
+		if self.SkipSpam && entry.verdict == LogVerdictSpam {
+			continue
+		}
+		sinkEntry := lokiSinkEntry{log: entry.log, verdict: LogVerdictInfoOf(entry.verdict).Key}
+		if entry.rule != nil {
+			sinkEntry.rule = entry.rule.ID
+		}
+		self.queue = append(self.queue, sinkEntry)
+	}
+	if dropped := len(self.queue) - maxLokiSinkQueue; dropped > 0 {
+		slog.Warn("Loki sink queue full, dropping oldest logs", "count", dropped)
+		self.queue = slices.Delete(self.queue, 0, dropped)
+	}
+}
+
+type lokiPushStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][]any           `json:"values"`
+}
+
+type lokiPushRequest struct {
+	Streams []*lokiPushStream `json:"streams"`
+}
+
+// payload returns the push request for the entries; the streams are in
+// the order of their first entry
+func (self *LokiSink) payload(entries []lokiSinkEntry) ([]byte, error) {
+	var request lokiPushRequest
+	streams := make(map[string]*lokiPushStream)
+	for _, entry := range entries {
+		labels := make(map[string]string, len(entry.log.Stream)+2)
+		for k, v := range entry.log.Stream {
+			labels[k] = v
+		}
+		lixie := map[string]string{LokiVerdictLabel: entry.verdict}
+		if entry.rule != 0 {
+			lixie[LokiRuleLabel] = strconv.Itoa(entry.rule)
+		}
+		value := []any{strconv.FormatInt(entry.log.Timestamp, 10), entry.log.RawMessage}
+		if self.Metadata {
+			value = append(value, lixie)
+		} else {
+			for k, v := range lixie {
+				labels[k] = v
+			}
+		}
+		var key strings.Builder
+		for _, k := range SortedKeys[string](labels) {
+			fmt.Fprintf(&key, "%q=%q,", k, labels[k])
+		}
+		stream, ok := streams[key.String()]
+		if !ok {
+			stream = &lokiPushStream{Stream: labels}
+			streams[key.String()] = stream
+			request.Streams = append(request.Streams, stream)
+		}
+		stream.Values = append(stream.Values, value)
+	}
+	return json.Marshal(request)
+}
+
+// lokiPushError is an error from Loki; retrying client errors (other
+// than rate limiting) is pointless
+type lokiPushError struct {
+	status int
+	body   string
+}
+
+func (self *lokiPushError) Error() string {
+	return fmt.Sprintf("Loki push failed - status code %d: %s", self.status, self.body)
+}
+
+func (self *lokiPushError) retryable() bool {
+	return self.status/100 != 4 || self.status == http.StatusTooManyRequests
+}
+
+func (self *LokiSink) send(ctx context.Context, entries []lokiSinkEntry) error {
+	payload, err := self.payload(entries)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(self.Server, "/")+lokiPushPath, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if self.Tenant != "" {
+		req.Header.Set("X-Scope-OrgID", self.Tenant)
+	}
+	client := self.Client
+	if client == nil {
+		client = &http.Client{Timeout: lokiPushTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return &lokiPushError{status: resp.StatusCode, body: strings.TrimSpace(string(body))}
+	}
+	return nil
+}
+
+// Push pushes the queued logs in batches; on failure, the rest are
+// left for later
+func (self *LokiSink) Push(ctx context.Context, now time.Time) {
+	for {
+		self.lock.Lock()
+		if len(self.queue) == 0 || now.Before(self.retryAt) {
+			self.lock.Unlock()
+			return
+		}
+		batch := self.queue[:min(len(self.queue), maxLokiPushBatch)]
+		self.queue = self.queue[len(batch):]
+		self.lock.Unlock()
+
+		err := self.send(ctx, batch)
+
+		self.lock.Lock()
+		var pushErr *lokiPushError
+		if err == nil {
+			self.failures = 0
+		} else if errors.As(err, &pushErr) && !pushErr.retryable() {
+			slog.Error("Loki rejected logs, dropping them", "count", len(batch), "err", err)
+		} else {
+			slog.Warn("Loki push failed", "err", err)
+			self.queue = slices.Concat(batch, self.queue)
+			self.failures++
+			backoff := lokiPushRetryInterval << min(self.failures-1, 16)
+			self.retryAt = now.Add(min(backoff, maxLokiPushRetryInterval))
+			self.lock.Unlock()
+			return
+		}
+		self.lock.Unlock()
+	}
+}
+
+// Run pushes the logs until the context is done
+func (self *LokiSink) Run(ctx context.Context) {
+	ticker := time.NewTicker(lokiPushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			self.Push(ctx, now)
+		}
+	}
+}
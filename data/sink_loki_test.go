@@ -0,0 +1,123 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+// lokiStandIn records the push requests it gets, and responds with the
+// given statuses first
+type lokiStandIn struct {
+	lock     sync.Mutex
+	statuses []int
+	tenants  []string
+	requests []lokiPushRequest
+}
+
+func (self *lokiStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if r.URL.Path != lokiPushPath {
+		http.NotFound(w, r)
+		return
+	}
+	if len(self.statuses) > 0 {
+		status := self.statuses[0]
+		self.statuses = self.statuses[1:]
+		http.Error(w, "nope", status)
+		return
+	}
+	var request lokiPushRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	self.tenants = append(self.tenants, r.Header.Get("X-Scope-OrgID"))
+	self.requests = append(self.requests, request)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (self *lokiStandIn) respond(statuses ...int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.statuses = statuses
+}
+
+func (self *lokiStandIn) received() []lokiPushRequest {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	result := self.requests
+	self.requests = nil
+	return result
+}
+
+func TestLokiSink(t *testing.T) {
+	path := "test_db.json"
+	_ = os.Remove(path)
+
+	standIn := &lokiStandIn{}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	sink := &LokiSink{Server: server.URL + "/", Tenant: "curated", SkipSpam: true}
+	source := &ArraySource{Chunk: 100}
+	db := Database{Path: path, Source: source, LokiSink: sink}
+	assert.Equal(t, db.Add(LogRule{Matchers: []LogFieldMatcher{{Field: "message", Op: OpEqual, Value: "spam"}}}), nil)
+	assert.Equal(t, db.Add(LogRule{Ham: true, Matchers: []LogFieldMatcher{{Field: "message", Op: OpEqual, Value: "ham"}}}), nil)
+	fetch := func(messages ...string) {
+		source.Data = nil
+		for i, message := range messages {
+			source.Data = append(source.Data, NewLog(int64(100-i), map[string]string{"source": "a"}, message))
+		}
+		source.offset = 0
+		_, err := db.Logs()
+		assert.Equal(t, err, nil)
+	}
+	ctx := context.Background()
+	now := time.Now()
+
+	// Newest first from the source, oldest first to Loki
+	fetch("ham", "spam", "x", "ham")
+	sink.Push(ctx, now)
+	assert.DeepEqual(t, standIn.received(), []lokiPushRequest{{Streams: []*lokiPushStream{
+		{Stream: map[string]string{"source": "a", "lixie": "ham", "lixie_rule": "2"}, Values: [][]any{{"97", "ham"}, {"100", "ham"}}},
+		{Stream: map[string]string{"source": "a", "lixie": "unknown"}, Values: [][]any{{"98", "x"}}},
+	}}})
+	assert.DeepEqual(t, standIn.tenants, []string{"curated"})
+
+	// Retried after a failure, but not after being rejected
+	sink.Metadata = true
+	standIn.respond(http.StatusInternalServerError)
+	fetch("ham")
+	sink.Push(ctx, now)
+	sink.Push(ctx, now.Add(lokiPushRetryInterval/2))
+	assert.Equal(t, len(standIn.received()), 0)
+	sink.Push(ctx, now.Add(lokiPushRetryInterval))
+	assert.DeepEqual(t, standIn.received(), []lokiPushRequest{{Streams: []*lokiPushStream{
+		{Stream: map[string]string{"source": "a"}, Values: [][]any{{"100", "ham", map[string]any{"lixie": "ham", "lixie_rule": "2"}}}},
+	}}})
+
+	standIn.respond(http.StatusBadRequest)
+	fetch("x")
+	sink.Push(ctx, now.Add(time.Hour))
+	sink.Push(ctx, now.Add(2*time.Hour))
+	assert.Equal(t, len(standIn.received()), 0)
+}
@@ -42,6 +42,10 @@ type LokiSource struct {
 	Server   string
 	Selector string
 
+	// Filter returns additional pipeline stages for the queries (e.g.
+	// LogQLFilter.Keep); it is called with the database locked
+	Filter func() string
+
 	lastErrorTime time.Time
 	last          *Log
 }
@@ -53,12 +57,18 @@ func (self *LokiSource) loadAfter(start int64) ([]*Log, error) {
 	v := url.Values{}
 	// v.Set("direction", "backward")
 	v.Set("limit", "5000")
+	query := self.Selector
 	if start > 0 {
-		v.Set("query", self.Selector)
 		v.Set("start", strconv.FormatInt(start, 10))
 	} else {
-		v.Set("query", strings.TrimSuffix(self.Selector, "}")+`,lixie!="spam"}`)
+		query = strings.TrimSuffix(self.Selector, "}") + `,lixie!="spam"}`
+	}
+	if self.Filter != nil {
+		if filter := self.Filter(); filter != "" {
+			query += " " + filter
+		}
 	}
+	v.Set("query", query)
 
 	resp, err := http.Get(base + "?" + v.Encode())
 	if err != nil {
@@ -44,3 +44,18 @@ func UnmarshalJSONFromPath(target any, path string) error {
 	}
 	return nil
 }
+
+// MarshalJSONToPath writes the value as (indented) JSON to the path,
+// atomically replacing the previous content
+func MarshalJSONToPath(v any, path string) error {
+	b, err := json.MarshalIndent(v, "", " ")
+	if err != nil {
+		return err
+	}
+	temp := path + ".tmp"
+	err = os.WriteFile(temp, b, 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
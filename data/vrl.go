@@ -0,0 +1,298 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Vector (https://vector.dev) remap program generation.
+
+ The ruleset is converted to a VRL program, which sets .lixie to the
+verdict key of the first matching rule (and .lixie_rule to its ID, and
+.lixie_retention to the retention hint of the verdict, if any). See
+export.go for the rules which are exported. Rate conditions are not
+supported, so the base verdict of the rule is used.
+
+ Field names are event paths: dotted components are nested fields,
+and numeric components (or [n] suffixes) are array indexes. The fields
+used by the rules are converted to their canonical string form (see
+log_field.go) up front, as the matchers work on those.
+
+ Dispatched blocks of rules use a binary search over the values.
+*/
+
+package data
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Up to this many values are compared one by one
+const maxVRLLinearValues = 4
+
+type vrlSyntax struct {
+	// Do some of the rules depend on the log timestamp?
+	timed bool
+}
+
+func vrlString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func vrlRegexp(expr string) string {
+	return "r'" + strings.ReplaceAll(expr, "'", `\'`) + "'"
+}
+
+func vrlFloat(f float64) string {
+	s := strconv.FormatFloat(f, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+// vrlPath converts the field name to VRL event path
+func vrlPath(field string) string {
+	var b strings.Builder
+	for _, part := range exportPath(field) {
+		switch {
+		case part.isIndex:
+			fmt.Fprintf(&b, "[%d]", part.index)
+		case exportIdentifier.MatchString(part.name):
+			b.WriteString("." + part.name)
+		default:
+			b.WriteString("." + vrlString(part.name))
+		}
+	}
+	if b.Len() == 0 {
+		return "."
+	}
+	return b.String()
+}
+
+func vrlFound(field *exportField) string {
+	return fmt.Sprintf("found_%d", field.index)
+}
+
+func vrlValue(field *exportField) string {
+	return fmt.Sprintf("value_%d", field.index)
+}
+
+func vrlNumber(field *exportField) string {
+	return fmt.Sprintf("number_%d", field.index)
+}
+
+func (self *vrlSyntax) and(exprs []string) string {
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	return "(" + strings.Join(exprs, " && ") + ")"
+}
+
+func (self *vrlSyntax) or(exprs []string) string {
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	return "(" + strings.Join(exprs, " || ") + ")"
+}
+
+func (self *vrlSyntax) not(expr string) string {
+	if exportIdentifier.MatchString(expr) || parenthesized(expr, `"'`) {
+		return "!" + expr
+	}
+	return "!(" + expr + ")"
+}
+
+func (self *vrlSyntax) constant(value bool) string {
+	return strconv.FormatBool(value)
+}
+
+func (self *vrlSyntax) present(field *exportField) string {
+	return vrlFound(field)
+}
+
+func (self *vrlSyntax) guard(field *exportField, expr string, absent bool) string {
+	if absent {
+		return fmt.Sprintf("(!%s || %s)", vrlFound(field), expr)
+	}
+	return fmt.Sprintf("(%s && %s)", vrlFound(field), expr)
+}
+
+// equal matches the canonical string form of the field against the
+// value the way MatchField does
+func (self *vrlSyntax) equal(field *exportField, value string, fold bool) string {
+	expr := fmt.Sprintf("%s == %s", vrlValue(field), vrlString(value))
+	if fold {
+		expr = fmt.Sprintf("downcase(%s) == %s", vrlValue(field), vrlString(strings.ToLower(value)))
+	}
+	keys := fieldIndexKeys(value)
+	if len(keys) == 1 {
+		return expr
+	}
+	// Non-strings compare equal also in their canonical form
+	var alternatives []string
+	for _, key := range keys[1:] {
+		alternatives = append(alternatives, fmt.Sprintf("%s == %s", vrlValue(field), vrlString(key)))
+	}
+	return fmt.Sprintf("(%s || (!is_string(field_%d) && %s))", expr, field.index, self.or(alternatives))
+}
+
+func (self *vrlSyntax) match(field *exportField, matcher *LogFieldMatcher) (string, error) {
+	value := vrlValue(field)
+	switch matcher.Op {
+	case OpEqual:
+		return self.equal(field, matcher.Value, false), nil
+	case OpEqualFold:
+		return self.equal(field, matcher.Value, true), nil
+	case OpRegexp:
+		return fmt.Sprintf("match(%s, %s)", value, vrlRegexp("^"+matcher.Value+"$")), nil
+	case OpContains:
+		return fmt.Sprintf("contains(%s, %s)", value, vrlString(matcher.Value)), nil
+	case OpPrefix:
+		return fmt.Sprintf("starts_with(%s, %s)", value, vrlString(matcher.Value)), nil
+	case OpSuffix:
+		return fmt.Sprintf("ends_with(%s, %s)", value, vrlString(matcher.Value)), nil
+	case OpContainsFold:
+		return fmt.Sprintf("contains(downcase(%s), %s)", value, vrlString(strings.ToLower(matcher.Value))), nil
+	case OpPrefixFold:
+		return fmt.Sprintf("starts_with(downcase(%s), %s)", value, vrlString(strings.ToLower(matcher.Value))), nil
+	case OpSuffixFold:
+		return fmt.Sprintf("ends_with(downcase(%s), %s)", value, vrlString(strings.ToLower(matcher.Value))), nil
+	case OpLess, OpLessEqual, OpGreater, OpGreaterEqual:
+		number, _ := parseNumber(matcher.Value)
+		return fmt.Sprintf("(is_float(%s) && float!(%s) %s %s)", vrlNumber(field), vrlNumber(field), matcher.Op, vrlFloat(number)), nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrExportUnsupported, matcher.Op)
+}
+
+func (self *vrlSyntax) validity(from, until *time.Time) string {
+	self.timed = true
+	var exprs []string
+	if from != nil {
+		exprs = append(exprs, fmt.Sprintf("log_time >= %d", from.UnixNano()))
+	}
+	if until != nil {
+		exprs = append(exprs, fmt.Sprintf("log_time < %d", until.UnixNano()))
+	}
+	return strings.Join(exprs, " && ")
+}
+
+type vrlWriter struct {
+	exportWriter
+	syntax vrlSyntax
+	fields exportFields
+}
+
+// rules writes the rules as a chain of ifs; the first matching rule
+// sets the verdict
+func (self *vrlWriter) rules(rules []*LogRule) {
+	for i, rule := range rules {
+		exprs, err := exportRuleExprs(&self.syntax, &self.fields, rule)
+		expr := strings.Join(exprs, " && ")
+		switch {
+		case err != nil:
+			// All operations are supported, so this should not happen
+			expr = "false"
+		case expr == "":
+			expr = "true"
+		}
+		if i == 0 {
+			self.open("if %s {", expr)
+		} else {
+			self.next("} else if %s {", expr)
+		}
+		self.line(".lixie = %s", vrlString(rule.VerdictKey()))
+		self.line(".lixie_rule = %d", rule.ID)
+		if retention := exportRetention(rule); retention != "" {
+			self.line(".lixie_retention = %s", vrlString(retention))
+		}
+		self.line("matched = true")
+	}
+	self.close("}")
+}
+
+func (self *vrlWriter) dispatch(field *exportField, buckets []exportBucket) {
+	if len(buckets) > maxVRLLinearValues {
+		mid := len(buckets) / 2
+		self.open("if %s < %s {", vrlValue(field), vrlString(buckets[mid].value))
+		self.dispatch(field, buckets[:mid])
+		self.next("} else {")
+		self.dispatch(field, buckets[mid:])
+		self.close("}")
+		return
+	}
+	for i, bucket := range buckets {
+		if i == 0 {
+			self.open("if %s == %s {", vrlValue(field), vrlString(bucket.value))
+		} else {
+			self.next("} else if %s == %s {", vrlValue(field), vrlString(bucket.value))
+		}
+		self.rules(bucket.rules)
+	}
+	self.close("}")
+}
+
+// VRL returns the ruleset as a VRL program, for use as the source of a
+// Vector remap transform
+func (self *LogRules) VRL(now time.Time) string {
+	rules := self.exportRules(now)
+	var w vrlWriter
+	for _, block := range exportBlocks(rules) {
+		w.open("if !matched {")
+		if block.field != "" {
+			w.dispatch(w.fields.field(block.field), block.buckets)
+		} else {
+			w.rules(block.rules)
+		}
+		w.close("}")
+	}
+
+	var header exportWriter
+	header.line("# Generated by Lixie from %d rules; do not edit", len(rules))
+	header.line(".lixie = %s", vrlString(LogVerdictUnknownKey))
+	header.line("matched = false")
+	if w.syntax.timed {
+		header.line(`log_time = to_unix_timestamp(timestamp(.timestamp) ?? now(), unit: "nanoseconds")`)
+	}
+	for _, field := range w.fields.order {
+		i, path := field.index, vrlPath(field.name)
+		header.line("%s = exists(%s)", vrlFound(field), path)
+		header.line("field_%d = %s", i, path)
+		header.line("%s = if is_string(field_%d) { string!(field_%d) } else { encode_json(field_%d) }", vrlValue(field), i, i, i)
+		if field.numeric {
+			header.line(`%s = to_float(strip_whitespace(%s)) ?? parse_duration(strip_whitespace(%s), "s") ?? null`,
+				vrlNumber(field), vrlValue(field), vrlValue(field))
+		}
+	}
+	return header.b.String() + w.b.String()
+}
+
+// VRL returns the current ruleset as a VRL program
+func (self *Database) VRL() string {
+	self.Lock()
+	defer self.Unlock()
+
+	return self.LogRules.VRL(time.Now())
+}
@@ -0,0 +1,114 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package data
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestVRLPath(t *testing.T) {
+	for field, path := range map[string]string{
+		"source":              ".source",
+		"http.request.method": ".http.request.method",
+		"headers[0]":          ".headers[0]",
+		"headers.1.name":      ".headers[1].name",
+		"x-forwarded-for":     `."x-forwarded-for"`,
+	} {
+		assert.Equal(t, vrlPath(field), path, field)
+	}
+}
+
+func TestLogRulesVRL(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+	rules := NewLogRules([]*LogRule{
+		{ID: 1, Matchers: []LogFieldMatcher{
+			{Field: "source", Op: OpEqual, Value: "a"},
+			{Field: "message", Op: OpContains, Value: `say "hi"`},
+		}},
+		{ID: 2, Disabled: true, Matchers: []LogFieldMatcher{{Field: "source", Op: OpEqual, Value: "b"}}},
+		{ID: 3, ValidUntil: &past, Matchers: []LogFieldMatcher{{Field: "source", Op: OpEqual, Value: "c"}}},
+		{ID: 4, Verdict: "drop", ValidUntil: &future, Matchers: []LogFieldMatcher{
+			{Field: "level", Op: OpGreaterEqual, Value: "3"},
+			{Field: "user", Op: OpNotExists},
+		}, Groups: []LogMatcherGroup{{Op: GroupNot, Matchers: []LogFieldMatcher{
+			{Field: "message", Op: OpRegexp, Value: "it's.*"},
+		}}}},
+		{ID: 5, Ham: true, Matchers: []LogFieldMatcher{{Field: "ok", Op: OpNotEqual, Value: "1"}}},
+	}, 1)
+	assert.Equal(t, rules.VRL(now), `# Generated by Lixie from 3 rules; do not edit
+.lixie = "unknown"
+matched = false
+log_time = to_unix_timestamp(timestamp(.timestamp) ?? now(), unit: "nanoseconds")
+found_0 = exists(.ok)
+field_0 = .ok
+value_0 = if is_string(field_0) { string!(field_0) } else { encode_json(field_0) }
+found_1 = exists(.level)
+field_1 = .level
+value_1 = if is_string(field_1) { string!(field_1) } else { encode_json(field_1) }
+number_1 = to_float(strip_whitespace(value_1)) ?? parse_duration(strip_whitespace(value_1), "s") ?? null
+found_2 = exists(.user)
+field_2 = .user
+value_2 = if is_string(field_2) { string!(field_2) } else { encode_json(field_2) }
+found_3 = exists(.message)
+field_3 = .message
+value_3 = if is_string(field_3) { string!(field_3) } else { encode_json(field_3) }
+found_4 = exists(.source)
+field_4 = .source
+value_4 = if is_string(field_4) { string!(field_4) } else { encode_json(field_4) }
+if !matched {
+  if (!found_0 || !(value_0 == "1")) {
+    .lixie = "ham"
+    .lixie_rule = 5
+    matched = true
+  } else if log_time < 1717203600000000000 && (found_1 && (is_float(number_1) && float!(number_1) >= 3.0)) && !found_2 && !(found_3 && match(value_3, r'^it\'s.*$')) {
+    .lixie = "drop"
+    .lixie_rule = 4
+    .lixie_retention = "0"
+    matched = true
+  } else if (found_4 && value_4 == "a") && (found_3 && contains(value_3, "say \"hi\"")) {
+    .lixie = "spam"
+    .lixie_rule = 1
+    matched = true
+  }
+}
+`)
+}
+
+func TestLogRulesVRLDispatch(t *testing.T) {
+	var rules []*LogRule
+	for i := range 12 {
+		rule := LogRule{ID: 100 - i, Matchers: []LogFieldMatcher{{Field: "source", Op: OpEqual, Value: fmt.Sprintf("s%d", i%6)}}}
+		if i == 8 {
+			// Breaks the run; the rules after it must stay after it
+			rule.Matchers[0].Field = "host"
+		}
+		rules = append(rules, &rule)
+	}
+	lrules := NewLogRules(rules, 1)
+	vrl := lrules.VRL(time.Now())
+
+	// First run is dispatched with binary search, second is too short
+	assert.Equal(t, strings.Count(vrl, `if value_0 < "s3" {`), 1)
+	assert.Equal(t, strings.Count(vrl, "if !matched {"), 2)
+	assert.Assert(t, strings.Index(vrl, ".lixie_rule = 98\n") < strings.Index(vrl, ".lixie_rule = 92\n"))
+	assert.Assert(t, strings.Index(vrl, ".lixie_rule = 92\n") < strings.Index(vrl, ".lixie_rule = 91\n"))
+	for _, rule := range rules {
+		assert.Equal(t, strings.Count(vrl, fmt.Sprintf(".lixie_rule = %d\n", rule.ID)), 1)
+	}
+
+	// Within the bucket, the rules are in the evaluation order
+	bucket := vrl[strings.Index(vrl, `if value_0 == "s0" {`):]
+	assert.Assert(t, strings.Index(bucket, "= 100\n") < strings.Index(bucket, "= 94\n"))
+}
@@ -0,0 +1,293 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Email digest of the logs (see data/digest.go).
+
+ The digest is sent on a cron-like schedule, covering the time since
+the previous digest (or, for the first one, the interval of the
+schedule). The HTML part reuses the web UI components, and the links
+in it are relative to the configured base URL. The mail is sent over
+SMTP; STARTTLS is required, and PLAIN authentication is used if
+credentials are configured.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/fingon/lixie/data"
+)
+
+const digestDefaultSubject = "Lixie digest"
+
+var (
+	errDigestInvalidConfig = errors.New("invalid digest configuration")
+	errDigestNoStartTLS    = errors.New("SMTP server does not support STARTTLS")
+)
+
+type digestSMTPConfig struct {
+	// host:port of the server
+	Server string
+
+	Username string `json:",omitempty"`
+	Password string `json:",omitempty"`
+
+	From string
+	To   []string
+
+	// Used for STARTTLS (default: verify the server name)
+	tlsConfig *tls.Config
+}
+
+type digestConfig struct {
+	// Cron-like schedule (in local time), e.g. "0 7 * * *"
+	Schedule string
+
+	// Subject of the mails (default: Lixie digest)
+	Subject string `json:",omitempty"`
+
+	// URL of Lixie, for the links in the mails
+	BaseURL string `json:",omitempty"`
+
+	// Send the digest even if there is nothing to report
+	SendEmpty bool `json:",omitempty"`
+
+	SMTP digestSMTPConfig
+
+	// Parsed Schedule
+	schedule *cronSchedule
+}
+
+func loadDigestConfig(path string) (*digestConfig, error) {
+	config := digestConfig{}
+	err := data.UnmarshalJSONFromPath(&config, path)
+	if err != nil {
+		return nil, err
+	}
+	config.schedule, err = parseCronSchedule(config.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errDigestInvalidConfig, err)
+	}
+	if config.SMTP.Server == "" || config.SMTP.From == "" || len(config.SMTP.To) == 0 {
+		return nil, fmt.Errorf("%w: SMTP server, from and to are required", errDigestInvalidConfig)
+	}
+	if config.Subject == "" {
+		config.Subject = digestDefaultSubject
+	}
+	return &config, nil
+}
+
+type DigestModel struct {
+	Subject string
+	BaseURL string
+
+	Digest *data.LogDigest
+
+	// The ham logs, for LogListTable
+	HamLogs LogListModel
+}
+
+func newDigestModel(config *digestConfig, db *data.Database, digest *data.LogDigest) DigestModel {
+	return DigestModel{
+		Subject: config.Subject,
+		BaseURL: config.BaseURL,
+		Digest:  digest,
+		HamLogs: LogListModel{
+			DB:                db,
+			Logs:              digest.HamLogs,
+			Config:            LogListConfig{AutoRefresh: true},
+			DisableActions:    true,
+			DisablePagination: true,
+		},
+	}
+}
+
+// digestText returns the plain text version of the digest
+func digestText(m DigestModel) string {
+	var b strings.Builder
+	digest := m.Digest
+	fmt.Fprintf(&b, "%s\n%s - %s\n", m.Subject, digest.Since.Format(time.DateTime), digest.Until.Format(time.DateTime))
+
+	fmt.Fprintf(&b, "\nInteresting logs (%d):\n", digest.HamCount)
+	for _, log := range digest.HamLogs {
+		fmt.Fprintf(&b, "  %s %s %s\n", log.Time.Format(time.DateTime), log.Stream[primaryStreamKey], log.Message)
+	}
+
+	fmt.Fprintf(&b, "\nTop unknown log templates (%d logs):\n", digest.UnknownCount)
+	for _, cluster := range digest.UnknownClusters {
+		fmt.Fprintf(&b, "  %d %s %s\n", cluster.Count, cluster.Stream, cluster.Template())
+	}
+
+	fmt.Fprintf(&b, "\nNew sources:\n")
+	for _, source := range digest.NewSources {
+		fmt.Fprintf(&b, "  %s\n", source)
+	}
+
+	fmt.Fprintf(&b, "\nRules that stopped matching:\n")
+	for _, stopped := range digest.StoppedRules {
+		fmt.Fprintf(&b, "  #%d %s, last seen %s", stopped.Rule.ID, data.LogVerdictToString(data.LogRuleToVerdict(stopped.Rule)),
+			stopped.Stats.LastSeen.Format(time.DateTime))
+		if m.BaseURL != "" {
+			fmt.Fprintf(&b, " %s%s", strings.TrimSuffix(m.BaseURL, "/"), ruleLinkString(stopped.Rule.ID, "edit"))
+		}
+		fmt.Fprintf(&b, "\n")
+	}
+	return b.String()
+}
+
+func writeQuotedPrintable(w *multipart.Writer, contentType string, content []byte) error {
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(part)
+	if _, err = qp.Write(content); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// digestMessage returns the mail with both plain text and HTML parts
+func digestMessage(ctx context.Context, config *digestConfig, m DigestModel, now time.Time) ([]byte, error) {
+	var html bytes.Buffer
+	if err := DigestEmail(m).Render(ctx, &html); err != nil {
+		return nil, err
+	}
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	if err := writeQuotedPrintable(w, "text/plain; charset=utf-8", []byte(digestText(m))); err != nil {
+		return nil, err
+	}
+	if err := writeQuotedPrintable(w, "text/html; charset=utf-8", html.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", config.SMTP.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(config.SMTP.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", w.Boundary())
+	_, _ = body.WriteTo(&msg)
+	return msg.Bytes(), nil
+}
+
+func sendMail(config *digestSMTPConfig, msg []byte) error {
+	host, _, err := net.SplitHostPort(config.Server)
+	if err != nil {
+		return err
+	}
+	c, err := smtp.Dial(config.Server)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		return errDigestNoStartTLS
+	}
+	tlsConfig := config.tlsConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: host}
+	}
+	if err = c.StartTLS(tlsConfig); err != nil {
+		return err
+	}
+	if config.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", config.Username, config.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(config.From); err != nil {
+		return err
+	}
+	for _, to := range config.To {
+		if err = c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// sendDigest sends the digest of the period, unless there is nothing
+// to report
+func sendDigest(ctx context.Context, db *data.Database, config *digestConfig, since, until time.Time) error {
+	digest, err := db.Digest(since, until)
+	if err != nil {
+		return err
+	}
+	if digest.Empty() && !config.SendEmpty {
+		slog.Info("Nothing to report, digest not sent", "since", since)
+		return nil
+	}
+	msg, err := digestMessage(ctx, config, newDigestModel(config, db, digest), time.Now())
+	if err != nil {
+		return err
+	}
+	return sendMail(&config.SMTP, msg)
+}
+
+// runDigests sends the digests on schedule until the context is done
+func runDigests(ctx context.Context, db *data.Database, config *digestConfig) {
+	var last time.Time
+	for {
+		next := config.schedule.Next(time.Now())
+		if next.IsZero() {
+			slog.Error("Digest schedule never fires", "schedule", config.Schedule)
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		since := last
+		if since.IsZero() {
+			// The interval of the schedule
+			since = next.Add(-config.schedule.Next(next).Sub(next))
+		}
+		if err := sendDigest(ctx, db, config, since, next); err != nil {
+			slog.Error("Unable to send digest", "err", err)
+			continue
+		}
+		last = next
+	}
+}
@@ -0,0 +1,248 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fingon/lixie/data"
+	"gotest.tools/v3/assert"
+)
+
+// smtpStandIn is a minimal SMTP server for a single session, which
+// requires STARTTLS before AUTH PLAIN
+type smtpStandIn struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+
+	// Results of the session
+	done    chan struct{}
+	auth    string
+	from    string
+	to      []string
+	data    string
+	usedTLS bool
+}
+
+func newSMTPStandIn(t *testing.T) (*smtpStandIn, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Equal(t, err, nil)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	assert.Equal(t, err, nil)
+	cert, err := x509.ParseCertificate(der)
+	assert.Equal(t, err, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	result := &smtpStandIn{
+		listener:  listener,
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}},
+		done:      make(chan struct{}),
+	}
+	go result.serve()
+	return result, pool
+}
+
+func (self *smtpStandIn) serve() {
+	defer close(self.done)
+	conn, err := self.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	_ = tp.PrintfLine("220 localhost ready")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			if self.usedTLS {
+				_ = tp.PrintfLine("250-localhost\r\n250 AUTH PLAIN")
+			} else {
+				_ = tp.PrintfLine("250-localhost\r\n250 STARTTLS")
+			}
+		case "STARTTLS":
+			_ = tp.PrintfLine("220 go ahead")
+			tlsConn := tls.Server(conn, self.tlsConfig)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn = tlsConn
+			tp = textproto.NewConn(conn)
+			self.usedTLS = true
+		case "AUTH":
+			if !self.usedTLS {
+				_ = tp.PrintfLine("530 must issue STARTTLS first")
+				continue
+			}
+			b, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(arg, "PLAIN "))
+			self.auth = string(b)
+			_ = tp.PrintfLine("235 ok")
+		case "MAIL":
+			self.from = arg
+			_ = tp.PrintfLine("250 ok")
+		case "RCPT":
+			self.to = append(self.to, arg)
+			_ = tp.PrintfLine("250 ok")
+		case "DATA":
+			_ = tp.PrintfLine("354 go ahead")
+			b, _ := io.ReadAll(tp.DotReader())
+			self.data = string(b)
+			_ = tp.PrintfLine("250 ok")
+		case "QUIT":
+			_ = tp.PrintfLine("221 bye")
+			return
+		default:
+			_ = tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+// mailParts returns the decoded parts of the multipart mail by content type
+func mailParts(t *testing.T, message string) (*mail.Message, map[string]string) {
+	msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(message)))
+	assert.Equal(t, err, nil)
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, mediaType, "multipart/alternative")
+	parts := make(map[string]string)
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := r.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		assert.Equal(t, err, nil)
+		b, err := io.ReadAll(quotedprintable.NewReader(part))
+		assert.Equal(t, err, nil)
+		parts[part.Header.Get("Content-Type")] = string(b)
+	}
+	return msg, parts
+}
+
+func TestSendDigest(t *testing.T) {
+	path := "test_db.json"
+	_ = os.Remove(path)
+	defer os.Remove(path)
+
+	until := time.Now().Truncate(time.Second)
+	since := until.Add(-24 * time.Hour)
+	newLog := func(age time.Duration, source, message string) *data.Log {
+		return data.NewLog(until.Add(-age).UnixNano(), map[string]string{"source": source}, message)
+	}
+	logs := []*data.Log{
+		newLog(time.Hour, "cron", "something <interesting>"),
+		newLog(2*time.Hour, "sshd", "user 1 logged in"),
+		newLog(3*time.Hour, "sshd", "user 2 logged in"),
+		newLog(30*time.Hour, "cron", "old"),
+	}
+	db := data.Database{Path: path, Source: &data.ArraySource{Data: logs, Chunk: len(logs)}}
+	assert.Equal(t, db.Add(data.LogRule{Matchers: []data.LogFieldMatcher{{Field: "message", Op: data.OpEqual, Value: "old"}}}), nil)
+	assert.Equal(t, db.Add(data.LogRule{Ham: true, Matchers: []data.LogFieldMatcher{{Field: "message", Op: data.OpPrefix, Value: "something"}}}), nil)
+
+	standIn, pool := newSMTPStandIn(t)
+	defer standIn.listener.Close()
+	config := digestConfig{
+		Subject: "Digest ä",
+		BaseURL: "https://lixie.example.com/",
+		SMTP: digestSMTPConfig{
+			Server:    standIn.listener.Addr().String(),
+			Username:  "user",
+			Password:  "secret",
+			From:      "lixie@example.com",
+			To:        []string{"admin@example.com", "other@example.com"},
+			tlsConfig: &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"},
+		},
+	}
+	assert.Equal(t, sendDigest(context.Background(), &db, &config, since, until), nil)
+	<-standIn.done
+
+	assert.Assert(t, standIn.usedTLS)
+	assert.Equal(t, standIn.auth, "\x00user\x00secret")
+	assert.Equal(t, standIn.from, "FROM:<lixie@example.com>")
+	assert.DeepEqual(t, standIn.to, []string{"TO:<admin@example.com>", "TO:<other@example.com>"})
+
+	msg, parts := mailParts(t, standIn.data)
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, subject, "Digest ä")
+	text := parts["text/plain; charset=utf-8"]
+	for _, s := range []string{
+		"Interesting logs (1):",
+		"cron something <interesting>",
+		"2 sshd user <*> logged in",
+		"New sources:\n  sshd\n",
+		"#1 Noise, last seen",
+		"https://lixie.example.com/log/rule/1/edit",
+	} {
+		assert.Assert(t, strings.Contains(text, s), "%q not in %s", s, text)
+	}
+	html := parts["text/html; charset=utf-8"]
+	for _, s := range []string{
+		`<base href="https://lixie.example.com/">`,
+		"something &lt;interesting&gt;",
+		"user &lt;*&gt; logged in",
+		`<a href="/log/rule/1/edit">1</a>`,
+	} {
+		assert.Assert(t, strings.Contains(html, s), "%q not in %s", s, html)
+	}
+}
+
+func TestLoadDigestConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "digest.json")
+	write := func(s string) {
+		assert.Equal(t, os.WriteFile(path, []byte(s), 0o600), nil)
+	}
+	write(`{"Schedule": "0 7 * * *", "SMTP": {"Server": "mail:587", "From": "a@b", "To": ["c@d"]}}`)
+	config, err := loadDigestConfig(path)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, config.Subject, digestDefaultSubject)
+	assert.Assert(t, config.schedule != nil)
+
+	write(`{"Schedule": "0 7 * *", "SMTP": {"Server": "mail:587", "From": "a@b", "To": ["c@d"]}}`)
+	_, err = loadDigestConfig(path)
+	assert.ErrorIs(t, err, errDigestInvalidConfig)
+
+	write(`{"Schedule": "@daily", "SMTP": {"Server": "mail:587"}}`)
+	_, err = loadDigestConfig(path)
+	assert.ErrorIs(t, err, errDigestInvalidConfig)
+}
@@ -0,0 +1,127 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Ruleset export to log shippers.
+
+ The 'export' subcommand writes the ruleset as a Fluent Bit Lua filter
+script or as rsyslog RainerScript statements (see data/fluentbit.go
+and data/rsyslog.go), or as Loki query or recording rules (see
+loki.go); VRL is also available, but see vector.go for rewriting
+Vector configurations. Rules which cannot be exported are
+reported on standard error.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/fingon/lixie/data"
+)
+
+const (
+	exportFormatFluentBit = "fluentbit"
+	exportFormatRsyslog   = "rsyslog"
+	exportFormatVRL       = "vrl"
+	exportFormatLogQL     = "logql"
+	exportFormatLokiRules = "loki-rules"
+)
+
+var (
+	errExportUnknownFormat = errors.New("unknown export format")
+	errExportInvalidField  = errors.New("field mapping must be of form name=target")
+)
+
+type exportSettings struct {
+	options data.ExportOptions
+
+	// Loki stream selector, and the labels to group the recorded
+	// volume by
+	selector string
+	by       []string
+}
+
+// exportRules returns the ruleset in the given format, and the rules
+// which could not be exported
+func exportRules(db *data.Database, format string, settings exportSettings) (string, []string, error) {
+	options := settings.options
+	switch format {
+	case exportFormatFluentBit:
+		script, skipped := db.FluentBitLua(options)
+		return script, skipped, nil
+	case exportFormatRsyslog:
+		script, skipped := db.RainerScript(options)
+		return script, skipped, nil
+	case exportFormatVRL:
+		return db.VRL(), nil, nil
+	case exportFormatLogQL:
+		filter := db.LogQLFilter(options)
+		return lokiQuery(filter, settings.selector) + "\n", filter.Skipped, nil
+	case exportFormatLokiRules:
+		filter := db.LogQLFilter(options)
+		rules, err := lokiRecordingRules(filter, options, settings.selector, settings.by)
+		return string(rules), filter.Skipped, err
+	}
+	return "", nil, fmt.Errorf("%w: %q", errExportUnknownFormat, format)
+}
+
+func exportCommand(_ context.Context, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
+	dbPath := flags.String("db", "db.json", "Database to use")
+	format := flags.String("format", exportFormatFluentBit, "Output format (fluentbit, rsyslog, vrl, logql or loki-rules)")
+	output := flags.String("o", "", "Where to write the output (default: standard output)")
+	drop := flags.String("drop", "", "Comma-separated verdicts of the logs to drop instead of annotating them (logql: default spam)")
+	selector := flags.String("selector", lokiDefaultSelector, "Loki stream selector (logql and loki-rules)")
+	by := flags.String("by", lokiDefaultBy, "Comma-separated labels to group the recorded volume by (loki-rules)")
+	options := data.ExportOptions{Fields: map[string]string{}}
+	flags.Func("field", "Field mapping of form name=target (e.g. message=log); may be repeated", func(s string) error {
+		name, target, ok := strings.Cut(s, "=")
+		if !ok || name == "" || target == "" {
+			return errExportInvalidField
+		}
+		options.Fields[name] = target
+		return nil
+	})
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *drop != "" {
+		options.Drop = strings.Split(*drop, ",")
+	}
+	settings := exportSettings{options: options, selector: *selector}
+	if *by != "" {
+		settings.by = strings.Split(*by, ",")
+	}
+
+	db := data.Database{Path: *dbPath}
+	if err := db.Load(); err != nil {
+		return err
+	}
+	result, skipped, err := exportRules(&db, *format, settings)
+	if err != nil {
+		return err
+	}
+	for _, reason := range skipped {
+		fmt.Fprintf(os.Stderr, "Skipped %s\n", reason)
+	}
+	if *output == "" {
+		_, err = io.WriteString(stdout, result)
+		return err
+	}
+	temp := *output + ".tmp"
+	if err = os.WriteFile(temp, []byte(result), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(temp, *output)
+}
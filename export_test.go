@@ -0,0 +1,73 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fingon/lixie/data"
+	lua "github.com/yuin/gopher-lua"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/golden"
+)
+
+// TestExportGolden exports the rulesets in testdata/export in all
+// formats, and compares the results with the golden files next to them
+// (go test -update rewrites them)
+func TestExportGolden(t *testing.T) {
+	paths, err := filepath.Glob("testdata/export/*.json")
+	assert.Equal(t, err, nil)
+	assert.Assert(t, len(paths) > 0)
+	settings := exportSettings{options: data.ExportOptions{Drop: []string{"drop"}}, selector: lokiDefaultSelector, by: []string{lokiDefaultBy}}
+	for _, path := range paths {
+		db := data.Database{Path: path}
+		assert.Equal(t, db.Load(), nil)
+		for format, suffix := range map[string]string{
+			exportFormatFluentBit: ".lua",
+			exportFormatRsyslog:   ".rsyslog",
+			exportFormatVRL:       ".vrl",
+			exportFormatLogQL:     ".logql",
+			exportFormatLokiRules: ".loki.yaml",
+		} {
+			// Skipped rules are noted within the results
+			settings := settings
+			if format == exportFormatLogQL || format == exportFormatLokiRules {
+				// Spam by default
+				settings.options.Drop = nil
+			}
+			result, _, err := exportRules(&db, format, settings)
+			assert.Equal(t, err, nil)
+			if format == exportFormatFluentBit {
+				L := lua.NewState()
+				assert.Equal(t, L.DoString(result), nil, path)
+				L.Close()
+			}
+			golden.Assert(t, result, strings.TrimPrefix(strings.TrimSuffix(path, ".json"), "testdata/")+suffix)
+		}
+	}
+}
+
+func TestExportCommand(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "lixie.rsyslog")
+	args := []string{"lixie export", "-db", "testdata/export/basic.json", "-format", "rsyslog", "-drop", "drop,spam", "-field", "source=$programname", "-o", output}
+	var out bytes.Buffer
+	assert.Equal(t, exportCommand(context.Background(), args, &out), nil)
+	script, err := os.ReadFile(output)
+	assert.Equal(t, err, nil)
+	assert.Assert(t, strings.Contains(string(script), `$programname == "systemd"`), string(script))
+	assert.Assert(t, strings.Contains(string(script), "stop\n"), string(script))
+
+	args = []string{"lixie export", "-db", "testdata/export/basic.json", "-format", "x"}
+	assert.ErrorIs(t, exportCommand(context.Background(), args, &out), errExportUnknownFormat)
+}
@@ -7,6 +7,8 @@
 
 package main
 
+import "iter"
+
 type FTSMatchable interface {
 	MatchesFTS(string) bool
 }
@@ -32,3 +34,14 @@ func filterFTS[T FTSMatchable](s []T, search string, limit int) []T {
 	}
 	return filtered
 }
+
+// matchFTS is the lazy variant of filterFTS
+func matchFTS[T FTSMatchable](s []T, search string) iter.Seq[T] {
+	return func(yield func(T) bool) {
+		for _, o := range s {
+			if (search == "" || o.MatchesFTS(search)) && !yield(o) {
+				return
+			}
+		}
+	}
+}
@@ -8,7 +8,9 @@ require (
 	github.com/a-h/templ v0.3.819
 	github.com/cespare/xxhash v1.1.0
 	github.com/sourcegraph/conc v0.3.0
+	github.com/yuin/gopher-lua v1.1.1
 	golang.org/x/exp v0.0.0-20250106191152-7588d65b2ba8
+	gopkg.in/yaml.v3 v3.0.1
 	gotest.tools/v3 v3.5.2
 )
 
@@ -32,15 +32,51 @@ transforms:
 """
 
 from dataclasses import dataclass
+import datetime
 import json
+import re
 
 # Used only in .txt; json/yaml currently escape newlines anyway
 INDENT = ""
 
 
 def load_rules(path):
+    # Same order as Lixie itself uses: priority descending, then ID descending
     with open(path) as f:
-        return list(reversed(json.load(f)["LogRules"]["Rules"]))
+        db = json.load(f)
+    rules = db["LogRules"]["Rules"]
+    # Retention hints are not part of the rules, so annotate them here
+    # (the default verdicts are assumed to be used if none are configured)
+    retention = {v["Key"]: v.get("Retention", "") for v in db.get("Verdicts") or DEFAULT_VERDICTS}
+    for rule in rules:
+        rule["_Retention"] = retention.get(rule_verdict(rule), "")
+    # Expired (temporary) rules are not exported at all
+    now = datetime.datetime.now(datetime.timezone.utc)
+    rules = [r for r in rules if not r.get("ValidUntil") or parse_time(r["ValidUntil"]) > now]
+    return sorted(rules, key=lambda r: (-r.get("Priority", 0), -r["ID"]))
+
+
+def parse_time(s):
+    # Go may produce nanosecond precision, which Python does not support
+    return datetime.datetime.fromisoformat(re.sub(r"(\.\d{6})\d+", r"\1", s))
+
+
+# Must match DefaultLogVerdicts in data/log_verdict.go
+DEFAULT_VERDICTS = [
+    {"Key": "unknown"},
+    {"Key": "ham"},
+    {"Key": "spam"},
+    {"Key": "drop", "Retention": "0"},
+    {"Key": "archive-short", "Retention": "7d"},
+    {"Key": "security", "Retention": "365d"},
+]
+
+
+def rule_verdict(rule):
+    # Older databases have only the Ham boolean
+    if verdict := rule.get("Verdict"):
+        return verdict
+    return "ham" if rule["Ham"] else "spam"
 
 
 def get_source_matcher(rule):
@@ -72,29 +108,55 @@ def split_by_source_expr(rules):
         yield matcher_op, chunk
 
 
+def matcher_expr(m):
+    field = m["Field"]
+    op = m["Op"]
+    value = m["Value"]
+    if op == "=":
+        evalue = escape(value, '"', True)
+        return f'.{field} == "{evalue}"'
+    if op == "=~":
+        evalue = escape(value, "'", False)
+        return f"(parse_regex(.{field}, r'^{evalue}$') ?? null) != null"
+    raise NotImplementedError
+
+
+def group_expr(group):
+    # Empty matchers and groups are ignored, like in Lixie itself
+    exprs = [matcher_expr(m) for m in group.get("Matchers") or [] if m["Field"] or m["Value"]]
+    exprs.extend(e for g in group.get("Groups") or [] if (e := group_expr(g)))
+    if not exprs:
+        return None
+    match group["Op"]:
+        case "and":
+            return "(" + " && ".join(exprs) + ")"
+        case "or":
+            return "(" + " || ".join(exprs) + ")"
+        case "not":
+            return "!(" + " && ".join(exprs) + ")"
+    raise NotImplementedError(group["Op"])
+
+
 def dump_rule_matchers_ignoring_source(rule):
     prefix = ""
     for m in rule["Matchers"]:
-        if (field := m["Field"]) == "source":
+        if m["Field"] == "source":
             continue
-        op = m["Op"]
-        value = m["Value"]
-        if op == "=":
-            evalue = escape(value, '"', True)
-            expr = f'.{field} == "{evalue}"'
-        elif op == "=~":
-            evalue = escape(value, "'", False)
-            expr = f"(parse_regex(.{field}, r'^{evalue}$') ?? null) != null"
-        else:
-            raise NotImplementedError
-        yield f"{prefix}{expr}"
+        yield f"{prefix}{matcher_expr(m)}"
         prefix = "&& "
+    for g in rule.get("Groups") or []:
+        if expr := group_expr(g):
+            yield f"{prefix}{expr}"
+            prefix = "&& "
     if not prefix:
         yield "true"
 
 def dump_rule_verdict(rule):
-    verdict = "ham" if rule["Ham"] else "spam"
+    # NB: Rate conditions are not supported; Vector gets the base verdict
+    verdict = rule_verdict(rule)
     yield f'.lixie = "{verdict}"'
+    if retention := rule.get("_Retention"):
+        yield f'.lixie_retention = "{retention}"'
 
 def dump_rules_ignoring_source(chunk):
     assert chunk
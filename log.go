@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/a-h/templ"
 	"github.com/fingon/lixie/data"
@@ -29,7 +30,7 @@ func toJSON(v interface{}) string {
 	return string(b)
 }
 
-func logClassifyHandler(st State, ham bool) http.Handler {
+func logClassifyHandler(st State) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		hashString := r.PathValue("hash")
 		hash, err := strconv.ParseUint(hashString, 10, 64)
@@ -37,7 +38,17 @@ func logClassifyHandler(st State, ham bool) http.Handler {
 			http.Error(w, err.Error(), 400)
 			return
 		}
-		err = st.DB.ClassifyHash(hash, ham)
+		verdict := r.PathValue("verdict")
+		v, ok := data.LogVerdictFromKey(verdict)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if v == data.LogVerdictUnknown {
+			http.Error(w, data.ErrRuleVerdictUnknown.Error(), 400)
+			return
+		}
+		err = st.DB.ClassifyHash(hash, verdict)
 		if err == data.ErrHashNotFound {
 			http.NotFound(w, r)
 			return
@@ -49,3 +60,67 @@ func logClassifyHandler(st State, ham bool) http.Handler {
 		http.Redirect(w, r, topLevelLog.Path, http.StatusSeeOther)
 	})
 }
+
+// Durations offered for snoozing logs
+var snoozeDurations = []struct {
+	Title    string
+	Duration time.Duration
+}{
+	{"1h", time.Hour},
+	{"1d", 24 * time.Hour},
+	{"1w", 7 * 24 * time.Hour},
+}
+
+// snooze form fields
+const snoozeDurationKey = "d"
+
+func snoozeLink(log *data.Log, d time.Duration) templ.SafeURL {
+	return logLink(log, "snooze?"+snoozeDurationKey+"="+d.String())
+}
+
+func logSnoozeHandler(st State) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hashString := r.PathValue("hash")
+		hash, err := strconv.ParseUint(hashString, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		d, err := time.ParseDuration(r.FormValue(snoozeDurationKey))
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid duration", 400)
+			return
+		}
+		err = st.DB.SnoozeHash(hash, time.Now().Add(d).Truncate(time.Second))
+		if err == data.ErrHashNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		http.Redirect(w, r, topLevelLog.Path, http.StatusSeeOther)
+	})
+}
+
+func logRuleFromHashHandler(st State) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hashString := r.PathValue("hash")
+		hash, err := strconv.ParseUint(hashString, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		rule, err := st.DB.LogRuleForHash(hash, data.LogVerdictSpamKey)
+		if err == data.ErrHashNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		http.Redirect(w, r, string(logRuleEditLink(rule)), http.StatusSeeOther)
+	})
+}
@@ -0,0 +1,42 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/fingon/lixie/data"
+)
+
+type LogClusterListModel struct {
+	// The largest clusters of unknown logs
+	Clusters []*data.LogCluster
+
+	// Total number of clusters
+	TotalCount int
+}
+
+func logClusterListHandler(st State) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Ensure the logs have been retrieved at least once
+		_, err := st.DB.Logs()
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		clusters := st.DB.UnknownLogClusters()
+		m := LogClusterListModel{Clusters: clusters, TotalCount: len(clusters)}
+		if len(m.Clusters) > 100 {
+			m.Clusters = m.Clusters[:100]
+		}
+		err = LogClusterList(st, m).Render(r.Context(), w)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+		}
+	})
+}
@@ -0,0 +1,142 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Export of the log list.
+
+ Every log matching the current log list configuration (filter, search
+and before cursor) is streamed as NDJSON or CSV, along with its verdict
+and the matching rule. Unlike the log list itself, there is no limit.
+*/
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fingon/lixie/cm"
+	"github.com/fingon/lixie/data"
+)
+
+const (
+	exportFormatKey    = "format"
+	exportFormatNDJSON = "ndjson"
+	exportFormatCSV    = "csv"
+)
+
+var exportCSVHeader = []string{"time", "verdict", "rule", "stream", "line"}
+
+type exportedLog struct {
+	Time    time.Time          `json:"time"`
+	Stream  map[string]string  `json:"stream"`
+	Line    string             `json:"line"`
+	Verdict string             `json:"verdict"`
+	Rule    *data.ClassifyRule `json:"rule,omitempty"`
+}
+
+func newExportedLog(log *data.Log, verdict int, rule *data.LogRule) exportedLog {
+	result := exportedLog{
+		Time:    log.Time,
+		Stream:  log.Stream,
+		Line:    log.RawMessage,
+		Verdict: data.LogVerdictInfoOf(verdict).Key,
+	}
+	if rule != nil {
+		result.Rule = &data.ClassifyRule{ID: rule.ID, Version: rule.Version}
+	}
+	return result
+}
+
+// streamString returns the stream labels in the LogQL selector format
+func (self *exportedLog) streamString() string {
+	var sb strings.Builder
+	sb.WriteString("{")
+	for i, k := range data.SortedKeys[string](self.Stream) {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "%s=%q", k, self.Stream[k])
+	}
+	sb.WriteString("}")
+	return sb.String()
+}
+
+func (self *exportedLog) csvRecord() []string {
+	rule := ""
+	if self.Rule != nil {
+		rule = strconv.Itoa(self.Rule.ID)
+	}
+	return []string{self.Time.Format(time.RFC3339Nano), self.Verdict, rule, self.streamString(), self.Line}
+}
+
+func (self LogListConfig) ExportQuery(format string) *QueryWrapper {
+	q := QueryWrapper{Base: logExport.Path}
+	q.Add(exportFormatKey, format)
+	if self.BeforeHash != 0 {
+		q.Add(beforeKey, strconv.FormatUint(self.BeforeHash, 10))
+	}
+	return &q
+}
+
+func logExportHandler(st State) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := LogListConfig{Filter: data.LogVerdictSpamKey}
+		wr, err := cm.GetWrapper(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		err = config.Init(r, wr, w)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		format := r.FormValue(exportFormatKey)
+		if format == "" {
+			format = exportFormatNDJSON
+		}
+		if format != exportFormatNDJSON && format != exportFormatCSV {
+			http.Error(w, fmt.Sprintf("unsupported format: %q", format), 400)
+			return
+		}
+
+		model := LogListModel{Config: config, DB: st.DB}
+		logs, err := model.All()
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="lixie-logs.%s"`, format))
+		if format == exportFormatCSV {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			writer := csv.NewWriter(w)
+			_ = writer.Write(exportCSVHeader)
+			for log, verdict := range logs {
+				exported := newExportedLog(log, verdict, model.LogToRule(log))
+				if writer.Write(exported.csvRecord()) != nil {
+					return
+				}
+			}
+			writer.Flush()
+			return
+		}
+		w.Header().Set("Content-Type", classifyContentNDJSON)
+		encoder := json.NewEncoder(w)
+		for log, verdict := range logs {
+			if encoder.Encode(newExportedLog(log, verdict, model.LogToRule(log))) != nil {
+				return
+			}
+		}
+	})
+}
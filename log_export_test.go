@@ -0,0 +1,73 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fingon/lixie/data"
+	"gotest.tools/v3/assert"
+)
+
+func TestLogExportHandler(t *testing.T) {
+	path := "test_db.json"
+	_ = os.Remove(path)
+	defer os.Remove(path)
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var logs []*data.Log
+	for i := range 30 {
+		message := "cron job " + strconv.Itoa(i)
+		if i%10 == 0 {
+			message = "other " + strconv.Itoa(i)
+		}
+		logs = append(logs, data.NewLog(now.Add(-time.Duration(i)*time.Second).UnixNano(), map[string]string{"source": "a"}, message))
+	}
+	db := data.Database{Path: path, Source: &data.ArraySource{Data: logs, Chunk: len(logs)}}
+	assert.Equal(t, db.Add(data.LogRule{Matchers: []data.LogFieldMatcher{{Field: "message", Op: data.OpPrefix, Value: "cron"}}}), nil)
+	st := State{DB: &db}
+	export := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		logExportHandler(st).ServeHTTP(w, httptest.NewRequest("GET", logExport.Path+"?"+query, nil))
+		return w
+	}
+
+	// Spam is filtered by default
+	w := export("")
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Header().Get("Content-Type"), classifyContentNDJSON)
+	assert.Equal(t, w.Body.String(), `{"time":"2024-05-01T12:00:00Z","stream":{"source":"a"},"line":"other 0","verdict":"unknown"}
+{"time":"2024-05-01T11:59:50Z","stream":{"source":"a"},"line":"other 10","verdict":"unknown"}
+{"time":"2024-05-01T11:59:40Z","stream":{"source":"a"},"line":"other 20","verdict":"unknown"}
+`)
+
+	// Nothing filtered goes beyond the log list limit
+	w = export("filter=nothing")
+	assert.Equal(t, strings.Count(w.Body.String(), "\n"), 30)
+
+	w = export("format=csv&filter=nothing&gsearch=job+1&before=" + strconv.FormatUint(logs[11].Hash(), 10))
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Header().Get("Content-Type"), "text/csv; charset=utf-8")
+	assert.Equal(t, w.Body.String(), `time,verdict,rule,stream,line
+2024-05-01T11:59:48Z,spam,1,"{source=""a""}",cron job 12
+2024-05-01T11:59:47Z,spam,1,"{source=""a""}",cron job 13
+2024-05-01T11:59:46Z,spam,1,"{source=""a""}",cron job 14
+2024-05-01T11:59:45Z,spam,1,"{source=""a""}",cron job 15
+2024-05-01T11:59:44Z,spam,1,"{source=""a""}",cron job 16
+2024-05-01T11:59:43Z,spam,1,"{source=""a""}",cron job 17
+2024-05-01T11:59:42Z,spam,1,"{source=""a""}",cron job 18
+2024-05-01T11:59:41Z,spam,1,"{source=""a""}",cron job 19
+`)
+
+	assert.Equal(t, export("format=xml").Code, 400)
+}
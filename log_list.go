@@ -8,7 +8,10 @@
 package main
 
 import (
+	"encoding/json"
+	"iter"
 	"net/http"
+	"slices"
 	"strconv"
 
 	"github.com/fingon/lixie/cm"
@@ -21,8 +24,8 @@ type LogListConfig struct {
 	Global GlobalConfig `json:"-"`
 
 	// Local state (cookie)
-	AutoRefresh bool `json:"ar" cm:"auto-refresh"`
-	Filter      int  `json:"f" cm:"filter"`
+	AutoRefresh bool          `json:"ar" cm:"auto-refresh"`
+	Filter      LogListFilter `json:"f" cm:"filter"`
 
 	// These are only handled via links
 	BeforeHash uint64
@@ -35,6 +38,67 @@ const (
 	llFilterKey      = "filter"
 )
 
+// LogListFilter is the key of the verdict whose logs are not shown
+// (or llFilterNothing)
+type LogListFilter string
+
+// Filter value which shows logs of every verdict
+const llFilterNothing LogListFilter = "nothing"
+
+// Before the verdicts were configurable, the filter was the verdict
+// index, with 3 meaning nothing; old links and cookies still use those
+var llLegacyFilters = map[LogListFilter]LogListFilter{
+	"0": data.LogVerdictUnknownKey,
+	"1": data.LogVerdictHamKey,
+	"2": data.LogVerdictSpamKey,
+	"3": llFilterNothing,
+}
+
+func (self *LogListFilter) UnmarshalJSON(b []byte) error {
+	var index int
+	if json.Unmarshal(b, &index) == nil {
+		*self = LogListFilter(strconv.Itoa(index)).normalized()
+		return nil
+	}
+	var key string
+	if err := json.Unmarshal(b, &key); err != nil {
+		return err
+	}
+	*self = LogListFilter(key).normalized()
+	return nil
+}
+
+func (self LogListFilter) normalized() LogListFilter {
+	if filter, ok := llLegacyFilters[self]; ok {
+		return filter
+	}
+	return self
+}
+
+// verdict returns the verdict the filter hides, or -1 if none
+func (self LogListFilter) verdict() int {
+	if verdict, ok := data.LogVerdictFromKey(string(self)); ok {
+		return verdict
+	}
+	return -1
+}
+
+// logListFilters returns the possible values of LogListConfig.Filter
+func logListFilters() []LogListFilter {
+	result := make([]LogListFilter, 0, len(data.LogVerdicts())+1)
+	for _, info := range data.LogVerdicts() {
+		result = append(result, LogListFilter(info.Key))
+	}
+	return append(result, llFilterNothing)
+}
+
+func logListFilterString(filter LogListFilter) string {
+	if filter == llFilterNothing {
+		return "Nothing"
+	}
+	return data.LogVerdictToString(filter.verdict())
+}
+
 // These are handled only in templates
 const (
 	expandKey = "expand"
@@ -53,6 +117,7 @@ func (self *LogListConfig) Init(s cm.CookieSource, wr *cm.URLWrapper, w http.Res
 	if err != nil {
 		return err
 	}
+	self.Filter = self.Filter.normalized()
 
 	// Link-based state
 	_, err = cm.Uint64FromForm(wr, expandKey, &self.Expand)
@@ -134,15 +199,60 @@ func (self *LogListModel) LogToRule(log *data.Log) *data.LogRule {
 	return log.ToRule(&self.DB.LogRules)
 }
 
+// LogVerdict returns verdict of the log; rate conditions are taken
+// into account only with the database ruleset
 func (self *LogListModel) LogVerdict(log *data.Log) int {
-	rule := self.LogToRule(log)
-	return data.LogRuleToVerdict(rule)
+	if self.LogRules != nil {
+		return data.LogVerdict(log, self.LogRules)
+	}
+	return log.Verdict(&self.DB.LogRules)
+}
+
+func (self *LogListModel) LogOverRate(log *data.Log) bool {
+	return self.LogRules == nil && log.OverRate(&self.DB.LogRules)
+}
+
+// matchingLogs yields the logs after the before cursor which are not
+// filtered out, with their verdicts; the logs before the cursor are
+// passed to skip (if any)
+func (self *LogListModel) matchingLogs(logs iter.Seq[*data.Log], skip func(*data.Log)) iter.Seq2[*data.Log, int] {
+	return func(yield func(*data.Log, int) bool) {
+		filter := self.Config.Filter.verdict()
+		active := self.Config.BeforeHash == 0
+		for log := range logs {
+			if !active {
+				if log.Hash() == self.Config.BeforeHash {
+					active = true
+				}
+				if skip != nil {
+					skip(log)
+				}
+				continue
+			}
+			verdict := self.LogVerdict(log)
+			if verdict == filter {
+				continue
+			}
+			if !yield(log, verdict) {
+				return
+			}
+		}
+	}
+}
+
+// All returns every log matching the configuration, regardless of the
+// Limit
+func (self *LogListModel) All() (iter.Seq2[*data.Log, int], error) {
+	allLogs, err := self.DB.Logs()
+	if err != nil {
+		return nil, err
+	}
+	return self.matchingLogs(matchFTS(allLogs, self.Config.Global.Search), nil), nil
 }
 
 func (self *LogListModel) Filter() error {
 	// Some spare capacity but who really cares
 	logs := make([]*data.Log, 0, self.Limit)
-	active := self.Config.BeforeHash == 0
 	count := 0
 	allLogs, err := self.DB.Logs()
 	if err != nil {
@@ -151,19 +261,12 @@ func (self *LogListModel) Filter() error {
 
 	allLogs = filterFTS(allLogs, self.Config.Global.Search, len(allLogs))
 	self.TotalCount = len(allLogs)
-	for _, log := range allLogs {
-		if !active {
-			if log.Hash() == self.Config.BeforeHash {
-				active = true
-			}
-			if self.EnableAccurateCounting && self.LogVerdict(log) != self.Config.Filter {
-				count++
-			}
-			continue
-		}
-		if self.LogVerdict(log) == self.Config.Filter {
-			continue
+	skip := func(log *data.Log) {
+		if self.EnableAccurateCounting && self.LogVerdict(log) != self.Config.Filter.verdict() {
+			count++
 		}
+	}
+	for log := range self.matchingLogs(slices.Values(allLogs), skip) {
 		count++
 		if len(logs) < self.Limit {
 			logs = append(logs, log)
@@ -178,7 +281,7 @@ func (self *LogListModel) Filter() error {
 
 func logListHandler(st State) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		config := LogListConfig{Filter: data.LogVerdictSpam}
+		config := LogListConfig{Filter: data.LogVerdictSpamKey}
 		wr, err := cm.GetWrapper(r)
 		if err != nil {
 			http.Error(w, err.Error(), 400)
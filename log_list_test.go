@@ -8,10 +8,14 @@
 package main
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
 
 	"github.com/fingon/lixie/cm"
+	"github.com/fingon/lixie/data"
 	"gotest.tools/v3/assert"
 )
 
@@ -27,3 +31,28 @@ func TestLogList(t *testing.T) {
 	assert.Equal(t, err, nil)
 	assert.Equal(t, conf, conf1)
 }
+
+func TestLogListFilter(t *testing.T) {
+	fromQuery := func(value string) LogListFilter {
+		conf := LogListConfig{}
+		r := httptest.NewRequest(http.MethodGet, "/?"+url.Values{llFilterKey: {value}}.Encode(), nil)
+		wr, err := cm.GetWrapper(r)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, conf.Init(r, wr, httptest.NewRecorder()), nil)
+		return conf.Filter
+	}
+	assert.Equal(t, fromQuery("security"), LogListFilter("security"))
+	assert.Equal(t, fromQuery(string(llFilterNothing)), llFilterNothing)
+
+	// Verdict indexes from before the verdicts were configurable
+	assert.Equal(t, fromQuery("2"), LogListFilter(data.LogVerdictSpamKey))
+	assert.Equal(t, fromQuery("3"), llFilterNothing)
+
+	var conf LogListConfig
+	assert.Equal(t, json.Unmarshal([]byte(`{"f": 3}`), &conf), nil)
+	assert.Equal(t, conf.Filter, llFilterNothing)
+	assert.Equal(t, json.Unmarshal([]byte(`{"f": "ham"}`), &conf), nil)
+	assert.Equal(t, conf.Filter, LogListFilter(data.LogVerdictHamKey))
+	assert.Equal(t, conf.Filter.verdict(), data.LogVerdictHam)
+	assert.Equal(t, llFilterNothing.verdict(), -1)
+}
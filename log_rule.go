@@ -10,8 +10,10 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 	"slices"
 	"strconv"
+	"time"
 
 	"github.com/a-h/templ"
 	"github.com/fingon/lixie/cm"
@@ -27,9 +29,24 @@ const (
 	commentKey  = "com"
 	disabledKey = "d"
 	hamKey      = "h"
+	verdictKey  = "vd"
+	fromKey     = "vf"
+	untilKey    = "vu"
+	priorityKey = "pri"
 	versionKey  = "ver"
 )
 
+// rate form fields
+const (
+	rateCountKey   = "rc"
+	rateWindowKey  = "rw"
+	rateLabelKey   = "rl"
+	rateVerdictKey = "rv"
+)
+
+// move form fields
+const aboveKey = "above"
+
 // per-matcher fields
 const (
 	deleteField = "del"
@@ -38,12 +55,41 @@ const (
 	valueField  = "v"
 )
 
+// Layout of datetime-local inputs
+const formTimeLayout = "2006-01-02T15:04:05"
+
+// fixture fields (prefixed with mustMatchPrefix or mustNotMatchPrefix)
+const (
+	mustMatchPrefix     = "fm-"
+	mustNotMatchPrefix  = "fn-"
+	fixtureCountField   = "n"
+	fixtureStreamField  = "s"
+	fixtureMessageField = "m"
+)
+
+// per-group fields (prefixed with groupPrefix)
+const (
+	groupOpField     = "op"
+	deleteGroupField = "delg"
+)
+
 // actions
 const (
-	actionAdd  = "a"
-	actionSave = "s"
+	actionAdd        = "a"
+	actionAddGroup   = "ag"
+	actionSave       = "s"
+	actionSaveAnyway = "sa"
 )
 
+func optionalTimeFromForm(r cm.FormValued, key string) (*time.Time, error) {
+	var t time.Time
+	found, err := cm.TimeFromForm(r, key, formTimeLayout, &t)
+	if !found || err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
 func NewLogRuleFromForm(r cm.FormValued) (result *data.LogRule, err error) {
 	rule := data.LogRule{}
 
@@ -53,44 +99,260 @@ func NewLogRuleFromForm(r cm.FormValued) (result *data.LogRule, err error) {
 	if _, err = cm.IntFromForm(r, versionKey, &rule.Version); err != nil {
 		return
 	}
+	if _, err = cm.IntFromForm(r, priorityKey, &rule.Priority); err != nil {
+		return
+	}
 	cm.BoolFromForm(r, disabledKey, &rule.Disabled)
+	// The ham checkbox is still supported for older links
 	cm.BoolFromForm(r, hamKey, &rule.Ham)
+	rule.Verdict = r.FormValue(verdictKey)
 	rule.Comment = r.FormValue(commentKey)
+	if rule.ValidFrom, err = optionalTimeFromForm(r, fromKey); err != nil {
+		return
+	}
+	if rule.ValidUntil, err = optionalTimeFromForm(r, untilKey); err != nil {
+		return
+	}
+	rate := data.LogRuleRate{
+		Window:   r.FormValue(rateWindowKey),
+		PerLabel: r.FormValue(rateLabelKey),
+		Verdict:  r.FormValue(rateVerdictKey),
+	}
+	var found bool
+	if found, err = cm.IntFromForm(r, rateCountKey, &rate.Count); err != nil {
+		return
+	}
+	if found && rate.Count > 0 {
+		rule.Rate = &rate
+	}
 
+	rule.Matchers, rule.Groups = matchersFromForm(r, "")
+	if rule.MustMatch, err = fixturesFromForm(r, mustMatchPrefix); err != nil {
+		return
+	}
+	if rule.MustNotMatch, err = fixturesFromForm(r, mustNotMatchPrefix); err != nil {
+		return
+	}
+
+	// Save is dealt with externally
+	result = &rule
+	return
+}
+
+// matchersFromForm reads the matchers and groups with the given field
+// name prefix (empty for the top level of the rule), and applies the
+// mutation actions to them
+func matchersFromForm(r cm.FormValued, prefix string) (matchers []data.LogFieldMatcher, groups []data.LogMatcherGroup) {
 	// Read the matcher fields
 	i := 0
 	del := -1
 	for {
 		// Keep track of what to delete here too
-		if r.FormValue(fieldID(i, deleteField)) != "" {
+		if r.FormValue(prefix+fieldID(i, deleteField)) != "" {
 			del = i
 		}
-		field := r.FormValue(fieldID(i, fieldField))
-		op := r.FormValue(fieldID(i, opField))
-		value := r.FormValue(fieldID(i, valueField))
+		field := r.FormValue(prefix + fieldID(i, fieldField))
+		op := r.FormValue(prefix + fieldID(i, opField))
+		value := r.FormValue(prefix + fieldID(i, valueField))
 		if field == "" && op == "" && value == "" {
 			break
 		}
 		matcher := data.LogFieldMatcher{Field: field, Op: op, Value: value}
-		rule.Matchers = append(rule.Matchers, matcher)
+		matchers = append(matchers, matcher)
 		i++
 	}
 
+	// Read the nested groups
+	for j := 0; ; j++ {
+		gprefix := groupPrefix(prefix, j)
+		op := r.FormValue(gprefix + groupOpField)
+		if op == "" {
+			break
+		}
+		gmatchers, ggroups := matchersFromForm(r, gprefix)
+		if r.FormValue(gprefix+deleteGroupField) != "" {
+			continue
+		}
+		groups = append(groups, data.LogMatcherGroup{Op: op, Matchers: gmatchers, Groups: ggroups})
+	}
+
 	// Handle the mutation actions
 	if del >= 0 {
-		rule.Matchers = slices.Delete(rule.Matchers, del, del+1)
+		matchers = slices.Delete(matchers, del, del+1)
 	}
-	if r.FormValue(actionAdd) != "" {
-		rule.Matchers = append(rule.Matchers, data.LogFieldMatcher{Op: "="})
+	if r.FormValue(prefix+actionAdd) != "" {
+		matchers = append(matchers, data.LogFieldMatcher{Op: data.OpEqual})
+	}
+	if r.FormValue(prefix+actionAddGroup) != "" {
+		groups = append(groups, data.LogMatcherGroup{Op: data.GroupOr, Matchers: []data.LogFieldMatcher{{Op: data.OpEqual}}})
 	}
-	// Save is dealt with externally
-	result = &rule
 	return
 }
 
+// fixturesFromForm reads the fixtures with the given field name
+// prefix, and applies the mutation actions to them
+func fixturesFromForm(r cm.FormValued, prefix string) (fixtures []data.LogRuleFixture, err error) {
+	var count int
+	if _, err = cm.IntFromForm(r, prefix+fixtureCountField, &count); err != nil {
+		return
+	}
+	for i := range count {
+		if r.FormValue(prefix+fieldID(i, deleteField)) != "" {
+			continue
+		}
+		fixture := data.LogRuleFixture{Message: r.FormValue(prefix + fieldID(i, fixtureMessageField))}
+		fixture.SetStreamString(r.FormValue(prefix + fieldID(i, fixtureStreamField)))
+		fixtures = append(fixtures, fixture)
+	}
+	if r.FormValue(prefix+actionAdd) != "" {
+		fixtures = append(fixtures, data.LogRuleFixture{})
+	}
+	return
+}
+
+func setFixtureValues(v url.Values, prefix string, fixtures []data.LogRuleFixture) {
+	if len(fixtures) == 0 {
+		return
+	}
+	v.Set(prefix+fixtureCountField, strconv.Itoa(len(fixtures)))
+	for i, fixture := range fixtures {
+		v.Set(prefix+fieldID(i, fixtureStreamField), fixture.StreamString())
+		v.Set(prefix+fieldID(i, fixtureMessageField), fixture.Message)
+	}
+}
+
+func setMatcherValues(v url.Values, prefix string, matchers []data.LogFieldMatcher, groups []data.LogMatcherGroup) {
+	for i, m := range matchers {
+		v.Set(prefix+fieldID(i, fieldField), m.Field)
+		v.Set(prefix+fieldID(i, opField), m.Op)
+		v.Set(prefix+fieldID(i, valueField), m.Value)
+	}
+	for j, g := range groups {
+		gprefix := groupPrefix(prefix, j)
+		v.Set(gprefix+groupOpField, g.Op)
+		setMatcherValues(v, gprefix, g.Matchers, g.Groups)
+	}
+}
+
+// logRuleValues encodes the rule as form values (the inverse of
+// NewLogRuleFromForm)
+func logRuleValues(rule *data.LogRule) url.Values {
+	v := url.Values{}
+	if rule.ID != 0 {
+		v.Set(idKey, strconv.Itoa(rule.ID))
+	}
+	v.Set(versionKey, strconv.Itoa(rule.Version))
+	v.Set(priorityKey, strconv.Itoa(rule.Priority))
+	if rule.Comment != "" {
+		v.Set(commentKey, rule.Comment)
+	}
+	if rule.Ham {
+		v.Set(hamKey, "1")
+	}
+	if rule.Verdict != "" {
+		v.Set(verdictKey, rule.Verdict)
+	}
+	if rule.Disabled {
+		v.Set(disabledKey, "1")
+	}
+	if rule.ValidFrom != nil {
+		v.Set(fromKey, rule.ValidFrom.Format(formTimeLayout))
+	}
+	if rule.ValidUntil != nil {
+		v.Set(untilKey, rule.ValidUntil.Format(formTimeLayout))
+	}
+	if rate := rule.Rate; rate != nil {
+		v.Set(rateCountKey, strconv.Itoa(rate.Count))
+		v.Set(rateWindowKey, rate.Window)
+		v.Set(rateLabelKey, rate.PerLabel)
+		v.Set(rateVerdictKey, rate.Verdict)
+	}
+	setMatcherValues(v, "", rule.Matchers, rule.Groups)
+	setFixtureValues(v, mustMatchPrefix, rule.MustMatch)
+	setFixtureValues(v, mustNotMatchPrefix, rule.MustNotMatch)
+	return v
+}
+
+func ruleExpired(rule *data.LogRule) bool {
+	return rule.Expired(time.Now())
+}
+
+// ruleRate returns the rate of the rule, or the default shown in the
+// editor if the rule has none
+func ruleRate(rule *data.LogRule) *data.LogRuleRate {
+	if rule.Rate != nil {
+		return rule.Rate
+	}
+	return &data.LogRuleRate{Window: "1m", Verdict: data.LogVerdictHamKey}
+}
+
+func ruleRateVerdict(rule *data.LogRule) int {
+	verdict, _ := data.LogVerdictFromKey(rule.Rate.Verdict)
+	return verdict
+}
+
+func rateCountString(rule *data.LogRule) string {
+	if rule.Rate == nil {
+		return ""
+	}
+	return strconv.Itoa(rule.Rate.Count)
+}
+
+func formTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(formTimeLayout)
+}
+
+func logRuleEditLink(rule *data.LogRule) templ.SafeURL {
+	return templ.URL(logRuleEdit.Path + "?" + logRuleValues(rule).Encode())
+}
+
+// The editor is re-rendered on every keystroke, so the generalization
+// is evaluated only against this many newest logs
+const maxGeneralizationLogs = 1000
+
+// LogRuleGeneralization is a proposal to replace exact message
+// matchers of a rule with generalized regexps
+type LogRuleGeneralization struct {
+	Rule *data.LogRule
+
+	// Number of the newest cached logs looked at, and how many of
+	// them the current and the proposed rule match
+	Sample   int
+	Current  int
+	Proposed int
+}
+
+func generalizeLogRule(db *data.Database, rule *data.LogRule) *LogRuleGeneralization {
+	generalized := data.GeneralizeLogRule(rule)
+	if generalized == nil {
+		return nil
+	}
+	logs, err := db.CachedLogs()
+	if err != nil {
+		return nil
+	}
+	logs = logs[:min(len(logs), maxGeneralizationLogs)]
+	generalized.Disabled = false
+	current := *rule
+	current.Disabled = false
+	result := LogRuleGeneralization{Rule: generalized, Sample: len(logs)}
+	for _, log := range logs {
+		if data.LogMatchesRule(log, &current) {
+			result.Current++
+		}
+		if data.LogMatchesRule(log, generalized) {
+			result.Proposed++
+		}
+	}
+	return &result
+}
+
 func findMatchingLogs(db *data.Database, rule *data.LogRule) *LogListModel {
 	m := LogListModel{
-		Config:                 LogListConfig{Filter: data.LogVerdictUnknown},
+		Config:                 LogListConfig{Filter: data.LogVerdictUnknownKey},
 		DB:                     db,
 		LogRules:               []*data.LogRule{rule},
 		DisableActions:         true,
@@ -126,6 +388,50 @@ func findMatchingOtherRules(db *data.Database, logs []*data.Log, skipRule *data.
 	return nil
 }
 
+// LogRuleFixtureStatus is the state of the fixtures shown in the rule
+// editor
+type LogRuleFixtureStatus struct {
+	// Failures involving the edited rule (as if it was saved)
+	Failures []*data.LogRuleFixtureFailure
+
+	// Number of other failures within the (saved) ruleset
+	Others int
+
+	// Was save refused because of the failures?
+	SaveRefused bool
+}
+
+// ruleFixtureStatus returns the fixture state of the rule; the other
+// failures are counted only if previewing, as that checks the fixtures
+// of the whole ruleset
+func ruleFixtureStatus(db *data.Database, rule *data.LogRule, preview bool) *LogRuleFixtureStatus {
+	status := LogRuleFixtureStatus{Failures: db.RuleFixtureFailures(*rule)}
+	if !preview {
+		return &status
+	}
+	for _, failure := range db.FixtureFailures() {
+		involved := rule.ID != 0 && (failure.Rule.ID == rule.ID || (failure.By != nil && failure.By.ID == rule.ID))
+		if !involved {
+			status.Others++
+		}
+	}
+	return &status
+}
+
+// ruleImpact returns the impact of saving the rule on the cached logs.
+// As it rematches all of them, it is done only if explicitly previewed
+// (and not on every change within the editor).
+func ruleImpact(db *data.Database, rule *data.LogRule, preview bool) *data.LogRulesDiff {
+	if !preview {
+		return nil
+	}
+	diff, err := db.WhatIfRule(*rule)
+	if err != nil {
+		return nil
+	}
+	return diff
+}
+
 func logRuleEditHandler(st State) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		db := st.DB
@@ -134,18 +440,26 @@ func logRuleEditHandler(st State) http.Handler {
 			// TODO log error?
 			return
 		}
-		if r.FormValue(actionSave) != "" {
-			err := db.AddOrUpdate(*rule)
-			if err != nil {
-				http.Error(w, err.Error(), 500)
+		preview := r.FormValue(actionPreview) != ""
+		fixtures := ruleFixtureStatus(db, rule, preview)
+		// Invalid rules are not saved; the problems are shown inline
+		// instead. Fixture failures need to be explicitly accepted.
+		saveAnyway := r.FormValue(actionSaveAnyway) != ""
+		if (r.FormValue(actionSave) != "" || saveAnyway) && rule.Validate() == nil {
+			if len(fixtures.Failures) == 0 || saveAnyway {
+				err := db.AddOrUpdate(*rule)
+				if err != nil {
+					http.Error(w, err.Error(), 500)
+					return
+				}
+				http.Redirect(w, r, topLevelLogRule.Path, http.StatusSeeOther)
 				return
 			}
-			http.Redirect(w, r, topLevelLogRule.Path, http.StatusSeeOther)
-			return
+			fixtures.SaveRefused = true
 		}
 		logs := findMatchingLogs(db, rule)
 		rules := findMatchingOtherRules(db, logs.Logs, rule)
-		err = LogRuleEdit(st, *rule, rules, logs).Render(r.Context(), w)
+		err = LogRuleEdit(st, *rule, rules, logs, generalizeLogRule(db, rule), fixtures, ruleImpact(db, rule, preview)).Render(r.Context(), w)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 		}
@@ -168,6 +482,58 @@ func logRuleDeleteSpecificHandler(st State) http.Handler {
 	})
 }
 
+// requirePost refuses the requests which would change state with
+// other methods than POST
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodPost {
+		return true
+	}
+	w.Header().Set("Allow", http.MethodPost)
+	http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+	return false
+}
+
+func logRuleMoveSpecificHandler(st State, up bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !requirePost(w, r) {
+			return
+		}
+		rid, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err = st.DB.MoveUp(rid, up); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, topLevelLogRule.Path, http.StatusSeeOther)
+	})
+}
+
+func logRuleMoveAboveSpecificHandler(st State) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !requirePost(w, r) {
+			return
+		}
+		rid, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		var above int
+		if _, err = cm.IntFromForm(r, aboveKey, &above); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err = st.DB.Move(rid, above, true); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, topLevelLogRule.Path, http.StatusSeeOther)
+	})
+}
+
 func logRuleEditSpecificHandler(st State) http.Handler {
 	db := st.DB
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -181,7 +547,7 @@ func logRuleEditSpecificHandler(st State) http.Handler {
 			if rule.ID == rid {
 				logs := findMatchingLogs(db, rule)
 				rules := findMatchingOtherRules(db, logs.Logs, rule)
-				err = LogRuleEdit(st, *rule, rules, logs).Render(r.Context(), w)
+				err = LogRuleEdit(st, *rule, rules, logs, generalizeLogRule(db, rule), ruleFixtureStatus(db, rule, false), ruleImpact(db, rule, false)).Render(r.Context(), w)
 				if err != nil {
 					http.Error(w, err.Error(), 500)
 				}
@@ -192,10 +558,57 @@ func logRuleEditSpecificHandler(st State) http.Handler {
 	})
 }
 
+func logRuleLintHandler(st State) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := LogRuleLint(st, st.DB.LogRules.Invalid(), st.DB.FixtureFailures()).Render(r.Context(), w)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+		}
+	})
+}
+
+func logRuleAnalysisHandler(st State) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		issues := data.AnalyzeLogRules(st.DB.LogRules.Ordered)
+		err := LogRuleAnalysis(st, issues).Render(r.Context(), w)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+		}
+	})
+}
+
+func logRuleIssueKindString(kind int) string {
+	switch kind {
+	case data.LogRuleIssueShadowed:
+		return "Shadowed"
+	case data.LogRuleIssueConflict:
+		return "Conflict"
+	}
+	return "Unknown"
+}
+
 func fieldID(id int, suffix string) string {
 	return fmt.Sprintf("row-%d-%s", id, suffix)
 }
 
+func groupTitle(op string) string {
+	switch op {
+	case data.GroupAnd:
+		return "All of (AND)"
+	case data.GroupOr:
+		return "Any of (OR)"
+	case data.GroupNot:
+		return "Not all of (NOT)"
+	}
+	return op
+}
+
+// groupPrefix returns the field name prefix of the nth group within
+// the given (group) prefix
+func groupPrefix(prefix string, n int) string {
+	return fmt.Sprintf("%sg%d-", prefix, n)
+}
+
 func ruleTitle(rule data.LogRule) string {
 	if rule.ID > 0 {
 		return fmt.Sprintf("Log rule editor - editing #%d", rule.ID)
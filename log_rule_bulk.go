@@ -0,0 +1,102 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Bulk operations on rules (disabling or enabling a set of them), with
+preview of their impact on the cached logs. Preview works with any
+method, but applying the operation requires POST.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/fingon/lixie/data"
+)
+
+// bulk form fields
+const (
+	bulkRuleKey   = "r"
+	bulkEnableKey = "en"
+)
+
+// bulk actions
+const (
+	actionPreview = "p"
+	actionApply   = "ap"
+)
+
+type LogRuleBulkModel struct {
+	Rules    []*data.LogRule
+	Selected map[int]bool
+
+	// Enable (instead of disable) the selected rules
+	Enable bool
+
+	// Impact of the operation, if previewed
+	Diff *data.LogRulesDiff
+}
+
+// whatIfRuleString describes the (current or proposed) rule of a log
+func whatIfRuleString(rule *data.LogRule) string {
+	if rule == nil {
+		return "no rule"
+	}
+	return "#" + strconv.Itoa(rule.ID)
+}
+
+func logRuleBulkHandler(st State) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		db := st.DB
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		m := LogRuleBulkModel{
+			Rules:    db.LogRules.Ordered,
+			Selected: make(map[int]bool),
+			Enable:   r.FormValue(bulkEnableKey) != "",
+		}
+		var rids []int
+		for _, s := range r.Form[bulkRuleKey] {
+			rid, err := strconv.Atoi(s)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			m.Selected[rid] = true
+			rids = append(rids, rid)
+		}
+		if len(rids) > 0 {
+			if r.FormValue(actionApply) != "" {
+				if !requirePost(w, r) {
+					return
+				}
+				if err := db.SetDisabled(rids, !m.Enable); err != nil {
+					http.Error(w, err.Error(), 400)
+					return
+				}
+				http.Redirect(w, r, topLevelLogRule.Path, http.StatusSeeOther)
+				return
+			}
+			if r.FormValue(actionPreview) != "" {
+				diff, err := db.WhatIfDisabled(rids, !m.Enable)
+				if err != nil {
+					http.Error(w, err.Error(), 400)
+					return
+				}
+				m.Diff = diff
+			}
+		}
+		err := LogRuleBulk(st, m).Render(r.Context(), w)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+		}
+	})
+}
@@ -8,15 +8,45 @@
 package main
 
 import (
+	"cmp"
+	"fmt"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/fingon/lixie/cm"
 	"github.com/fingon/lixie/data"
 )
 
-const indexKey = "i"
+const (
+	indexKey = "i"
+	sortKey  = "sort"
+	staleKey = "stale"
+)
+
+// Rule list orders (besides the default evaluation order)
+const (
+	sortLastSeen = "last-seen"
+	sortHits     = "hits"
+)
+
+var ruleListOrders = []struct {
+	Key   string
+	Title string
+}{
+	{"", "Evaluation order"},
+	{sortLastSeen, "Least recently seen"},
+	{sortHits, "Most hits"},
+}
+
+// Rules which have not matched in this long are stale
+const staleRuleAge = 30 * 24 * time.Hour
+
+// Number of days shown in the hit sparklines
+const sparklineDays = 30
 
 // This struct represents external configuration - what we can get as query/form parameters
 type LogRuleListConfig struct {
@@ -25,6 +55,12 @@ type LogRuleListConfig struct {
 
 	// Paging support
 	Index int
+
+	// Order of the rules (empty for evaluation order)
+	Sort string
+
+	// Show only rules which have not matched in staleRuleAge
+	Stale bool
 }
 
 func (self *LogRuleListConfig) Init(r *http.Request, w http.ResponseWriter) error {
@@ -32,10 +68,12 @@ func (self *LogRuleListConfig) Init(r *http.Request, w http.ResponseWriter) erro
 	if err != nil {
 		return err
 	}
+	self.Sort = r.FormValue(sortKey)
+	cm.BoolFromForm(r, staleKey, &self.Stale)
 	return cm.Run(r, w, &self.Global)
 }
 
-func (self *LogRuleListConfig) ToLinkString() string {
+func (self LogRuleListConfig) ToLinkString() string {
 	base := topLevelLogRule.Path + "/"
 
 	v := url.Values{}
@@ -44,6 +82,12 @@ func (self *LogRuleListConfig) ToLinkString() string {
 	if self.Index != 0 {
 		v.Set(indexKey, strconv.Itoa(self.Index))
 	}
+	if self.Sort != "" {
+		v.Set(sortKey, self.Sort)
+	}
+	if self.Stale {
+		v.Set(staleKey, "1")
+	}
 	if len(v) == 0 {
 		return base
 	}
@@ -63,6 +107,90 @@ type LogRuleListModel struct {
 	Limit   int
 }
 
+func (self LogRuleListConfig) WithSort(sort string) LogRuleListConfig {
+	self.Sort = sort
+	self.Index = 0
+	return self
+}
+
+func (self LogRuleListConfig) WithStale(stale bool) LogRuleListConfig {
+	self.Stale = stale
+	self.Index = 0
+	return self
+}
+
+// applyStats filters and sorts the rules based on their hit statistics
+func (self *LogRuleListModel) applyStats(now time.Time) {
+	if !self.Config.Stale && self.Config.Sort == "" {
+		return
+	}
+	stats := make(map[int]*data.LogRuleStats, len(self.LogRules))
+	for _, rule := range self.LogRules {
+		stats[rule.ID] = self.DB.RuleStats(rule.ID)
+	}
+	rules := self.LogRules
+	if self.Config.Stale {
+		rules = slices.DeleteFunc(slices.Clone(rules), func(rule *data.LogRule) bool {
+			return stats[rule.ID].SeenSince(now.Add(-staleRuleAge))
+		})
+	}
+	switch self.Config.Sort {
+	case sortLastSeen:
+		rules = slices.Clone(rules)
+		slices.SortStableFunc(rules, func(a, b *data.LogRule) int {
+			return ruleLastSeen(stats[a.ID]).Compare(ruleLastSeen(stats[b.ID]))
+		})
+	case sortHits:
+		rules = slices.Clone(rules)
+		slices.SortStableFunc(rules, func(a, b *data.LogRule) int {
+			return cmp.Compare(ruleRecentHits(stats[b.ID], now), ruleRecentHits(stats[a.ID], now))
+		})
+	}
+	self.LogRules = rules
+}
+
+func ruleLastSeen(stats *data.LogRuleStats) time.Time {
+	if stats == nil {
+		return time.Time{}
+	}
+	return stats.LastSeen
+}
+
+func ruleRecentHits(stats *data.LogRuleStats, now time.Time) int {
+	if stats == nil {
+		return 0
+	}
+	hits := 0
+	for _, count := range stats.RecentDays(now, sparklineDays) {
+		hits += count
+	}
+	return hits
+}
+
+// Size of the sparklines (in pixels)
+const (
+	sparklineWidth  = 90
+	sparklineHeight = 20
+)
+
+// sparklinePoints returns the counts as SVG polyline points, scaled to
+// the sparkline size
+func sparklinePoints(counts []int) string {
+	highest := max(slices.Max(counts), 1)
+	var sb strings.Builder
+	for i, count := range counts {
+		x := i * sparklineWidth / max(len(counts)-1, 1)
+		y := sparklineHeight - 1 - count*(sparklineHeight-2)/highest
+		fmt.Fprintf(&sb, "%d,%d ", x, y)
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+func ruleHitsTitle(stats *data.LogRuleStats) string {
+	return fmt.Sprintf("%d hits in the last %d days; first seen %s",
+		ruleRecentHits(stats, time.Now()), sparklineDays, stats.FirstSeen.Format(time.DateTime))
+}
+
 func (self *LogRuleListModel) Filter() {
 	// First do fts (if necessary)
 	last := self.Config.Index + self.Limit
@@ -93,7 +221,8 @@ func logRuleListHandler(st State) http.Handler {
 			http.Error(w, err.Error(), 400)
 			return
 		}
-		m := LogRuleListModel{Config: config, DB: st.DB, LogRules: st.DB.LogRules.Reversed, Limit: 10}
+		m := LogRuleListModel{Config: config, DB: st.DB, LogRules: st.DB.LogRules.Ordered, Limit: 10}
+		m.applyStats(time.Now())
 		m.Filter()
 		err = LogRuleList(st, m).Render(r.Context(), w)
 		if err != nil {
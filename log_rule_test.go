@@ -12,56 +12,214 @@
 package main
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"reflect"
-	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/fingon/lixie/cm"
 	"github.com/fingon/lixie/data"
 	"gotest.tools/v3/assert"
 )
 
-func logRuleToWrapper(rule *data.LogRule) cm.URLWrapper {
-	w := cm.URLWrapper{}
-	// TODO: Manually populate corresponding values
-	// (normally browser does it so we don't have corresponding 'prod' code)
-	add := func(key, value string) {
-		w[key] = append(w[key], value)
-	}
-	add(idKey, strconv.Itoa(rule.ID))
-	add(versionKey, strconv.Itoa(rule.Version))
-	add(commentKey, rule.Comment)
-	if rule.Ham {
-		add(hamKey, "1")
-	}
-	if rule.Disabled {
-		add(disabledKey, "1")
-	}
-	for i, m := range rule.Matchers {
-		add(fieldID(i, fieldField), m.Field)
-		add(fieldID(i, opField), m.Op)
-		add(fieldID(i, valueField), m.Value)
-	}
-	return w
-}
-
 func TestLogRuleEndecode(t *testing.T) {
 	rule := data.LogRule{
 		ID:       42,
 		Disabled: true,
-		Ham:      true,
+		Verdict:  "security",
 		Matchers: []data.LogFieldMatcher{{
 			Field: "key",
 			Op:    "=",
 			Value: "value",
 		}},
-		Comment: "a comment",
-		Version: 7,
+		Priority: 3,
+		Comment:  "a comment",
+		Version:  7,
 	}
-	w := logRuleToWrapper(&rule)
+	from := time.Date(2024, 6, 1, 12, 34, 56, 0, time.Local)
+	rule.ValidFrom = &from
+	rule.ValidUntil = &from
+	rule.Rate = &data.LogRuleRate{Count: 5, Window: "1m", PerLabel: "host", Verdict: "ham"}
+	rule.Groups = []data.LogMatcherGroup{{
+		Op:       data.GroupOr,
+		Matchers: []data.LogFieldMatcher{{Field: "a", Op: "=", Value: "1"}},
+		Groups: []data.LogMatcherGroup{{
+			Op:       data.GroupNot,
+			Matchers: []data.LogFieldMatcher{{Field: "b", Op: "=~", Value: "2"}},
+		}},
+	}}
+	rule.MustMatch = []data.LogRuleFixture{{Stream: map[string]string{"source": "x"}, Message: "foo"}}
+	rule.MustNotMatch = []data.LogRuleFixture{{Message: "bar"}}
+	w := cm.URLWrapper(logRuleValues(&rule))
 
 	rule2, err := NewLogRuleFromForm(w)
 	assert.Equal(t, err, nil)
 
 	assert.Assert(t, reflect.DeepEqual(rule, *rule2))
 }
+
+func TestLogRuleFormGroups(t *testing.T) {
+	rule := data.LogRule{Groups: []data.LogMatcherGroup{{Op: data.GroupOr}}}
+	v := logRuleValues(&rule)
+	v.Set(actionAddGroup, "1")
+	v.Set(groupPrefix("", 0)+actionAdd, "1")
+	rule2, err := NewLogRuleFromForm(cm.URLWrapper(v))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(rule2.Groups), 2)
+	assert.Equal(t, len(rule2.Groups[0].Matchers), 1)
+
+	v = logRuleValues(rule2)
+	v.Set(groupPrefix("", 0)+deleteGroupField, "1")
+	rule3, err := NewLogRuleFromForm(cm.URLWrapper(v))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(rule3.Groups), 1)
+}
+
+func TestLogRuleFormFixtures(t *testing.T) {
+	rule := data.LogRule{MustMatch: []data.LogRuleFixture{{Message: "a"}, {Message: "b"}}}
+	v := logRuleValues(&rule)
+	v.Set(mustMatchPrefix+fieldID(0, deleteField), "1")
+	v.Set(mustNotMatchPrefix+actionAdd, "1")
+	rule2, err := NewLogRuleFromForm(cm.URLWrapper(v))
+	assert.Equal(t, err, nil)
+	assert.DeepEqual(t, rule2.MustMatch, []data.LogRuleFixture{{Message: "b"}})
+	assert.Equal(t, len(rule2.MustNotMatch), 1)
+}
+
+// saveLogRuleForm saves the rule through the rule editor
+func saveLogRuleForm(t *testing.T, db *data.Database, rule *data.LogRule) *httptest.ResponseRecorder {
+	t.Helper()
+	return postLogRuleForm(t, db, rule, actionSave)
+}
+
+// postLogRuleForm submits the rule to the rule editor with the action
+// (if any)
+func postLogRuleForm(t *testing.T, db *data.Database, rule *data.LogRule, action string) *httptest.ResponseRecorder {
+	t.Helper()
+	v := logRuleValues(rule)
+	if action != "" {
+		v.Set(action, "1")
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, topLevelLogRule.Path+"/edit", strings.NewReader(v.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	logRuleEditHandler(State{DB: db}).ServeHTTP(w, r)
+	return w
+}
+
+func TestLogRuleEditSaveBlankMatcher(t *testing.T) {
+	path := "test_db.json"
+	_ = os.Remove(path)
+	defer os.Remove(path)
+
+	db := data.Database{Path: path}
+	rule := data.LogRule{Matchers: []data.LogFieldMatcher{{Field: "message", Op: data.OpEqual, Value: "x"}}}
+	v := logRuleValues(&rule)
+	v.Set(actionAdd, "1")
+	rule2, err := NewLogRuleFromForm(cm.URLWrapper(v))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(rule2.Matchers), 2)
+
+	w := saveLogRuleForm(t, &db, rule2)
+	assert.Equal(t, w.Code, http.StatusSeeOther)
+	assert.Equal(t, len(db.LogRules.Rules), 1)
+}
+
+func TestLogRuleMoveHandlers(t *testing.T) {
+	path := "test_db.json"
+	_ = os.Remove(path)
+	defer os.Remove(path)
+
+	db := data.Database{Path: path}
+	for range 2 {
+		assert.Equal(t, db.Add(data.LogRule{}), nil)
+	}
+	st := State{DB: &db}
+	serve := func(handler http.Handler, method, body string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetPathValue("id", "1")
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// State is changed only with POST
+	assert.Equal(t, serve(logRuleMoveSpecificHandler(st, true), http.MethodGet, ""), http.StatusMethodNotAllowed)
+	assert.Equal(t, db.LogRules.Ordered[0].ID, 2)
+	assert.Equal(t, serve(logRuleMoveSpecificHandler(st, true), http.MethodPost, ""), http.StatusSeeOther)
+	assert.Equal(t, db.LogRules.Ordered[0].ID, 1)
+
+	assert.Equal(t, serve(logRuleMoveAboveSpecificHandler(st), http.MethodGet, aboveKey+"=2"), http.StatusMethodNotAllowed)
+	assert.Equal(t, serve(logRuleMoveAboveSpecificHandler(st), http.MethodPost, aboveKey+"=1"), http.StatusSeeOther)
+	assert.Equal(t, db.LogRules.Ordered[0].ID, 1)
+}
+
+func TestLogRuleEditSaveNewGroup(t *testing.T) {
+	path := "test_db.json"
+	_ = os.Remove(path)
+	defer os.Remove(path)
+
+	db := data.Database{Path: path}
+	rule := data.LogRule{Matchers: []data.LogFieldMatcher{{Field: "message", Op: data.OpEqual, Value: "x"}}}
+	v := logRuleValues(&rule)
+	v.Set(actionAddGroup, "1")
+	rule2, err := NewLogRuleFromForm(cm.URLWrapper(v))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(rule2.Groups), 1)
+	assert.Assert(t, rule2.Groups[0].Empty())
+
+	w := saveLogRuleForm(t, &db, rule2)
+	assert.Equal(t, w.Code, http.StatusSeeOther)
+	assert.Equal(t, len(db.LogRules.Rules), 1)
+	assert.Equal(t, len(db.LogRules.Rules[0].Groups), 1)
+
+	// The empty group does not change what the rule matches
+	assert.Assert(t, data.LogMatchesRule(data.NewLog(1, nil, "x"), db.LogRules.Rules[0]))
+	assert.Assert(t, !data.LogMatchesRule(data.NewLog(1, nil, "y"), db.LogRules.Rules[0]))
+}
+
+func TestLogRuleEditPreview(t *testing.T) {
+	path := "test_db.json"
+	_ = os.Remove(path)
+	defer os.Remove(path)
+
+	logs := []*data.Log{data.NewLog(1, nil, "x")}
+	db := data.Database{Path: path, Source: &data.ArraySource{Data: logs, Chunk: 1}}
+	rule := data.LogRule{Matchers: []data.LogFieldMatcher{{Field: "message", Op: data.OpEqual, Value: "x"}}}
+
+	// The impact is evaluated only when explicitly previewed
+	w := postLogRuleForm(t, &db, &rule, "")
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Assert(t, !strings.Contains(w.Body.String(), "Impact on"))
+
+	w = postLogRuleForm(t, &db, &rule, actionPreview)
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Assert(t, strings.Contains(w.Body.String(), "Impact on 1 cached logs"), w.Body.String())
+}
+
+func TestLogRuleBulkHandler(t *testing.T) {
+	path := "test_db.json"
+	_ = os.Remove(path)
+	defer os.Remove(path)
+
+	db := data.Database{Path: path, Source: &data.ArraySource{}}
+	assert.Equal(t, db.Add(data.LogRule{}), nil)
+	st := State{DB: &db}
+	serve := func(method, query string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, topLevelLogRule.Path+"/bulk?"+query, nil)
+		logRuleBulkHandler(st).ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// Preview works with GET, but applying requires POST
+	assert.Equal(t, serve(http.MethodGet, bulkRuleKey+"=1&"+actionPreview+"=1"), http.StatusOK)
+	assert.Equal(t, serve(http.MethodGet, bulkRuleKey+"=1&"+actionApply+"=1"), http.StatusMethodNotAllowed)
+	assert.Assert(t, !db.LogRules.Rules[0].Disabled)
+	assert.Equal(t, serve(http.MethodPost, bulkRuleKey+"=1&"+actionApply+"=1"), http.StatusSeeOther)
+	assert.Assert(t, db.LogRules.Rules[0].Disabled)
+}
@@ -0,0 +1,45 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/fingon/lixie/data"
+	"gotest.tools/v3/assert"
+)
+
+func TestLogClassifyHandler(t *testing.T) {
+	path := "test_db.json"
+	_ = os.Remove(path)
+	defer os.Remove(path)
+
+	log := data.NewLog(123, map[string]string{"source": "a"}, "message")
+	db := data.Database{Path: path, Source: &data.ArraySource{Data: []*data.Log{log}, Chunk: 1}}
+	_, err := db.Logs()
+	assert.Equal(t, err, nil)
+	st := State{DB: &db}
+	classify := func(verdict string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.SetPathValue("hash", strconv.FormatUint(log.Hash(), 10))
+		r.SetPathValue("verdict", verdict)
+		logClassifyHandler(st).ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, classify("bogus"), http.StatusNotFound)
+	assert.Equal(t, classify(data.LogVerdictUnknownKey), http.StatusBadRequest)
+	assert.Equal(t, len(db.LogRules.Rules), 0)
+	assert.Equal(t, classify(data.LogVerdictHamKey), http.StatusSeeOther)
+	assert.Equal(t, len(db.LogRules.Rules), 1)
+}
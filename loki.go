@@ -0,0 +1,92 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Loki integration.
+
+ The rules which drop logs (spam by default) are available as a LogQL
+query (see data/logql.go), which the Loki source can also use itself
+(-loki-filter), and as a Loki ruler recording rules file with the
+volume of the dropped logs per source.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/fingon/lixie/data"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	lokiDefaultSelector = `{host=~".+"}`
+	lokiDefaultBy       = "source"
+	lokiRuleGroup       = "lixie"
+	lokiRuleRange       = "5m"
+)
+
+type lokiRule struct {
+	Record string `yaml:"record"`
+	Expr   string `yaml:"expr"`
+}
+
+type lokiRuleGroupSpec struct {
+	Name  string     `yaml:"name"`
+	Rules []lokiRule `yaml:"rules"`
+}
+
+type lokiRuleFile struct {
+	Groups []lokiRuleGroupSpec `yaml:"groups"`
+}
+
+var lokiMetricNameInvalid = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// lokiQuery returns the query for the logs that are kept
+func lokiQuery(filter *data.LogQLFilter, selector string) string {
+	if keep := filter.Keep(); keep != "" {
+		return selector + " " + keep
+	}
+	return selector
+}
+
+// lokiRecordingRules returns the Loki ruler recording rules for the
+// volume of the dropped logs, grouped by the given labels
+func lokiRecordingRules(filter *data.LogQLFilter, options data.ExportOptions, selector string, by []string) ([]byte, error) {
+	name := "spam"
+	if len(options.Drop) > 0 {
+		name = lokiMetricNameInvalid.ReplaceAllString(strings.Join(options.Drop, "_"), "_")
+	}
+	logs := strings.TrimSpace(selector + " " + filter.Dropped())
+	grouping := ""
+	if len(by) > 0 {
+		grouping = fmt.Sprintf(" by (%s)", strings.Join(by, ", "))
+	}
+	file := lokiRuleFile{Groups: []lokiRuleGroupSpec{{
+		Name: lokiRuleGroup,
+		Rules: []lokiRule{
+			{
+				Record: fmt.Sprintf("lixie:%s_log_lines:rate%s", name, lokiRuleRange),
+				Expr:   fmt.Sprintf("sum%s (rate(%s [%s]))", grouping, logs, lokiRuleRange),
+			},
+			{
+				Record: fmt.Sprintf("lixie:%s_log_bytes:rate%s", name, lokiRuleRange),
+				Expr:   fmt.Sprintf("sum%s (bytes_rate(%s [%s]))", grouping, logs, lokiRuleRange),
+			},
+		},
+	}}}
+	var b bytes.Buffer
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&file); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -55,6 +55,68 @@ func mainHandler(st State) http.Handler {
 	})
 }
 
+// How often expired rules are looked for
+const expiredRuleCleanupInterval = 10 * time.Minute
+
+// cleanupExpiredRules removes rules which have been expired for longer
+// than the grace period, until the context is done
+func cleanupExpiredRules(ctx context.Context, db *data.Database, grace time.Duration) {
+	ticker := time.NewTicker(expiredRuleCleanupInterval)
+	defer ticker.Stop()
+	for {
+		removed, err := db.DeleteExpired(time.Now().Add(-grace))
+		if err != nil {
+			slog.Error("Unable to remove expired rules", "err", err)
+		} else if removed > 0 {
+			slog.Info("Removed expired rules", "count", removed)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// How often the rule statistics are persisted
+const statsSaveInterval = time.Minute
+
+// saveStats persists the rule statistics periodically, and once more
+// when the context is done
+func saveStats(ctx context.Context, db *data.Database) {
+	ticker := time.NewTicker(statsSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+		if err := db.SaveStats(); err != nil {
+			slog.Error("Unable to save rule statistics", "err", err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// fetchLogs fetches the logs periodically, so that the alerts and the
+// Loki sink do not depend on someone looking at the logs
+func fetchLogs(ctx context.Context, db *data.Database, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := db.Logs(); err != nil {
+			slog.Error("Unable to fetch logs", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 func newMux(st State) http.Handler {
 	mux := http.NewServeMux()
 
@@ -67,13 +129,25 @@ func newMux(st State) http.Handler {
 	mux.Handle("/{$}", mainHandler(st))
 
 	mux.Handle(topLevelLog.PathMatcher(), logListHandler(st))
-	mux.Handle(topLevelLog.Path+"/{hash}/ham", logClassifyHandler(st, true))
-	mux.Handle(topLevelLog.Path+"/{hash}/spam", logClassifyHandler(st, false))
+	mux.Handle(logExport.Path, logExportHandler(st))
+	mux.Handle(topLevelLog.Path+"/{hash}/{verdict}", logClassifyHandler(st))
+	mux.Handle(topLevelLog.Path+"/{hash}/rule", logRuleFromHashHandler(st))
+	mux.Handle(topLevelLog.Path+"/{hash}/snooze", logSnoozeHandler(st))
 
 	mux.Handle(topLevelLogRule.PathMatcher(), logRuleListHandler(st))
 	mux.Handle(topLevelLogRule.Path+"/edit", logRuleEditHandler(st))
+	mux.Handle(logRuleLint.Path, logRuleLintHandler(st))
+	mux.Handle(logRuleAnalysis.Path, logRuleAnalysisHandler(st))
+	mux.Handle(logRuleBulk.Path, logRuleBulkHandler(st))
+	mux.Handle(logRuleVector.Path, vectorHandler(st))
 	mux.Handle(topLevelLogRule.Path+"/{id}/delete", logRuleDeleteSpecificHandler(st))
 	mux.Handle(topLevelLogRule.Path+"/{id}/edit", logRuleEditSpecificHandler(st))
+	mux.Handle(topLevelLogRule.Path+"/{id}/up", logRuleMoveSpecificHandler(st, true))
+	mux.Handle(topLevelLogRule.Path+"/{id}/down", logRuleMoveSpecificHandler(st, false))
+	mux.Handle(topLevelLogRule.Path+"/{id}/move", logRuleMoveAboveSpecificHandler(st))
+	mux.Handle(topLevelLogCluster.PathMatcher(), logClusterListHandler(st))
+	mux.Handle(apiClassify.Path, classifyHandler(st))
+	mux.Handle(metricsPage.Path, metricsHandler(st))
 	mux.Handle("/version", versionHandler(st))
 
 	// Static content
@@ -101,36 +175,79 @@ func run(
 	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt)
 	defer cancel()
 
+	if cmd, cmdArgs := findCommand(args); cmd != nil {
+		return cmd(ctx, cmdArgs, os.Stdout)
+	}
+
 	// CLI
 	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
 	address := flags.String("address", "127.0.0.1", "Address to listen at")
 	lokiServer := flags.String("loki-server", "https://fw.fingon.iki.fi:3100", "Address of the Loki server")
-	lokiSelector := flags.String("loki-selector", `{host=~".+"}`, "Selector to use when querying logs from Loki")
+	lokiSelector := flags.String("loki-selector", lokiDefaultSelector, "Selector to use when querying logs from Loki")
+	lokiFilter := flags.Bool("loki-filter", false, "Filter out the logs the rules mark as spam already within the Loki queries")
 	arrayFile := flags.String("log-source-file", "", "Log file source")
 	dbPath := flags.String("db", "db.json", "Database to use")
 	dev := flags.Bool("dev", false, "Enable development mode")
+	expiredGrace := flags.Duration("expired-rule-grace", 24*time.Hour, "How long expired rules are kept before they are removed")
+	alertsPath := flags.String("alerts", "", "Alert rules (JSON) for the newly fetched logs")
+	fetchInterval := flags.Duration("fetch-interval", time.Minute, "How often the logs are fetched when alerting or pushing them to Loki")
+	digestPath := flags.String("digest", "", "Email digest configuration (JSON)")
+	lokiPush := flags.String("loki-push", "", "Address of the Loki server to push the classified logs to")
+	lokiPushTenant := flags.String("loki-push-tenant", "", "Tenant (X-Scope-OrgID) to push the classified logs as")
+	lokiPushSkipSpam := flags.Bool("loki-push-skip-spam", false, "Do not push the logs the rules mark as spam")
+	lokiPushMetadata := flags.Bool("loki-push-metadata", false, "Push the verdict and the rule as structured metadata instead of labels")
 
 	port := flags.Int("port", 8080, "Port number to listen at")
 	if err := flags.Parse(args[1:]); err != nil {
 		return err
 	}
 
-	var source data.LogSource
+	db := data.Database{Path: *dbPath}
 	if *arrayFile != "" {
 		arr := data.ArraySource{}
 		err := data.UnmarshalJSONFromPath(&arr, *arrayFile)
 		if err != nil {
 			return err
 		}
-		source = &arr
+		db.Source = &arr
 	} else {
-		source = &data.LokiSource{Server: *lokiServer, Selector: *lokiSelector}
+		loki := data.LokiSource{Server: *lokiServer, Selector: *lokiSelector}
+		if *lokiFilter {
+			db.SourceFiltered = []string{data.LogVerdictSpamKey}
+			loki.Filter = func() string {
+				// Called with the database locked
+				return db.LogRules.LogQLFilter(time.Now(), data.ExportOptions{Drop: db.SourceFiltered}).Keep()
+			}
+		}
+		db.Source = &loki
 	}
-	db := data.Database{Source: source, Path: *dbPath}
 	err := db.Load()
 	if err != nil {
 		return err
 	}
+	if *alertsPath != "" {
+		alerter := data.Alerter{}
+		err = data.UnmarshalJSONFromPath(&alerter, *alertsPath)
+		if err != nil {
+			return err
+		}
+		err = alerter.Validate()
+		if err != nil {
+			return err
+		}
+		alerter.Since = time.Now()
+		db.Alerter = &alerter
+	}
+	if *lokiPush != "" {
+		db.LokiSink = &data.LokiSink{Server: *lokiPush, Tenant: *lokiPushTenant, SkipSpam: *lokiPushSkipSpam, Metadata: *lokiPushMetadata}
+	}
+	var digest *digestConfig
+	if *digestPath != "" {
+		digest, err = loadDigestConfig(*digestPath)
+		if err != nil {
+			return err
+		}
+	}
 
 	state := State{DB: &db, BuildTimestamp: ldBuildTimestamp}
 	if *dev {
@@ -152,6 +269,50 @@ func run(
 	}()
 
 	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		cleanupExpiredRules(ctx, &db, *expiredGrace)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		saveStats(ctx, &db)
+	}()
+
+	if db.Alerter != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db.Alerter.Run(ctx)
+		}()
+	}
+
+	if db.LokiSink != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db.LokiSink.Run(ctx)
+		}()
+	}
+
+	if db.Alerter != nil || db.LokiSink != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fetchLogs(ctx, &db, *fetchInterval)
+		}()
+	}
+
+	if digest != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runDigests(ctx, &db, digest)
+		}()
+	}
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -0,0 +1,25 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Prometheus metrics endpoint (see data/metrics.go).
+*/
+
+package main
+
+import (
+	"net/http"
+)
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+func metricsHandler(st State) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+		st.DB.WriteMetrics(w)
+	})
+}
@@ -0,0 +1,30 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fingon/lixie/data"
+	"gotest.tools/v3/assert"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	db := data.Database{}
+	st := State{DB: &db}
+
+	w := httptest.NewRecorder()
+	metricsHandler(st).ServeHTTP(w, httptest.NewRequest(http.MethodGet, metricsPage.Path, nil))
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Header().Get("Content-Type"), metricsContentType)
+	assert.Assert(t, strings.Contains(w.Body.String(), "# TYPE lixie_rule_hits_total counter\n"), w.Body.String())
+	assert.Assert(t, strings.Contains(w.Body.String(), "lixie_unknown_logs 0\n"), w.Body.String())
+}
@@ -15,6 +15,7 @@ const (
 	TopLevelMain int = iota
 	TopLevelLog
 	TopLevelLogRule
+	TopLevelLogCluster
 )
 
 type PageInfo struct {
@@ -32,10 +33,25 @@ func (self *PageInfo) URL() templ.SafeURL {
 }
 
 var (
-	topLevelLog     = PageInfo{TopLevelLog, "Logs", "/log"}
-	topLevelLogRule = PageInfo{TopLevelLogRule, "Log rules", "/log/rule"}
+	topLevelLog        = PageInfo{TopLevelLog, "Logs", "/log"}
+	topLevelLogRule    = PageInfo{TopLevelLogRule, "Log rules", "/log/rule"}
+	topLevelLogCluster = PageInfo{TopLevelLogCluster, "Log templates", "/log/cluster"}
 )
 
-var topLevelInfos = []PageInfo{topLevelLog, topLevelLogRule}
+var topLevelInfos = []PageInfo{topLevelLog, topLevelLogRule, topLevelLogCluster}
 
 var logRuleEdit = PageInfo{Path: "/log/rule/edit"}
+
+var logRuleLint = PageInfo{Path: "/log/rule/lint"}
+
+var logRuleAnalysis = PageInfo{Path: "/log/rule/analysis"}
+
+var logRuleBulk = PageInfo{Path: "/log/rule/bulk"}
+
+var logRuleVector = PageInfo{Path: "/log/rule/vector"}
+
+var logExport = PageInfo{Path: "/log/export"}
+
+var apiClassify = PageInfo{Path: "/api/v1/classify"}
+
+var metricsPage = PageInfo{Path: "/metrics"}
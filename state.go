@@ -35,6 +35,9 @@ type LogSourceSummary struct {
 	Source    string
 	RuleCount int
 	Hits      int
+
+	// Hits by verdict (indexed by verdict)
+	VerdictHits []int
 }
 
 func (self *LogSourceSummary) SearchLink() templ.SafeURL {
@@ -53,11 +56,13 @@ func (self *State) RuleStats() []*LogSourceSummary {
 		ss := rule.SourceString()
 		entry, ok := temp[ss]
 		if !ok {
-			entry = &LogSourceSummary{Source: ss}
+			entry = &LogSourceSummary{Source: ss, VerdictHits: make([]int, len(data.LogVerdicts()))}
 			temp[ss] = entry
 		}
+		hits := self.DB.RuleCount(rule.ID)
 		entry.RuleCount++
-		entry.Hits += self.DB.RuleCount(rule.ID)
+		entry.Hits += hits
+		entry.VerdictHits[data.LogRuleToVerdict(rule)] += hits
 	}
 	stats := maps.Values(temp)
 	sort.Slice(stats, func(i, j int) bool {
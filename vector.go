@@ -0,0 +1,308 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+/*
+ Vector configuration generation.
+
+ The ruleset is available as a VRL program (see data/vrl.go) both
+from the running instance and with the 'vector' subcommand. Either can
+also rewrite the source of a named remap transform within a Vector
+configuration file, leaving the rest of it as is.
+
+ YAML configurations are rewritten using the YAML node tree (so
+comments survive, but the indentation is normalized). TOML
+configurations are rewritten line by line, and the transform must be
+defined as its own table (e.g. [transforms.lixie_log]).
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/fingon/lixie/data"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	vectorFormatYAML = "yaml"
+	vectorFormatTOML = "toml"
+
+	// Default name of the remap transform to rewrite
+	vectorDefaultTransform = "lixie_log"
+
+	// Maximum size of configuration accepted over HTTP
+	vectorMaxConfigSize = 16 << 20
+)
+
+var (
+	errVectorUnknownFormat     = errors.New("unknown vector configuration format")
+	errVectorTransformNotFound = errors.New("transform not found")
+	errVectorTransformNotRemap = errors.New("transform is not a remap transform")
+)
+
+// vectorFormat returns the configuration format based on the filename
+func vectorFormat(path string) (string, error) {
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		return vectorFormatYAML, nil
+	case ".toml":
+		return vectorFormatTOML, nil
+	}
+	return "", fmt.Errorf("%w: %q", errVectorUnknownFormat, path)
+}
+
+// rewriteVectorConfig replaces the source of the named remap
+// transform within the configuration with the VRL program
+func rewriteVectorConfig(config []byte, format, name, vrl string) ([]byte, error) {
+	switch format {
+	case vectorFormatYAML:
+		return rewriteVectorYAML(config, name, vrl)
+	case vectorFormatTOML:
+		return rewriteVectorTOML(config, name, vrl)
+	}
+	return nil, fmt.Errorf("%w: %q", errVectorUnknownFormat, format)
+}
+
+func yamlMapValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func rewriteVectorYAML(config []byte, name, vrl string) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(config, &doc); err != nil {
+		return nil, err
+	}
+	var root *yaml.Node
+	if len(doc.Content) > 0 {
+		root = doc.Content[0]
+	}
+	transform := yamlMapValue(yamlMapValue(root, "transforms"), name)
+	if transform == nil {
+		return nil, fmt.Errorf("%w: %q", errVectorTransformNotFound, name)
+	}
+	if kind := yamlMapValue(transform, "type"); kind == nil || kind.Value != "remap" {
+		return nil, fmt.Errorf("%w: %q", errVectorTransformNotRemap, name)
+	}
+	source := yamlMapValue(transform, "source")
+	if source == nil {
+		source = &yaml.Node{}
+		transform.Content = append(transform.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "source"}, source)
+	}
+	*source = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: vrl, Style: yaml.LiteralStyle}
+
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+var (
+	tomlTableRegexp    = regexp.MustCompile(`^\[\s*([^\[\]]+?)\s*\]\s*(#.*)?$`)
+	tomlKeyValueRegexp = regexp.MustCompile(`^("[^"]*"|'[^']*'|[A-Za-z0-9_-]+)\s*=\s*(.*)$`)
+)
+
+// tomlKey splits the (possibly dotted and quoted) TOML key to its parts
+func tomlKey(key string) []string {
+	var parts []string
+	var part strings.Builder
+	var quote rune
+	for _, r := range key {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				part.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '.':
+			parts = append(parts, strings.TrimSpace(part.String()))
+			part.Reset()
+		case r != ' ' && r != '\t':
+			part.WriteRune(r)
+		}
+	}
+	return append(parts, strings.TrimSpace(part.String()))
+}
+
+// tomlString returns the value of a single-line TOML string (ignoring
+// escapes, as it is used only for the transform type)
+func tomlString(value string) string {
+	if value == "" || (value[0] != '"' && value[0] != '\'') {
+		return ""
+	}
+	s, _, _ := strings.Cut(value[1:], value[:1])
+	return s
+}
+
+func tomlMultilineString(s string) string {
+	if !strings.Contains(s, "'''") {
+		return "'''\n" + s + "'''"
+	}
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"""` + "\n" + s + `"""`
+}
+
+func rewriteVectorTOML(config []byte, name, vrl string) ([]byte, error) {
+	lines := strings.SplitAfter(string(config), "\n")
+	inTransform, found := false, false
+	kindLine, sourceStart, sourceEnd := -1, -1, -1
+	for i := 0; i < len(lines); {
+		line := strings.TrimSpace(lines[i])
+		end := i + 1
+		if m := tomlTableRegexp.FindStringSubmatch(line); m != nil {
+			key := tomlKey(m[1])
+			inTransform = len(key) == 2 && key[0] == "transforms" && key[1] == name
+			found = found || inTransform
+		} else if m := tomlKeyValueRegexp.FindStringSubmatch(line); m != nil {
+			key, value := tomlKey(m[1]), m[2]
+			// Skip over multi-line strings
+			for _, delim := range []string{`"""`, "'''"} {
+				if rest, ok := strings.CutPrefix(value, delim); ok && !strings.Contains(rest, delim) {
+					for end < len(lines) && !strings.Contains(lines[end], delim) {
+						end++
+					}
+					end = min(end+1, len(lines))
+				}
+			}
+			if inTransform && len(key) == 1 {
+				switch key[0] {
+				case "type":
+					if tomlString(value) != "remap" {
+						return nil, fmt.Errorf("%w: %q", errVectorTransformNotRemap, name)
+					}
+					kindLine = i
+				case "source":
+					sourceStart, sourceEnd = i, end
+				}
+			}
+		}
+		i = end
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: %q", errVectorTransformNotFound, name)
+	}
+	if kindLine < 0 {
+		return nil, fmt.Errorf("%w: %q", errVectorTransformNotRemap, name)
+	}
+	source := "source = " + tomlMultilineString(vrl) + "\n"
+	if sourceStart < 0 {
+		sourceStart, sourceEnd = kindLine+1, kindLine+1
+	}
+	result := strings.Join(lines[:sourceStart], "")
+	if result != "" && !strings.HasSuffix(result, "\n") {
+		result += "\n"
+	}
+	result += source + strings.Join(lines[sourceEnd:], "")
+	return []byte(result), nil
+}
+
+// vectorCommand writes the ruleset as VRL, either to standard output,
+// or to the source of a remap transform within Vector configuration
+func vectorCommand(_ context.Context, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
+	dbPath := flags.String("db", "db.json", "Database to use")
+	configPath := flags.String("config", "", "Vector configuration (YAML or TOML) to rewrite; if not set, the VRL is written to standard output")
+	name := flags.String("name", vectorDefaultTransform, "Name of the remap transform to rewrite")
+	output := flags.String("o", "", "Where to write the rewritten configuration (default: the configuration itself)")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	db := data.Database{Path: *dbPath}
+	if err := db.Load(); err != nil {
+		return err
+	}
+	vrl := db.VRL()
+	if *configPath == "" {
+		_, err := io.WriteString(stdout, vrl)
+		return err
+	}
+	format, err := vectorFormat(*configPath)
+	if err != nil {
+		return err
+	}
+	config, err := os.ReadFile(*configPath)
+	if err != nil {
+		return err
+	}
+	config, err = rewriteVectorConfig(config, format, *name, vrl)
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		*output = *configPath
+	}
+	temp := *output + ".tmp"
+	if err = os.WriteFile(temp, config, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(temp, *output)
+}
+
+// vectorHandler serves the ruleset as VRL; POSTing Vector
+// configuration to it returns the configuration with the named remap
+// transform (name parameter) rewritten
+func vectorHandler(st State) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vrl := st.DB.VRL()
+		if r.Method != http.MethodPost {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_, _ = io.WriteString(w, vrl)
+			return
+		}
+
+		// The body is the configuration, not a form
+		query := r.URL.Query()
+		format := query.Get("format")
+		if format == "" {
+			format = vectorFormatYAML
+		}
+		name := query.Get("name")
+		if name == "" {
+			name = vectorDefaultTransform
+		}
+		config, err := io.ReadAll(http.MaxBytesReader(w, r.Body, vectorMaxConfigSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		config, err = rewriteVectorConfig(config, format, name, vrl)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write(config)
+	})
+}
@@ -0,0 +1,148 @@
+/*
+ * Author: Markus Stenberg <fingon@iki.fi>
+ *
+ * Copyright (c) 2024 Markus Stenberg
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fingon/lixie/data"
+	"gotest.tools/v3/assert"
+)
+
+const testVRL = ".lixie = \"unknown\"\nif .x == \"it's\" {\n  .lixie = \"spam\"\n}\n"
+
+func TestRewriteVectorYAML(t *testing.T) {
+	config := `# Vector configuration
+transforms:
+  lixie_log:
+    type: remap
+    inputs:
+      - remap_log
+    source: |
+      .lixie = "unknown"
+  other:
+    type: filter # not touched
+`
+	result, err := rewriteVectorConfig([]byte(config), vectorFormatYAML, "lixie_log", testVRL)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(result), `# Vector configuration
+transforms:
+  lixie_log:
+    type: remap
+    inputs:
+      - remap_log
+    source: |
+      .lixie = "unknown"
+      if .x == "it's" {
+        .lixie = "spam"
+      }
+  other:
+    type: filter # not touched
+`)
+
+	_, err = rewriteVectorConfig([]byte(config), vectorFormatYAML, "missing", testVRL)
+	assert.ErrorIs(t, err, errVectorTransformNotFound)
+	_, err = rewriteVectorConfig([]byte(config), vectorFormatYAML, "other", testVRL)
+	assert.ErrorIs(t, err, errVectorTransformNotRemap)
+}
+
+func TestRewriteVectorTOML(t *testing.T) {
+	config := `[transforms.other]
+type = "remap"
+source = """
+[transforms.lixie_log]
+"""
+
+[transforms.lixie_log]
+type = "remap" # comment
+inputs = ["remap_log"]
+source = '''
+.lixie = "unknown"
+'''
+
+[sinks.loki]
+type = "loki"
+`
+	expected := `[transforms.other]
+type = "remap"
+source = """
+[transforms.lixie_log]
+"""
+
+[transforms.lixie_log]
+type = "remap" # comment
+inputs = ["remap_log"]
+source = '''
+.lixie = "unknown"
+if .x == "it's" {
+  .lixie = "spam"
+}
+'''
+
+[sinks.loki]
+type = "loki"
+`
+	result, err := rewriteVectorConfig([]byte(config), vectorFormatTOML, "lixie_log", testVRL)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(result), expected)
+
+	// Missing source is added
+	result, err = rewriteVectorConfig([]byte("[transforms.\"lixie_log\"]\ntype = 'remap'\n"), vectorFormatTOML, "lixie_log", "x\n")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(result), "[transforms.\"lixie_log\"]\ntype = 'remap'\nsource = '''\nx\n'''\n")
+
+	_, err = rewriteVectorConfig([]byte(config), vectorFormatTOML, "loki", testVRL)
+	assert.ErrorIs(t, err, errVectorTransformNotFound)
+	_, err = rewriteVectorConfig([]byte("[transforms.x]\ntype = \"filter\"\n"), vectorFormatTOML, "x", testVRL)
+	assert.ErrorIs(t, err, errVectorTransformNotRemap)
+}
+
+func TestVectorCommand(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "db.json")
+	db := data.Database{Path: dbPath}
+	assert.Equal(t, db.Add(data.LogRule{Matchers: []data.LogFieldMatcher{{Field: "message", Op: data.OpEqual, Value: "foo"}}}), nil)
+
+	var out bytes.Buffer
+	assert.Equal(t, vectorCommand(context.Background(), []string{"lixie vector", "-db", dbPath}, &out), nil)
+	assert.Equal(t, out.String(), db.VRL())
+
+	configPath := filepath.Join(dir, "vector.toml")
+	assert.Equal(t, os.WriteFile(configPath, []byte("[transforms.lixie_log]\ntype = \"remap\"\n"), 0o644), nil)
+	assert.Equal(t, vectorCommand(context.Background(), []string{"lixie vector", "-db", dbPath, "-config", configPath}, &out), nil)
+	config, err := os.ReadFile(configPath)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(config), "[transforms.lixie_log]\ntype = \"remap\"\nsource = '''\n"+db.VRL()+"'''\n")
+}
+
+func TestVectorHandler(t *testing.T) {
+	db := data.Database{}
+	st := State{DB: &db}
+
+	w := httptest.NewRecorder()
+	vectorHandler(st).ServeHTTP(w, httptest.NewRequest(http.MethodGet, logRuleVector.Path, nil))
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Body.String(), db.VRL())
+
+	config := "transforms:\n  lixie_log:\n    type: remap\n"
+	w = httptest.NewRecorder()
+	vectorHandler(st).ServeHTTP(w, httptest.NewRequest(http.MethodPost, logRuleVector.Path, strings.NewReader(config)))
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Assert(t, strings.Contains(w.Body.String(), "    source: |\n      # Generated by Lixie"), w.Body.String())
+
+	w = httptest.NewRecorder()
+	vectorHandler(st).ServeHTTP(w, httptest.NewRequest(http.MethodPost, logRuleVector.Path+"?format=toml&name=x", strings.NewReader("")))
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+}